@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/rand"
+	"math/big"
+)
+
+// Account numbers are ten digits: nine random digits followed by a Luhn check digit
+// The check digit catches most typos, including any single wrong digit and most swapped
+// neighbours, before a lookup is made. Uniqueness is enforced by the database, with
+// CreateAccount picking a new number if it collides with an existing one
+// Accounts opened before check digits were added keep their old numbers, which are
+// below a million and so can't be mistaken for a ten digit number
+const (
+	accountNumberBodyMin   = 100000000
+	accountNumberBodyMax   = 999999999
+	legacyAccountNumberMax = 999999
+	// How many numbers CreateAccount tries before giving up on a run of collisions
+	maxAccountNumberAttempts = 5
+)
+
+// generateAccountNumber returns a random account number with a valid check digit
+func generateAccountNumber() (int64, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(accountNumberBodyMax-accountNumberBodyMin+1))
+	if err != nil {
+		return 0, err
+	}
+
+	body := n.Int64() + accountNumberBodyMin
+	return body*10 + luhnCheckDigit(body), nil
+}
+
+// ValidAccountNumber reports whether an account number is the right length and its check digit matches
+func ValidAccountNumber(number int64) bool {
+	body := number / 10
+	if body < accountNumberBodyMin || body > accountNumberBodyMax {
+		return false
+	}
+	return number%10 == luhnCheckDigit(body)
+}
+
+// AcceptedAccountNumber reports whether a number given to find an account is worth looking up
+// New numbers must have a matching check digit, old ones are taken as they are
+func AcceptedAccountNumber(number int64) bool {
+	return ValidAccountNumber(number) || (number > 0 && number <= legacyAccountNumberMax)
+}
+
+// luhnCheckDigit computes the Luhn check digit for a number
+// Starting from the rightmost digit every other digit is doubled, and the check digit
+// is what brings the sum of the digits up to a multiple of ten
+func luhnCheckDigit(body int64) int64 {
+	var sum int64
+	double := true
+	for ; body > 0; body /= 10 {
+		d := body % 10
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return (10 - sum%10) % 10
+}
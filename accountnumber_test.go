@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestGenerateAccountNumber(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		number, err := generateAccountNumber()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ValidAccountNumber(number) {
+			t.Fatalf("generated %d, which isn't a valid account number", number)
+		}
+	}
+}
+
+func TestValidAccountNumber(t *testing.T) {
+	tests := []struct {
+		number   int64
+		valid    bool
+		accepted bool
+	}{
+		{1234567897, true, true},
+		{1234567890, false, false}, // wrong check digit
+		{1234567987, false, false}, // neighbours swapped
+		{123456789, false, false},  // too short for a new number, too long for an old one
+		{12345678970, false, false},
+		{424242, false, true}, // issued before check digits
+		{1, false, true},
+		{0, false, false},
+		{-1234567897, false, false},
+	}
+	for _, tt := range tests {
+		if got := ValidAccountNumber(tt.number); got != tt.valid {
+			t.Errorf("ValidAccountNumber(%d) = %v, want %v", tt.number, got, tt.valid)
+		}
+		if got := AcceptedAccountNumber(tt.number); got != tt.accepted {
+			t.Errorf("AcceptedAccountNumber(%d) = %v, want %v", tt.number, got, tt.accepted)
+		}
+	}
+}
+
+// Accounts opened before check digits can still log in and be sent money,
+// while a mistyped new number is turned away before it is looked up
+func TestLegacyAccountNumbers(t *testing.T) {
+	h, store, accounts := newTestServer(t)
+
+	legacy, err := NewAccount("Olde", "Timer", "password", []Role{RoleCustomer})
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy.AccountNumber = 424242
+	if _, err := store.CreateAccount(context.Background(), legacy); err != nil {
+		t.Fatal(err)
+	}
+	if legacy.AccountNumber != 424242 {
+		t.Fatalf("account got number %d, want 424242", legacy.AccountNumber)
+	}
+
+	login(t, h, legacy)
+	token := login(t, h, accounts[0])
+	rec := doJSON(t, h, http.MethodPost, "/transfer", token, TransferRequest{ToAccountNumber: legacy.AccountNumber, Amount: 10})
+	if rec.Code != http.StatusOK {
+		t.Errorf("transfer to a legacy number got status %d: %s", rec.Code, rec.Body)
+	}
+
+	// The right number with the wrong check digit
+	number := accounts[1].AccountNumber
+	mistyped := number - number%10 + (number%10+1)%10
+	rec = doJSON(t, h, http.MethodPost, "/transfer", token, TransferRequest{ToAccountNumber: mistyped, Amount: 10})
+	expectError(t, rec, http.StatusBadRequest, CodeValidation)
+	rec = doJSON(t, h, http.MethodPost, "/login", "", LoginRequest{AccountNumber: mistyped, Password: "password"})
+	expectError(t, rec, http.StatusBadRequest, CodeValidation)
+
+	// An unchanged legacy number passes validation on update, a new one needs a check digit
+	if err := validateStruct(&UpdateAccountRequest{FirstName: "Olde", LastName: "Timer", AccountNumber: 424242}); err != nil {
+		t.Errorf("update keeping a legacy number failed validation: %v", err)
+	}
+	admin := NewAccountPrincipal(&Account{ID: 99, Roles: []Role{RoleAdmin}})
+	ctx := context.WithValue(context.Background(), principalContextKey, admin)
+	err = checkAccountChanges(ctx, legacy, &UpdateAccountRequest{AccountNumber: 434343, Roles: legacy.Roles})
+	if !isErrorCode(err, CodeValidation) {
+		t.Errorf("changing to another legacy number got %v, want a validation error", err)
+	}
+}
@@ -1,11 +1,14 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"log"
+	"math"
+	"net"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
@@ -14,176 +17,875 @@ import (
 // Reprsents the JSON API server
 type APIServer struct {
 	listenAddr string
-	store      Storage
+	// How long a request may take before its database calls are cancelled
+	requestTimeout time.Duration
+	// How long requests in flight, like transfers, get to finish once the server is stopping
+	shutdownTimeout time.Duration
+	store           Storage
+	keys            *Keyring
+	secrets         *SecretBox
+	notifier        Notifier
 }
 
-// NewAPIServer creates a new JSON API server
-func NewAPIServer(listenAddr string, store Storage) *APIServer {
+// NewAPIServer creates a new JSON API server with the server settings from the config
+func NewAPIServer(cfg *Config, store Storage, keys *Keyring, secrets *SecretBox, notifier Notifier) *APIServer {
 	return &APIServer{
-		listenAddr: listenAddr,
-		store:      store,
+		listenAddr:      cfg.ListenAddr,
+		requestTimeout:  cfg.RequestTimeout,
+		shutdownTimeout: cfg.ShutdownTimeout,
+		store:           store,
+		keys:            keys,
+		secrets:         secrets,
+		notifier:        notifier,
 	}
 }
 
-// Run starts the JSON API server and listens for requests
-func (s *APIServer) Run() {
+// Timeouts for the HTTP server
+// Writes get longer than the request timeout so timed out requests still get a response
+const (
+	readHeaderTimeout = 5 * time.Second
+	readTimeout       = 15 * time.Second
+	writeTimeoutSlack = 5 * time.Second
+	idleTimeout       = 60 * time.Second
+)
+
+// Run starts the JSON API server and serves requests until ctx is done
+// Then it stops accepting connections and waits for the requests in flight to finish.
+// Requests still running after the shutdown timeout are cut off, which cancels their
+// contexts and rolls back any transfer they were making
+// The error is nil after a clean shutdown
+func (s *APIServer) Run(ctx context.Context) error {
+	srv := &http.Server{
+		Addr:              s.listenAddr,
+		Handler:           s.Handler(),
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      s.requestTimeout + writeTimeoutSlack,
+		IdleTimeout:       idleTimeout,
+	}
+
+	// Listen first so the log line only appears once the port is really open
+	listener, err := net.Listen("tcp", s.listenAddr)
+	if err != nil {
+		return err
+	}
+	log.Println("JSON API server running on", listener.Addr())
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.Serve(listener)
+	}()
+
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Println("Shutting down, waiting for requests in flight to finish")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		srv.Close()
+		return fmt.Errorf("error shutting down: %w", err)
+	}
+	log.Println("Server stopped")
+	return nil
+}
+
+// Middleware for putting a deadline on the request's context
+// Storage calls made with the context give up when it passes and a transfer in progress is rolled back
+func withRequestTimeout(timeout time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// Handler builds the router with all of the routes registered
+// This is separate from Run so the server can be driven by httptest
+func (s *APIServer) Handler() http.Handler {
 	// Create a new chi router and register the routes
 	router := chi.NewRouter()
+	// RequestID goes first so the logger and error responses can include it
+	router.Use(middleware.RequestID)
 	router.Use(middleware.Logger)
 	router.Use(middleware.Recoverer)
-	router.Use(middleware.RequestID)
+	router.Use(limitRequestBody)
+	router.Use(withRequestTimeout(s.requestTimeout))
+
+	// Every route below needs a valid token and declares the permission it requires
+	// See authz.go for which roles hold which permissions
+	router.Group(func(r chi.Router) {
+		r.Use(withJWTAuth(s.store, s.keys))
+
+		// This endpoint is for revoking the token the request is made with
+		r.Post("/logout", MakeHTTPHandlerFunc(s.handleLogout))
+		// These endpoints are for setting up two-factor authentication on the caller's own account
+		// They need no permission so admins can reach them before they have a second factor
+		r.Post("/mfa/enroll", MakeHTTPHandlerFunc(s.handleMFAEnroll))
+		r.Post("/mfa/confirm", MakeHTTPHandlerFunc(s.handleMFAConfirm))
+		r.Post("/mfa/disable", MakeHTTPHandlerFunc(s.handleMFADisable))
+
+		// These endpoints are for listing and creating accounts
+		// Creating accounts and transfers can be retried safely with an Idempotency-Key header
+		r.With(authorize(PermAccountsList, nil)).Get("/accounts", MakeHTTPHandlerFunc(s.handleGetAccounts))
+		r.With(authorize(PermAccountsCreate, nil), withIdempotency(s.store)).Post("/accounts", MakeHTTPHandlerFunc(s.handleCreateAccount))
+		// These endpoints are for getting, updating and deleting accounts by ID
+		r.With(authorize(PermAccountRead, accountFromURL)).Get("/account/{id}", MakeHTTPHandlerFunc(s.handleGetAccountByID))
+		r.With(authorize(PermAccountUpdate, accountFromURL)).Put("/account/{id}", MakeHTTPHandlerFunc(s.handleUpdateAccount))
+		r.With(authorize(PermAccountUpdate, accountFromURL)).Patch("/account/{id}", MakeHTTPHandlerFunc(s.handlePatchAccount))
+		r.With(authorize(PermAccountDelete, accountFromURL)).Delete("/account/{id}", MakeHTTPHandlerFunc(s.handleDeleteAccount))
+		// This endpoint is for moving an account through its lifecycle
+		r.With(authorize(PermAccountStatus, accountFromURL)).Post("/account/{id}/status", MakeHTTPHandlerFunc(s.handleAccountStatus))
+		// These endpoints are for changing your own password and for admins to send a reset token
+		r.With(authorize(PermPasswordChange, accountFromURL)).Post("/account/{id}/password", MakeHTTPHandlerFunc(s.handleChangePassword))
+		r.With(authorize(PermPasswordReset, accountFromURL)).Post("/account/{id}/password/reset", MakeHTTPHandlerFunc(s.handleRequestPasswordReset))
+		// These endpoints are for managing API keys for services
+		r.With(authorize(PermAPIKeysManage, nil)).Get("/api-keys", MakeHTTPHandlerFunc(s.handleGetAPIKeys))
+		r.With(authorize(PermAPIKeysManage, nil)).Post("/api-keys", MakeHTTPHandlerFunc(s.handleCreateAPIKey))
+		r.With(authorize(PermAPIKeysManage, nil)).Get("/api-keys/{id}", MakeHTTPHandlerFunc(s.handleGetAPIKey))
+		r.With(authorize(PermAPIKeysManage, nil)).Put("/api-keys/{id}", MakeHTTPHandlerFunc(s.handleUpdateAPIKey))
+		r.With(authorize(PermAPIKeysManage, nil)).Delete("/api-keys/{id}", MakeHTTPHandlerFunc(s.handleRevokeAPIKey))
+		// This endpoint is for lifting a login lockout on an account
+		r.With(authorize(PermLoginUnlock, accountFromURL)).Post("/account/{id}/unlock", MakeHTTPHandlerFunc(s.handleUnlockAccount))
+		// This endpoint is for reviewing failed logins, lockouts and unlocks
+		r.With(authorize(PermSecurityEventsRead, nil)).Get("/security/events", MakeHTTPHandlerFunc(s.handleGetSecurityEvents))
+		// This endpoint is for reading the transaction history of an account
+		r.With(authorize(PermTransactionsRead, accountFromURL)).Get("/account/{id}/transactions", MakeHTTPHandlerFunc(s.handleGetTransactions))
+		// This endpoint is for transferring money. Customers can only send from their own account,
+		// tellers and admins can move money between any two accounts
+		r.With(authorize(PermTransferCreate, callerAccount), withIdempotency(s.store)).Post("/transfer", MakeHTTPHandlerFunc(s.handleTransfer))
+	})
 
-	// The account endpoint is for creating and getting accounts. Admins only
-	router.HandleFunc("/accounts", withJWTAuth(true, MakeHTTPHandlerFunc(s.handleAccounts), s.store))
-	// This endpoint is for getting and deleting accounts by ID
-	router.HandleFunc("/account/{id}", withJWTAuth(false, MakeHTTPHandlerFunc(s.handleGetAccountByID), s.store))
-	// This endpoint is for transferring money between accounts. Admins only.
-	router.HandleFunc("/transfer", withJWTAuth(true, MakeHTTPHandlerFunc(s.handleTransfer), s.store))
 	// This endpoint is for logging in and receiving a JWT token
-	router.HandleFunc("/login", MakeHTTPHandlerFunc(s.handleLogin))
-	log.Println("JSON API server running on", s.listenAddr)
-	http.ListenAndServe(s.listenAddr, router)
+	router.Post("/login", MakeHTTPHandlerFunc(s.handleLogin))
+	// This endpoint is for setting a new password with a reset token
+	router.Post("/password/reset", MakeHTTPHandlerFunc(s.handleResetPassword))
+	// This endpoint is for the second step of logging in with two-factor authentication
+	router.Post("/login/mfa", MakeHTTPHandlerFunc(s.handleLoginMFA))
+	// This endpoint is for swapping a refresh token for a new JWT token
+	router.Post("/token/refresh", MakeHTTPHandlerFunc(s.handleRefreshToken))
+	// This endpoint is for other services to fetch the public keys tokens are signed with
+	router.Get("/.well-known/jwks.json", MakeHTTPHandlerFunc(s.handleJWKS))
+
+	return router
 }
 
 // Log in and receive a JWT token
 // Post to /login your account number and password
 //
 //	{
-//		"account_number": 123456,
+//		"account_number": 1234567897,
 //		"password": "password"
 //	}
+//
+// Accounts with two-factor authentication get an MFA token instead, see handleLoginMFA
 func (s *APIServer) handleLogin(w http.ResponseWriter, r *http.Request) error {
-	if r.Method != "POST" {
-		return fmt.Errorf("unsupported method %s", r.Method)
+	var req LoginRequest
+	if err := decodeJSON(r, &req); err != nil {
+		return err
 	}
 
-	var req LoginRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		return fmt.Errorf("invalid request body")
+	// Slow down and lock out callers guessing passwords, see loginguard.go
+	guard := newLoginGuard(s.store, r, req.AccountNumber)
+	wait, err := guard.Reserve()
+	if err != nil {
+		return fmt.Errorf("error checking login attempts: %w", err)
+	}
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		return tooManyRequestsError("too many failed login attempts, try again later")
 	}
 
-	account, err := s.store.GetAccountByNumber(int(req.AccountNumber))
+	account, err := s.store.GetAccountByNumber(r.Context(), int(req.AccountNumber))
+	if err != nil && !isErrorCode(err, CodeNotFound) {
+		return err
+	}
 	if err != nil {
-		return fmt.Errorf("unauthorized")
+		if err := guard.Failed("unknown account number"); err != nil {
+			return fmt.Errorf("error recording login attempt: %w", err)
+		}
+		return unauthorizedError("invalid account number or password")
 	}
 	if !account.ComparePassword(req.Password) {
-		return fmt.Errorf("unauthorized")
+		if err := guard.Failed("wrong password"); err != nil {
+			return fmt.Errorf("error recording login attempt: %w", err)
+		}
+		return unauthorizedError("invalid account number or password")
+	}
+	if err := guard.Passed(); err != nil {
+		return fmt.Errorf("error recording login attempt: %w", err)
 	}
-	token, err := createJWTToken(account)
+	if account.Status == StatusClosed {
+		return forbiddenError("account is closed")
+	}
+
+	// Failures are only cleared once the second factor is checked too,
+	// otherwise knowing the password would allow unlimited guesses at codes
+	if account.MFAEnabled {
+		challenge, err := createMFAChallenge(s.keys, account)
+		if err != nil {
+			return err
+		}
+		return WriteJSON(w, http.StatusOK, MFAChallengeResponse{
+			MFARequired: true,
+			MFAToken:    challenge,
+			ExpiresIn:   int(mfaChallengeTTL.Seconds()),
+		})
+	}
+	if err := guard.Succeeded(); err != nil {
+		return fmt.Errorf("error recording login attempt: %w", err)
+	}
+
+	resp, err := issueTokens(r.Context(), s.store, s.keys, account, "", false)
 	if err != nil {
 		return err
 	}
-	resp := LoginResponse{
-		AccountNumber: account.AccountNumber,
-		Token:         token,
+
+	return WriteJSON(w, http.StatusOK, resp)
+}
+
+// Finish logging in with two-factor authentication
+// Post to /login/mfa the MFA token from /login and a code from the authenticator app or a recovery code
+//
+//	{
+//		"mfa_token": "...",
+//		"code": "123456"
+//	}
+func (s *APIServer) handleLoginMFA(w http.ResponseWriter, r *http.Request) error {
+	var req MFALoginRequest
+	if err := decodeJSON(r, &req); err != nil {
+		return err
+	}
+
+	token, err := parseMFAChallenge(r.Context(), s.keys, s.store, req.MFAToken)
+	if err != nil {
+		return err
+	}
+	userID, err := getIDFromClaims(token)
+	if err != nil {
+		return unauthorizedError("invalid or expired mfa token")
+	}
+	account, err := s.store.GetAccountByID(r.Context(), userID)
+	if isErrorCode(err, CodeNotFound) {
+		return unauthorizedError("invalid or expired mfa token")
+	}
+	if err != nil {
+		return err
+	}
+	if account.Status == StatusClosed {
+		return forbiddenError("account is closed")
+	}
+	// The password was checked against one that has since changed
+	session := sessionFromClaims(token)
+	if !tokenStillValid(account, session) {
+		return unauthorizedError("invalid or expired mfa token")
+	}
+
+	if err := checkSecondFactor(s.store, s.secrets, w, r, account, req.Code); err != nil {
+		return err
+	}
+	if err := newLoginGuard(s.store, r, account.AccountNumber).Succeeded(); err != nil {
+		return fmt.Errorf("error recording login attempt: %w", err)
+	}
+
+	// The MFA token can only be used once
+	if err := s.store.RevokeAccessToken(r.Context(), session.TokenID, session.ExpiresAt); err != nil {
+		return fmt.Errorf("error using mfa token: %w", err)
+	}
+
+	resp, err := issueTokens(r.Context(), s.store, s.keys, account, "", true)
+	if err != nil {
+		return err
 	}
 
 	return WriteJSON(w, http.StatusOK, resp)
 }
 
-// Create a new account or get all accounts
-// Post to /account to create a new account
+// Start setting up two-factor authentication for the caller's account
+// Post to /mfa/enroll to get a new secret and an otpauth:// URI for the authenticator app
+// It is not used until it is confirmed at /mfa/confirm
+func (s *APIServer) handleMFAEnroll(w http.ResponseWriter, r *http.Request) error {
+	account, ok := accountFromContext(r.Context())
+	if !ok {
+		return forbiddenError("two-factor authentication is only for accounts")
+	}
+	if account.MFAEnabled {
+		return conflictError("two-factor authentication is already enabled")
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		return err
+	}
+	sealed, err := s.secrets.Seal(secret, mfaSecretContext(account.ID))
+	if err != nil {
+		return fmt.Errorf("error encrypting secret: %w", err)
+	}
+	if err := s.store.SetMFASecret(r.Context(), account.ID, sealed); err != nil {
+		return fmt.Errorf("error saving secret: %w", err)
+	}
+
+	return WriteJSON(w, http.StatusOK, MFAEnrollResponse{
+		Secret:     secret,
+		OTPAuthURI: totpURI(secret, account),
+	})
+}
+
+// Turn on two-factor authentication for the caller's account
+// Post to /mfa/confirm a code from the authenticator app to prove it was set up
+// Returns the recovery codes, they are not shown again
+func (s *APIServer) handleMFAConfirm(w http.ResponseWriter, r *http.Request) error {
+	account, ok := accountFromContext(r.Context())
+	if !ok {
+		return forbiddenError("two-factor authentication is only for accounts")
+	}
+	if account.MFAEnabled {
+		return conflictError("two-factor authentication is already enabled")
+	}
+	if account.MFASecret == "" {
+		return conflictError("two-factor authentication has not been set up, post to /mfa/enroll first")
+	}
+
+	var req MFACodeRequest
+	if err := decodeJSON(r, &req); err != nil {
+		return err
+	}
+	if err := checkSecondFactor(s.store, s.secrets, w, r, account, req.Code); err != nil {
+		return err
+	}
+
+	codes, err := generateRecoveryCodes()
+	if err != nil {
+		return err
+	}
+	hashes := make([]string, len(codes))
+	for i, code := range codes {
+		hashes[i] = hashToken(code)
+	}
+	if err := s.store.EnableMFA(r.Context(), account.ID, hashes); err != nil {
+		return fmt.Errorf("error enabling two-factor authentication: %w", err)
+	}
+
+	return WriteJSON(w, http.StatusOK, MFARecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// Turn off two-factor authentication for the caller's account
+// Post to /mfa/disable a current code or a recovery code
+// Admins can't turn it off
+func (s *APIServer) handleMFADisable(w http.ResponseWriter, r *http.Request) error {
+	account, ok := accountFromContext(r.Context())
+	if !ok {
+		return forbiddenError("two-factor authentication is only for accounts")
+	}
+	if !account.MFAEnabled {
+		return conflictError("two-factor authentication is not enabled")
+	}
+	if mfaRequired(account) {
+		return forbiddenError("two-factor authentication is required for this account")
+	}
+
+	var req MFACodeRequest
+	if err := decodeJSON(r, &req); err != nil {
+		return err
+	}
+	if err := checkSecondFactor(s.store, s.secrets, w, r, account, req.Code); err != nil {
+		return err
+	}
+
+	if err := s.store.DisableMFA(r.Context(), account.ID); err != nil {
+		return fmt.Errorf("error disabling two-factor authentication: %w", err)
+	}
+
+	return WriteJSON(w, http.StatusOK, map[string]bool{"mfa_enabled": false})
+}
+
+// Exchange a refresh token for a new access token and refresh token
+// Post to /token/refresh
 //
 //	{
-//		"first_name": "John",
-//		"last_name": "Doe",
-//		"password": "password"
-//		"is_admin": false
+//		"refresh_token": "..."
 //	}
 //
-// Get /account to get all accounts
-func (s *APIServer) handleAccounts(w http.ResponseWriter, r *http.Request) error {
-	if r.Method == "GET" {
-		return s.handleGetAccounts(w, r)
+// Each refresh token can only be used once. Using one twice logs out every session
+// that came from the same login
+func (s *APIServer) handleRefreshToken(w http.ResponseWriter, r *http.Request) error {
+	var req RefreshRequest
+	if err := decodeJSON(r, &req); err != nil {
+		return err
 	}
-	if r.Method == "POST" {
-		return s.handleCreateAccount(w, r)
+
+	resp, err := refreshTokens(r.Context(), s.store, s.keys, req.RefreshToken)
+	if err != nil {
+		return err
 	}
 
-	return fmt.Errorf("unsupported method %s", r.Method)
+	return WriteJSON(w, http.StatusOK, resp)
 }
 
-func (s *APIServer) handleGetAccountByID(w http.ResponseWriter, r *http.Request) error {
-	if r.Method == "GET" {
-		idStr := chi.URLParam(r, "id")
-		id, err := strconv.Atoi(idStr)
-		if err != nil {
-			return fmt.Errorf("invalid id %s", idStr)
+// Get the public keys for verifying tokens
+// Get /.well-known/jwks.json
+// Retired keys stay listed until they are removed from the key directory
+func (s *APIServer) handleJWKS(w http.ResponseWriter, r *http.Request) error {
+	return WriteJSON(w, http.StatusOK, s.keys.JWKS())
+}
+
+// Change your own password
+// Post to /account/{id}/password
+//
+//	{
+//		"current_password": "...",
+//		"new_password": "..."
+//	}
+//
+// Every token issued for the account stops working, so the caller has to log in again
+func (s *APIServer) handleChangePassword(w http.ResponseWriter, r *http.Request) error {
+	idStr := chi.URLParam(r, "id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return validationError("invalid id %s", idStr)
+	}
+	account, ok := accountFromContext(r.Context())
+	if !ok || account.ID != id {
+		return forbiddenError("you can only change your own password")
+	}
+
+	var req ChangePasswordRequest
+	if err := decodeJSON(r, &req); err != nil {
+		return err
+	}
+
+	// Guessing the current password here is throttled like logging in
+	guard := newLoginGuard(s.store, r, account.AccountNumber)
+	wait, err := guard.Reserve()
+	if err != nil {
+		return fmt.Errorf("error checking login attempts: %w", err)
+	}
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		return tooManyRequestsError("too many failed attempts, try again later")
+	}
+	if !account.ComparePassword(req.CurrentPassword) {
+		if err := guard.Failed("wrong current password"); err != nil {
+			return fmt.Errorf("error recording login attempt: %w", err)
 		}
+		return unauthorizedError("current password is incorrect")
+	}
+	if err := guard.Passed(); err != nil {
+		return fmt.Errorf("error recording login attempt: %w", err)
+	}
+
+	if err := changePassword(r.Context(), s.store, account, req.NewPassword); err != nil {
+		return forField("new_password", err)
+	}
+	recordSecurityEvent(s.store, r, EventPasswordChanged, account.AccountNumber, "changed by the account holder")
+	s.notify(account, "Your password was changed", "The password for your account was changed. If this wasn't you, contact us straight away.")
+
+	return WriteJSON(w, http.StatusOK, map[string]bool{"password_changed": true})
+}
+
+// Send a password reset token to an account holder
+// Post to /account/{id}/password/reset
+// The token goes through the notifier, never in the response, and works once within an hour
+func (s *APIServer) handleRequestPasswordReset(w http.ResponseWriter, r *http.Request) error {
+	idStr := chi.URLParam(r, "id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return validationError("invalid id %s", idStr)
+	}
+
+	account, err := s.store.GetAccountByID(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	if account.Status == StatusClosed {
+		return conflictError("account is closed")
+	}
+
+	token, rt, err := createPasswordResetToken(r.Context(), s.store, account)
+	if err != nil {
+		return fmt.Errorf("error creating reset token: %w", err)
+	}
+	body := fmt.Sprintf("Use this token to set a new password at /password/reset before %s:\n%s", rt.ExpiresAt.Format(time.RFC3339), token)
+	if err := s.notifier.Notify(Notification{
+		AccountID:     account.ID,
+		AccountNumber: account.AccountNumber,
+		Subject:       "Reset your password",
+		Body:          body,
+		CreatedAt:     time.Now().UTC(),
+	}); err != nil {
+		return fmt.Errorf("error sending reset token: %w", err)
+	}
+
+	caller, _ := principalFromContext(r.Context())
+	recordSecurityEvent(s.store, r, EventPasswordResetRequested, account.AccountNumber, fmt.Sprintf("requested by %s", caller))
+
+	return WriteJSON(w, http.StatusOK, map[string]any{"reset_requested": true, "expires_at": rt.ExpiresAt})
+}
+
+// Set a new password with a reset token
+// Post to /password/reset
+//
+//	{
+//		"token": "...",
+//		"new_password": "..."
+//	}
+func (s *APIServer) handleResetPassword(w http.ResponseWriter, r *http.Request) error {
+	var req ResetPasswordRequest
+	if err := decodeJSON(r, &req); err != nil {
+		return err
+	}
+
+	account, err := resetPassword(r.Context(), s.store, req.Token, req.NewPassword)
+	if err != nil {
+		return err
+	}
+	recordSecurityEvent(s.store, r, EventPasswordReset, account.AccountNumber, "reset with a reset token")
+	s.notify(account, "Your password was reset", "The password for your account was reset. If this wasn't you, contact us straight away.")
+
+	return WriteJSON(w, http.StatusOK, map[string]bool{"password_changed": true})
+}
 
-		account, err := s.store.GetAccountByID(id)
-		// if no rows are found error, return 404 "account not found"	
+// Helper for telling an account holder about something that happened to their account
+// Failing to notify is logged but doesn't fail the request
+func (s *APIServer) notify(account *Account, subject, body string) {
+	err := s.notifier.Notify(Notification{
+		AccountID:     account.ID,
+		AccountNumber: account.AccountNumber,
+		Subject:       subject,
+		Body:          body,
+		CreatedAt:     time.Now().UTC(),
+	})
+	if err != nil {
+		log.Println("error sending notification:", err)
+	}
+}
+
+// Create an API key
+// Post to /api-keys
+//
+//	{
+//		"name": "nightly statements",
+//		"permissions": ["accounts:list", "transactions:read"],
+//		"account_ids": [],
+//		"expires_at": "2027-01-01T00:00:00Z"
+//	}
+//
+// The key is only returned this once, send it in the X-API-Key header
+func (s *APIServer) handleCreateAPIKey(w http.ResponseWriter, r *http.Request) error {
+	req := new(APIKeyRequest)
+	if err := decodeJSON(r, req); err != nil {
+		return err
+	}
+	if err := checkAPIKeyRequest(r.Context(), s.store, req); err != nil {
+		return err
+	}
+	caller, ok := accountFromContext(r.Context())
+	if !ok {
+		return forbiddenError("api keys can only be created by an account")
+	}
+
+	key, prefix, err := generateAPIKey()
+	if err != nil {
+		return err
+	}
+	apiKey := &APIKey{
+		Name:        req.Name,
+		Prefix:      prefix,
+		KeyHash:     hashToken(key),
+		Permissions: req.Permissions,
+		AccountIDs:  req.AccountIDs,
+		CreatedBy:   caller.ID,
+		CreatedAt:   time.Now().UTC(),
+		ExpiresAt:   req.ExpiresAt,
+	}
+	if apiKey.AccountIDs == nil {
+		apiKey.AccountIDs = []int{}
+	}
+	if err := s.store.CreateAPIKey(r.Context(), apiKey); err != nil {
+		return fmt.Errorf("error creating api key: %w", err)
+	}
+
+	return WriteJSON(w, http.StatusOK, CreateAPIKeyResponse{Key: key, APIKey: apiKey})
+}
+
+// Get all API keys, including revoked ones
+func (s *APIServer) handleGetAPIKeys(w http.ResponseWriter, r *http.Request) error {
+	keys, err := s.store.GetAPIKeys(r.Context())
+	if err != nil {
+		return fmt.Errorf("error getting api keys: %w", err)
+	}
+	return WriteJSON(w, http.StatusOK, keys)
+}
+
+// Get an API key by ID
+func (s *APIServer) handleGetAPIKey(w http.ResponseWriter, r *http.Request) error {
+	idStr := chi.URLParam(r, "id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return validationError("invalid id %s", idStr)
+	}
+
+	key, err := s.store.GetAPIKeyByID(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, key)
+}
+
+// Update the name, permissions, accounts and expiry of an API key
+// Put to /api-keys/{id} the same body as creating one. The key itself doesn't change
+func (s *APIServer) handleUpdateAPIKey(w http.ResponseWriter, r *http.Request) error {
+	idStr := chi.URLParam(r, "id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return validationError("invalid id %s", idStr)
+	}
+
+	req := new(APIKeyRequest)
+	if err := decodeJSON(r, req); err != nil {
+		return err
+	}
+	if err := checkAPIKeyRequest(r.Context(), s.store, req); err != nil {
+		return err
+	}
+
+	key, err := s.store.GetAPIKeyByID(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	if key.RevokedAt != nil {
+		return conflictError("api key has been revoked")
+	}
+	key.Name = req.Name
+	key.Permissions = req.Permissions
+	key.AccountIDs = req.AccountIDs
+	if key.AccountIDs == nil {
+		key.AccountIDs = []int{}
+	}
+	key.ExpiresAt = req.ExpiresAt
+	if err := s.store.UpdateAPIKey(r.Context(), key); err != nil {
+		return fmt.Errorf("error updating api key: %w", err)
+	}
+
+	return WriteJSON(w, http.StatusOK, key)
+}
+
+// Revoke an API key
+// The key stops working straight away and stays listed as revoked
+func (s *APIServer) handleRevokeAPIKey(w http.ResponseWriter, r *http.Request) error {
+	idStr := chi.URLParam(r, "id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return validationError("invalid id %s", idStr)
+	}
+
+	if err := s.store.RevokeAPIKey(r.Context(), id, time.Now().UTC()); err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, map[string]int{"revoked": id})
+}
+
+// Lift a login lockout
+// Post to /account/{id}/unlock to clear the failed logins on the account's number
+// Lockouts on the caller's IP address are not affected
+func (s *APIServer) handleUnlockAccount(w http.ResponseWriter, r *http.Request) error {
+	idStr := chi.URLParam(r, "id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return validationError("invalid id %s", idStr)
+	}
+
+	account, err := s.store.GetAccountByID(r.Context(), id)
+	if err != nil {
+		return err
+	}
+
+	if err := s.store.ClearLoginThrottle(r.Context(), accountThrottleKey(account.AccountNumber)); err != nil {
+		return fmt.Errorf("error unlocking account: %w", err)
+	}
+
+	caller, _ := principalFromContext(r.Context())
+	recordSecurityEvent(s.store, r, EventAccountUnlocked, account.AccountNumber, fmt.Sprintf("unlocked by %s", caller))
+
+	return WriteJSON(w, http.StatusOK, map[string]bool{"unlocked": true})
+}
+
+// Get security events, newest first
+// Get /security/events with optional account_number, kind and limit query parameters
+func (s *APIServer) handleGetSecurityEvents(w http.ResponseWriter, r *http.Request) error {
+	q := r.URL.Query()
+	filter := SecurityEventFilter{
+		Kind:  SecurityEventKind(q.Get("kind")),
+		Limit: defaultSecurityEventsLimit,
+	}
+	if v := q.Get("account_number"); v != "" {
+		number, err := strconv.ParseInt(v, 10, 64)
 		if err != nil {
-			return fmt.Errorf("account not found")
+			return fieldError("account_number", "invalid account_number %s", v)
+		}
+		filter.AccountNumber = number
+	}
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxSecurityEventsLimit {
+			return fieldError("limit", "limit must be between 1 and %d", maxSecurityEventsLimit)
 		}
+		filter.Limit = limit
+	}
+
+	events, err := s.store.GetSecurityEvents(r.Context(), filter)
+	if err != nil {
+		return fmt.Errorf("error getting security events: %w", err)
+	}
+
+	return WriteJSON(w, http.StatusOK, events)
+}
 
-		return WriteJSON(w, http.StatusOK, account)
+// Log out
+// Post to /logout with the access token to revoke it and every refresh token from the same login
+func (s *APIServer) handleLogout(w http.ResponseWriter, r *http.Request) error {
+	principal, ok := principalFromContext(r.Context())
+	if !ok || principal.Session == nil {
+		return validationError("no session to log out of")
 	}
-	if r.Method == "DELETE" {
-		return s.handleDeleteAccount(w, r)
+
+	if err := logout(r.Context(), s.store, principal.Session); err != nil {
+		return fmt.Errorf("error logging out: %w", err)
+	}
+
+	return WriteJSON(w, http.StatusOK, map[string]bool{"logged_out": true})
+}
+
+// Get an account by ID
+func (s *APIServer) handleGetAccountByID(w http.ResponseWriter, r *http.Request) error {
+	idStr := chi.URLParam(r, "id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return validationError("invalid id %s", idStr)
 	}
 
-	if r.Method == "PUT" {
-		return s.handleUpdateAccount(w, r)
+	account, err := s.store.GetAccountByID(r.Context(), id)
+	// if no rows are found error, return 404 "account not found"
+	if err != nil {
+		return err
 	}
 
-	return fmt.Errorf("unsupported method %s", r.Method)
+	w.Header().Set("ETag", accountETag(account))
+	return WriteJSON(w, http.StatusOK, account)
 }
 
-// Get all accounts or get an account by ID
-// This function is used in the handleAccount function to get all accounts when the endpoint
-// is hit with the GET method
+// List accounts a page at a time
+// Get /accounts with optional query parameters:
+//
+//	name=Jo (start of the first or last name, ignoring case)
+//	status=pending|active|frozen|closed
+//	role=customer|teller|auditor|admin|superadmin
+//	min_balance=0&max_balance=1000 (inclusive)
+//	created_since=2023-01-01T00:00:00Z (inclusive)
+//	created_until=2023-02-01T00:00:00Z (exclusive)
+//	include_deleted=true
+//	sort=id|last_name|balance|created_at (prefix with - for descending, default id)
+//	limit=50 (max 100)
+//	cursor=<next_cursor from the previous page>
+//
+// The response has the page of accounts and the total number that match the filters
 func (s *APIServer) handleGetAccounts(w http.ResponseWriter, r *http.Request) error {
-	accounts, err := s.store.GetAccounts()
+	filter, err := parseAccountFilter(r.URL.Query())
 	if err != nil {
-		return fmt.Errorf("error getting accounts: %v", err)
+		return err
+	}
+
+	total, err := s.store.CountAccounts(r.Context(), *filter)
+	if err != nil {
+		return fmt.Errorf("error counting accounts: %w", err)
 	}
 
-	return WriteJSON(w, http.StatusOK, accounts)
+	// Ask for one extra row to know whether there is another page
+	limit := filter.Limit
+	filter.Limit++
+	accounts, err := s.store.GetAccounts(r.Context(), *filter)
+	if err != nil {
+		return fmt.Errorf("error getting accounts: %w", err)
+	}
+
+	resp := AccountsResponse{Accounts: accounts, Total: total}
+	if len(accounts) > limit {
+		resp.Accounts = accounts[:limit]
+		resp.NextCursor = encodeAccountCursor(accounts[limit-1], filter)
+	}
+
+	return WriteJSON(w, http.StatusOK, resp)
 }
 
 // Create a new account
-// Used in the handleAccount function to create a new account when the endpoint is hit with the POST method
+// Post to /accounts
 // Example request body:
 //
 //	{
 //		"first_name": "John",
 //		"last_name": "Doe",
 //		"password": "password"
-//		"is_admin": false
+//		"roles": ["customer"]
 //	}
+//
+// roles defaults to customer. Giving any other role needs the roles:manage permission
 func (s *APIServer) handleCreateAccount(w http.ResponseWriter, r *http.Request) error {
 	req := new(CreateAccountRequest)
-	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
-		return fmt.Errorf("invalid request body")
+	if err := decodeJSON(r, req); err != nil {
+		return err
+	}
+	if len(req.Roles) == 0 {
+		req.Roles = []Role{RoleCustomer}
+	}
+	if err := checkCanAssignRoles(r.Context(), req.Roles, []Role{RoleCustomer}); err != nil {
+		return err
+	}
+	if err := checkPasswordPolicy(req.Password, &Account{FirstName: req.FirstName, LastName: req.LastName}); err != nil {
+		return forField("password", err)
+	}
+	// New accounts can start out pending and be activated by an admin later
+	if req.Status != "" && req.Status != StatusPending && req.Status != StatusActive {
+		return fieldError("status", "new accounts must be pending or active")
 	}
 	account, err := NewAccount(
 		req.FirstName,
 		req.LastName,
 		req.Password,
-		false,
+		req.Roles,
 		req.Balance,
 	)
 	if err != nil {
-		return fmt.Errorf("error creating account: %v", err)
+		return fmt.Errorf("error creating account: %w", err)
+	}
+	if req.Status != "" {
+		account.Status = req.Status
 	}
-	acc, err := s.store.CreateAccount(account)
+	acc, err := s.store.CreateAccount(r.Context(), account)
 	if err != nil {
-		return fmt.Errorf("error creating account: %v", err)
+		return fmt.Errorf("error creating account: %w", err)
 	}
 	return WriteJSON(w, http.StatusOK, acc)
 
 }
 
+// Delete an account
+// This is a soft delete, the account is closed and marked deleted but kept for its history
+// Only accounts with a zero balance can be deleted
 func (s *APIServer) handleDeleteAccount(w http.ResponseWriter, r *http.Request) error {
 	idStr := chi.URLParam(r, "id")
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
-		return fmt.Errorf("invalid id %s", idStr)
+		return validationError("invalid id %s", idStr)
 	}
 
-	if err := s.store.DeleteAccount(id); err != nil {
-		return fmt.Errorf("error deleting account: %v", err)
+	if err := DeleteAccount(r.Context(), s.store, id); err != nil {
+		return fmt.Errorf("error deleting account: %w", err)
 	}
 
 	return WriteJSON(w, http.StatusOK, map[string]int{"deleted": id})
@@ -194,64 +896,268 @@ func (s *APIServer) handleDeleteAccount(w http.ResponseWriter, r *http.Request)
 //	{
 //		"first_name": "John",
 //		"last_name": "Doe",
-//		"account_number": 123456,
-//		"is_admin": false
+//		"account_number": 1234567897,
+//		"roles": ["customer"]
 //	}
+//
+// roles is optional and left alone when missing. Changing it needs the roles:manage permission
+// and changing account_number needs account:number, see checkAccountChanges
+// An If-Match header with the ETag from a GET makes the update fail if someone else changed the account first
+// Prefer PATCH, which only needs the fields that change
 func (s *APIServer) handleUpdateAccount(w http.ResponseWriter, r *http.Request) error {
 	idStr := chi.URLParam(r, "id")
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
-		return fmt.Errorf("invalid id %s", idStr)
+		return validationError("invalid id %s", idStr)
+	}
+	version, _, err := ifMatchVersion(r)
+	if err != nil {
+		return err
 	}
 
 	req := new(UpdateAccountRequest)
-	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
-		return fmt.Errorf("invalid request body")
+	if err := decodeJSON(r, req); err != nil {
+		return err
 	}
-	acc, err := s.store.GetAccountByID(id)
+	acc, err := s.store.GetAccountByID(r.Context(), id)
 	if err != nil {
-		return fmt.Errorf("error getting account: %v", err)
+		return fmt.Errorf("error getting account: %w", err)
+	}
+	if req.Roles == nil {
+		req.Roles = acc.Roles
 	}
 
-	updatedAccount := &Account{
-		ID:            acc.ID,
-		FirstName:     req.FirstName,
-		LastName:      req.LastName,
-		AccountNumber: req.AccountNumber,
-		IsAdmin:       req.IsAdmin,
+	updated, err := s.updateAccount(r, acc, req, version)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("ETag", accountETag(updated))
+	return WriteJSON(w, http.StatusOK, updated)
+
+}
+
+// Update some of an account's details
+// Patch /account/{id} with a JSON Merge Patch (RFC 7386) of the fields to change
+// and the ETag from a GET in the If-Match header
+//
+//	{
+//		"last_name": "Smith"
+//	}
+//
+// The fields are the same as for PUT. Missing fields are left alone
+// Responds with the saved account and its new ETag
+func (s *APIServer) handlePatchAccount(w http.ResponseWriter, r *http.Request) error {
+	idStr := chi.URLParam(r, "id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return validationError("invalid id %s", idStr)
+	}
+	version, ok, err := ifMatchVersion(r)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return newError(CodeVersionRequired, "PATCH needs an If-Match header with the account's ETag")
 	}
 
-	_, err = s.store.UpdateAccountByID(id, updatedAccount)
+	acc, err := s.store.GetAccountByID(r.Context(), id)
 	if err != nil {
-		return fmt.Errorf("error updating account: %v", err)
+		return err
+	}
+	if version != 0 && version != acc.Version {
+		return versionMismatchError(version, acc.Version)
 	}
 
-	return WriteJSON(w, http.StatusOK, updatedAccount)
+	req := &UpdateAccountRequest{
+		FirstName:     acc.FirstName,
+		LastName:      acc.LastName,
+		AccountNumber: acc.AccountNumber,
+		Roles:         acc.Roles,
+	}
+	if err := applyMergePatch(r, req); err != nil {
+		return err
+	}
+	if req.Roles == nil {
+		return fieldError("roles", "roles can't be removed")
+	}
+
+	// The version read above is what the patch was applied to, so it is always checked
+	// when saving, even with If-Match: *
+	updated, err := s.updateAccount(r, acc, req, acc.Version)
+	if err != nil {
+		return err
+	}
 
+	w.Header().Set("ETag", accountETag(updated))
+	return WriteJSON(w, http.StatusOK, updated)
+}
+
+// Helper for saving new details for an account once the caller is allowed to make the changes
+// A version of 0 skips the check that the account is still at that version
+func (s *APIServer) updateAccount(r *http.Request, acc *Account, req *UpdateAccountRequest, version int) (*Account, error) {
+	if err := checkAccountChanges(r.Context(), acc, req); err != nil {
+		return nil, err
+	}
+
+	updated, err := s.store.UpdateAccountByID(r.Context(), acc.ID, &Account{
+		ID:            acc.ID,
+		FirstName:     req.FirstName,
+		LastName:      req.LastName,
+		AccountNumber: req.AccountNumber,
+		Roles:         req.Roles,
+		Version:       version,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error updating account: %w", err)
+	}
+	return updated, nil
 }
 
 // Request body sample
 //
 //	{
-//		"to_account_id": 123456,
-//		"from_account_id": 123456,
+//		"to_account_number": 1234567897,
+//		"from_account_number": 9876543217,
 //		"amount": 100
 //	}
+//
+// Customers can leave out from_account_number, it is always their own account
+// Responds with a TransferReceipt
 func (s *APIServer) handleTransfer(w http.ResponseWriter, r *http.Request) error {
 	transferReq := new(TransferRequest)
-	if err := json.NewDecoder(r.Body).Decode(transferReq); err != nil {
-		return fmt.Errorf("invalid request body")
+	if err := decodeJSON(r, transferReq); err != nil {
+		return err
 	}
 
-	acc, err := s.store.MakeTransfer(
-		transferReq.ToAccountID,
-		transferReq.FromAccountID,
+	principal, ok := principalFromContext(r.Context())
+	if !ok {
+		return unauthorizedError("unauthorized")
+	}
+	account := principal.Account
+	// Unless the caller can transfer between any accounts, the money comes out of their own,
+	// or for API keys limited to some accounts, out of one of those
+	if principal.Scope(PermTransferCreate) != ScopeAny {
+		if account == nil {
+			from, err := s.store.GetAccountByNumber(r.Context(), int(transferReq.FromAccountNumber))
+			if err != nil && !isErrorCode(err, CodeNotFound) {
+				return err
+			}
+			if err != nil || !principal.Can(PermTransferCreate, from.ID) {
+				return forbiddenError("insufficient permissions")
+			}
+		} else {
+			if transferReq.FromAccountNumber != 0 && transferReq.FromAccountNumber != account.AccountNumber {
+				return forbiddenError("insufficient permissions")
+			}
+			transferReq.FromAccountNumber = account.AccountNumber
+		}
+	}
+	// Callers who can move money between any accounts have to say which one it comes from
+	if transferReq.FromAccountNumber == 0 {
+		return fieldError("from_account_number", "from_account_number is required")
+	}
+
+	// Large transfers need a fresh second factor from the caller
+	// This is a 401 so an idempotent retry with the code isn't answered from the stored response
+	// API keys are granted transfers explicitly by an admin and have no second factor to give
+	if account != nil && transferReq.Amount >= stepUpTransferAmount {
+		if !account.MFAEnabled {
+			return unauthorizedError("transfers of %d or more need two-factor authentication, set it up at /mfa/enroll", stepUpTransferAmount)
+		}
+		code := r.Header.Get(stepUpHeader)
+		if code == "" {
+			return unauthorizedError("transfers of %d or more need a two-factor code in the %s header", stepUpTransferAmount, stepUpHeader)
+		}
+		if err := checkSecondFactor(s.store, s.secrets, w, r, account, code); err != nil {
+			return err
+		}
+	}
+
+	receipt, err := MakeTransfer(
+		r.Context(),
+		s.store,
+		transferReq.ToAccountNumber,
+		transferReq.FromAccountNumber,
 		transferReq.Amount,
 	)
 
 	if err != nil {
-		return fmt.Errorf("error making transfer: %v", err)
+		return fmt.Errorf("error making transfer: %w", err)
 	}
 
-	return WriteJSON(w, http.StatusOK, fmt.Sprintf("Transfer successful. New balance: %d", acc.Balance))
+	return WriteJSON(w, http.StatusOK, receipt)
+}
+
+// Move an account to a new lifecycle status
+// Post to /account/{id}/status
+//
+//	{
+//		"status": "frozen"
+//	}
+//
+// Allowed moves: pending -> active, active <-> frozen, and anything -> closed
+// An account can only be closed with a zero balance
+func (s *APIServer) handleAccountStatus(w http.ResponseWriter, r *http.Request) error {
+	idStr := chi.URLParam(r, "id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return validationError("invalid id %s", idStr)
+	}
+
+	req := new(AccountStatusRequest)
+	if err := decodeJSON(r, req); err != nil {
+		return err
+	}
+
+	account, err := ChangeAccountStatus(r.Context(), s.store, id, req.Status)
+	if err != nil {
+		return fmt.Errorf("error changing account status: %w", err)
+	}
+
+	return WriteJSON(w, http.StatusOK, account)
+}
+
+// Get the transaction history of an account, newest first
+// Get /account/{id}/transactions with optional query parameters:
+//
+//	direction=debit|credit
+//	since=2023-01-01T00:00:00Z (inclusive)
+//	until=2023-02-01T00:00:00Z (exclusive)
+//	limit=50 (max 100)
+//	cursor=<next_cursor from the previous page>
+func (s *APIServer) handleGetTransactions(w http.ResponseWriter, r *http.Request) error {
+	idStr := chi.URLParam(r, "id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return validationError("invalid id %s", idStr)
+	}
+
+	filter, err := parseTransferFilter(r.URL.Query())
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.store.GetAccountByID(r.Context(), id); err != nil {
+		return err
+	}
+
+	// Ask for one extra row to know whether there is another page
+	limit := filter.Limit
+	filter.Limit++
+	transfers, err := s.store.GetTransfersByAccount(r.Context(), id, *filter)
+	if err != nil {
+		return fmt.Errorf("error getting transactions: %w", err)
+	}
+
+	resp := TransactionsResponse{Transactions: []*Transaction{}}
+	if len(transfers) > limit {
+		transfers = transfers[:limit]
+		resp.NextCursor = encodeCursor(transfers[limit-1].ID)
+	}
+	for _, t := range transfers {
+		resp.Transactions = append(resp.Transactions, transactionForAccount(t, id))
+	}
+
+	return WriteJSON(w, http.StatusOK, resp)
 }
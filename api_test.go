@@ -0,0 +1,532 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Helper for building a server on a memory store with two customers holding 1000 each
+func newTestServer(t *testing.T) (http.Handler, Storage, []*Account) {
+	t.Helper()
+	store := NewMemoryStore()
+	accounts := createTestAccounts(t, store, 2, 1000)
+	return newTestHandler(t, store), store, accounts
+}
+
+// Helper for building a server on any store
+func newTestHandler(t *testing.T, store Storage) http.Handler {
+	t.Helper()
+	keys, err := LoadKeyring("", "test-secret", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secrets, err := NewSecretBox(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewAPIServer(defaultConfig(), store, keys, secrets, LogNotifier{}).Handler()
+}
+
+// Each test request comes from its own address so failed logins in one check don't
+// throttle the next by IP
+var testClientIPs atomic.Int32
+
+// Helper for sending a JSON request to the handler, with a bearer token if one is given
+func doJSON(t *testing.T, h http.Handler, method, path, token string, body any) *httptest.ResponseRecorder {
+	t.Helper()
+	return doJSONWithHeaders(t, h, method, path, token, body, nil)
+}
+
+// Helper for sending a JSON request with extra headers, like If-Match
+func doJSONWithHeaders(t *testing.T, h http.Handler, method, path, token string, body any, headers map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+	b, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(method, path, bytes.NewReader(b))
+	n := testClientIPs.Add(1)
+	req.RemoteAddr = fmt.Sprintf("10.0.%d.%d:1234", n/250, n%250+1)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+// Helper for checking the status and error code of an error response
+func expectError(t *testing.T, rec *httptest.ResponseRecorder, status int, code ErrorCode) {
+	t.Helper()
+	if rec.Code != status {
+		t.Fatalf("got status %d, want %d: %s", rec.Code, status, rec.Body)
+	}
+	var apiErr ApiError
+	if err := json.Unmarshal(rec.Body.Bytes(), &apiErr); err != nil {
+		t.Fatal(err)
+	}
+	if apiErr.Code != code {
+		t.Errorf("got code %q, want %q", apiErr.Code, code)
+	}
+}
+
+// Helper for logging in and returning the access token
+func login(t *testing.T, h http.Handler, account *Account) string {
+	t.Helper()
+	rec := doJSON(t, h, http.MethodPost, "/login", "", LoginRequest{AccountNumber: account.AccountNumber, Password: "password"})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("login got status %d: %s", rec.Code, rec.Body)
+	}
+	var resp LoginResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp.Token
+}
+
+func TestHandleLogin(t *testing.T) {
+	h, _, accounts := newTestServer(t)
+
+	if token := login(t, h, accounts[0]); token == "" {
+		t.Error("login returned no access token")
+	}
+
+	rec := doJSON(t, h, http.MethodPost, "/login", "", LoginRequest{AccountNumber: accounts[1].AccountNumber, Password: "wrong"})
+	expectError(t, rec, http.StatusUnauthorized, CodeUnauthorized)
+
+	// An unknown number gets the same answer as a wrong password
+	rec = doJSON(t, h, http.MethodPost, "/login", "", LoginRequest{AccountNumber: 1234567897, Password: "password"})
+	expectError(t, rec, http.StatusUnauthorized, CodeUnauthorized)
+
+	rec = doJSON(t, h, http.MethodPost, "/login", "", map[string]any{"password": "password"})
+	expectError(t, rec, http.StatusBadRequest, CodeValidation)
+}
+
+// Guesses made in parallel must not get past the lockout by all being checked at once
+func TestHandleLoginParallelGuessesAreLimited(t *testing.T) {
+	h, _, accounts := newTestServer(t)
+	const attempts = 40
+
+	var mu sync.Mutex
+	statuses := map[int]int{}
+	var wg sync.WaitGroup
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := doJSON(t, h, http.MethodPost, "/login", "", LoginRequest{AccountNumber: accounts[0].AccountNumber, Password: "wrong"})
+			mu.Lock()
+			statuses[rec.Code]++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if statuses[http.StatusUnauthorized] > maxAccountLoginFailures {
+		t.Errorf("%d guesses were checked, want at most %d", statuses[http.StatusUnauthorized], maxAccountLoginFailures)
+	}
+	if statuses[http.StatusUnauthorized]+statuses[http.StatusTooManyRequests] != attempts {
+		t.Errorf("got statuses %v, want only 401 and 429", statuses)
+	}
+}
+
+func TestHandleTransfer(t *testing.T) {
+	h, store, accounts := newTestServer(t)
+	from, to := accounts[0], accounts[1]
+	token := login(t, h, from)
+
+	rec := doJSON(t, h, http.MethodPost, "/transfer", token, TransferRequest{ToAccountNumber: to.AccountNumber, Amount: 250})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body)
+	}
+	var receipt TransferReceipt
+	if err := json.Unmarshal(rec.Body.Bytes(), &receipt); err != nil {
+		t.Fatal(err)
+	}
+	if receipt.FromAccountNumber != from.AccountNumber || receipt.ToAccountNumber != to.AccountNumber || receipt.Balance != 750 {
+		t.Errorf("got receipt %+v, want 250 from %d to %d leaving 750", receipt, from.AccountNumber, to.AccountNumber)
+	}
+	got, err := store.GetAccountByID(context.Background(), to.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Balance != 1250 {
+		t.Errorf("to account has a balance of %d, want 1250", got.Balance)
+	}
+
+	tests := []struct {
+		name   string
+		token  string
+		body   any
+		status int
+		code   ErrorCode
+	}{
+		{"no token", "", TransferRequest{ToAccountNumber: to.AccountNumber, Amount: 1}, http.StatusUnauthorized, CodeUnauthorized},
+		{"more than the balance", token, TransferRequest{ToAccountNumber: to.AccountNumber, Amount: 751}, http.StatusUnprocessableEntity, CodeInsufficientFunds},
+		{"unknown account", token, TransferRequest{ToAccountNumber: 1234567897, Amount: 1}, http.StatusNotFound, CodeNotFound},
+		{"zero amount", token, TransferRequest{ToAccountNumber: to.AccountNumber}, http.StatusBadRequest, CodeValidation},
+		{"someone else's account", token, TransferRequest{FromAccountNumber: to.AccountNumber, ToAccountNumber: from.AccountNumber, Amount: 1}, http.StatusForbidden, CodeForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := doJSON(t, h, http.MethodPost, "/transfer", tt.token, tt.body)
+			expectError(t, rec, tt.status, tt.code)
+		})
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	timedOut, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		err     error
+		status  int
+		code    ErrorCode
+		message string
+	}{
+		{"typed error", context.Background(), notFoundError("account not found"), http.StatusNotFound, CodeNotFound, "account not found"},
+		{"wrapped typed error", context.Background(), fmt.Errorf("error getting account: %w", conflictError("taken")), http.StatusConflict, CodeConflict, "error getting account: taken"},
+		{"internal error is hidden", context.Background(), errors.New("pq: connection refused"), http.StatusInternalServerError, CodeInternal, "internal server error"},
+		{"timed out request", timedOut, errors.New("pq: canceling statement due to user request"), http.StatusServiceUnavailable, CodeTimeout, "request timed out"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(tt.ctx)
+			rec := httptest.NewRecorder()
+			writeError(rec, req, tt.err)
+
+			expectError(t, rec, tt.status, tt.code)
+			var apiErr ApiError
+			if err := json.Unmarshal(rec.Body.Bytes(), &apiErr); err != nil {
+				t.Fatal(err)
+			}
+			if apiErr.Error != tt.message {
+				t.Errorf("got message %q, want %q", apiErr.Error, tt.message)
+			}
+		})
+	}
+}
+
+// Helper for decoding a successful JSON response
+func decodeResponse(t *testing.T, rec *httptest.ResponseRecorder, v any) {
+	t.Helper()
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body)
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Following the cursors has to visit every matching account once, in order
+func TestHandleGetAccountsPages(t *testing.T) {
+	h, store, _ := newTestServer(t)
+	teller := createTestAccount(t, store, "Tina", "Teller", 0, RoleTeller)
+	token := login(t, h, teller)
+	for _, balance := range []int64{500, 100, 300, 100, 400} {
+		createTestAccount(t, store, "Paged", "Pagey", balance, RoleCustomer)
+	}
+
+	var balances []int64
+	seen := map[int]bool{}
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > 5 {
+			t.Fatal("cursors never ran out")
+		}
+		var resp AccountsResponse
+		decodeResponse(t, doJSON(t, h, http.MethodGet, "/accounts?name=pag&sort=-balance&limit=2&cursor="+cursor, token, nil), &resp)
+		if resp.Total != 5 {
+			t.Errorf("got a total of %d, want 5", resp.Total)
+		}
+		for _, acc := range resp.Accounts {
+			if seen[acc.ID] {
+				t.Errorf("account %d is on more than one page", acc.ID)
+			}
+			seen[acc.ID] = true
+			balances = append(balances, acc.Balance)
+		}
+		if resp.NextCursor == "" {
+			break
+		}
+		cursor = resp.NextCursor
+	}
+	if fmt.Sprint(balances) != "[500 400 300 100 100]" {
+		t.Errorf("got balances %v, want them largest first", balances)
+	}
+
+	var resp AccountsResponse
+	decodeResponse(t, doJSON(t, h, http.MethodGet, "/accounts?min_balance=200&max_balance=400&created_until=2000-01-01T00:00:00Z", token, nil), &resp)
+	if resp.Total != 0 {
+		t.Errorf("got %d accounts created before 2000, want none", resp.Total)
+	}
+	decodeResponse(t, doJSON(t, h, http.MethodGet, "/accounts?min_balance=200&max_balance=400&created_since=2000-01-01T00:00:00Z", token, nil), &resp)
+	if resp.Total != 2 {
+		t.Errorf("got %d accounts with 200 to 400, want 2", resp.Total)
+	}
+
+	// A cursor only works with the sort it was made for
+	rec := doJSON(t, h, http.MethodGet, "/accounts?sort=last_name&cursor="+cursor, token, nil)
+	expectError(t, rec, http.StatusBadRequest, CodeValidation)
+	rec = doJSON(t, h, http.MethodGet, "/accounts?limit=101", token, nil)
+	expectError(t, rec, http.StatusBadRequest, CodeValidation)
+}
+
+// Transfers name accounts by number, and errors about them never show internal IDs
+func TestHandleTransferByAccountNumber(t *testing.T) {
+	h, store, accounts := newTestServer(t)
+	from, to := accounts[0], accounts[1]
+	teller := createTestAccount(t, store, "Tina", "Teller", 0, RoleTeller)
+	token := login(t, h, teller)
+
+	rec := doJSON(t, h, http.MethodPost, "/transfer", token, TransferRequest{ToAccountNumber: to.AccountNumber, Amount: 10})
+	expectError(t, rec, http.StatusBadRequest, CodeValidation)
+	var apiErr ApiError
+	json.Unmarshal(rec.Body.Bytes(), &apiErr)
+	if len(apiErr.Fields) != 1 || apiErr.Fields[0].Field != "from_account_number" {
+		t.Errorf("got fields %v, want from_account_number", apiErr.Fields)
+	}
+
+	rec = doJSON(t, h, http.MethodPost, "/transfer", token, TransferRequest{FromAccountNumber: from.AccountNumber, ToAccountNumber: to.AccountNumber, Amount: 10})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("teller transfer got status %d: %s", rec.Code, rec.Body)
+	}
+
+	rec = doJSON(t, h, http.MethodPost, fmt.Sprintf("/account/%d/status", to.ID), token, AccountStatusRequest{Status: StatusFrozen})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("freezing got status %d: %s", rec.Code, rec.Body)
+	}
+	rec = doJSON(t, h, http.MethodPost, "/transfer", token, TransferRequest{FromAccountNumber: from.AccountNumber, ToAccountNumber: to.AccountNumber, Amount: 10})
+	expectError(t, rec, http.StatusConflict, CodeConflict)
+	json.Unmarshal(rec.Body.Bytes(), &apiErr)
+	if want := fmt.Sprintf("account %d is frozen", to.AccountNumber); !strings.Contains(apiErr.Error, want) {
+		t.Errorf("got error %q, want it to say %q", apiErr.Error, want)
+	}
+}
+
+// A handler still waiting when the request timeout passes is cut off with a 503,
+// whatever error the interrupted call returned
+func TestWithRequestTimeout(t *testing.T) {
+	slow := MakeHTTPHandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		<-r.Context().Done()
+		return fmt.Errorf("pq: canceling statement due to user request")
+	})
+	h := withRequestTimeout(10 * time.Millisecond)(slow)
+
+	start := time.Now()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("request took %s to time out", elapsed)
+	}
+	expectError(t, rec, http.StatusServiceUnavailable, CodeTimeout)
+}
+
+// heldTxStore is a store whose units of work wait to be released once they have done
+// their work, so a test can stop the server while a transfer is in flight
+type heldTxStore struct {
+	Storage
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (s *heldTxStore) WithTx(ctx context.Context, fn func(TxStore) error) error {
+	return s.Storage.WithTx(ctx, func(tx TxStore) error {
+		if err := fn(tx); err != nil {
+			return err
+		}
+		s.entered <- struct{}{}
+		<-s.release
+		return nil
+	})
+}
+
+// Helper for starting the server on a free local port
+// Returns the base URL and a channel with what Run returned
+func startTestServer(t *testing.T, ctx context.Context, cfg *Config, store Storage) (string, <-chan error) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ListenAddr = listener.Addr().String()
+	listener.Close()
+
+	keys, err := LoadKeyring("", "test-secret", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secrets, err := NewSecretBox(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- NewAPIServer(cfg, store, keys, secrets, LogNotifier{}).Run(ctx)
+	}()
+
+	url := "http://" + cfg.ListenAddr
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		resp, err := http.Get(url + "/.well-known/jwks.json")
+		if err == nil {
+			resp.Body.Close()
+			return url, done
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("server didn't start: %v", err)
+		}
+	}
+}
+
+// Helper for sending a JSON request to a running server
+func postJSON(url, token string, body any) (*http.Response, error) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return http.DefaultClient.Do(req)
+}
+
+// Helper for logging in to a running server
+func loginTo(t *testing.T, url string, account *Account) string {
+	t.Helper()
+	resp, err := postJSON(url+"/login", "", LoginRequest{AccountNumber: account.AccountNumber, Password: "password"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var login LoginResponse
+	if err := json.NewDecoder(resp.Body).Decode(&login); err != nil {
+		t.Fatal(err)
+	}
+	return login.Token
+}
+
+// Stopping the server lets a transfer in flight finish before Run returns
+func TestRunDrainsRequestsOnShutdown(t *testing.T) {
+	mem := NewMemoryStore()
+	accounts := createTestAccounts(t, mem, 2, 1000)
+	store := &heldTxStore{Storage: mem, entered: make(chan struct{}), release: make(chan struct{})}
+
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	url, done := startTestServer(t, ctx, defaultConfig(), store)
+	token := loginTo(t, url, accounts[0])
+
+	transferred := make(chan int, 1)
+	go func() {
+		resp, err := postJSON(url+"/transfer", token, TransferRequest{ToAccountNumber: accounts[1].AccountNumber, Amount: 100})
+		if err != nil {
+			t.Error(err)
+			transferred <- 0
+			return
+		}
+		resp.Body.Close()
+		transferred <- resp.StatusCode
+	}()
+
+	<-store.entered
+	stop()
+	select {
+	case err := <-done:
+		t.Fatalf("Run returned %v with a transfer in flight", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(store.release)
+	if status := <-transferred; status != http.StatusOK {
+		t.Errorf("transfer in flight got status %d", status)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("Run returned %v after a clean shutdown", err)
+	}
+	got, err := mem.GetAccountByID(context.Background(), accounts[1].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Balance != 1100 {
+		t.Errorf("receiving account has %d, want 1100", got.Balance)
+	}
+}
+
+// A transfer still running when the shutdown timeout passes is cut off and rolled back
+func TestRunShutdownTimeout(t *testing.T) {
+	mem := NewMemoryStore()
+	accounts := createTestAccounts(t, mem, 2, 1000)
+	store := &heldTxStore{Storage: mem, entered: make(chan struct{}), release: make(chan struct{})}
+
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	cfg := defaultConfig()
+	cfg.ShutdownTimeout = 50 * time.Millisecond
+	url, done := startTestServer(t, ctx, cfg, store)
+	token := loginTo(t, url, accounts[0])
+
+	transferred := make(chan error, 1)
+	go func() {
+		resp, err := postJSON(url+"/transfer", token, TransferRequest{ToAccountNumber: accounts[1].AccountNumber, Amount: 100})
+		if err == nil {
+			resp.Body.Close()
+		}
+		transferred <- err
+	}()
+
+	<-store.entered
+	stop()
+	if err := <-done; err == nil {
+		t.Error("Run returned no error after cutting off a request")
+	}
+	close(store.release)
+	if err := <-transferred; err == nil {
+		t.Error("the cut off transfer got a response")
+	}
+
+	for _, acc := range accounts {
+		got, err := mem.GetAccountByID(context.Background(), acc.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Balance != 1000 {
+			t.Errorf("account %d has %d after the transfer was cut off, want 1000", acc.ID, got.Balance)
+		}
+	}
+}
+
+func TestRunListenError(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	cfg := defaultConfig()
+	cfg.ListenAddr = listener.Addr().String()
+	server := NewAPIServer(cfg, NewMemoryStore(), nil, nil, LogNotifier{})
+	if err := server.Run(context.Background()); err == nil {
+		t.Error("Run on a port in use returned no error")
+	}
+}
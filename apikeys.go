@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"strings"
+	"time"
+)
+
+// API keys let services call the API without logging in as an account
+// A key looks like gbk_<12 hex characters>_<secret>. The part before the secret is the prefix,
+// which is stored in the clear to find the key and to tell keys apart in listings.
+// Only a hash of the whole key is stored
+const (
+	apiKeyHeader    = "X-API-Key"
+	apiKeyTag       = "gbk_"
+	apiKeyPrefixLen = len(apiKeyTag) + 12
+	// last_used_at is only written this often so busy keys don't write on every request
+	apiKeyTouchInterval = time.Minute
+)
+
+// Permissions that can't be given to an API key
+// A key that could manage keys or roles could give itself or others more access
+var nonGrantablePermissions = map[Permission]bool{
+	PermAPIKeysManage:    true,
+	PermRolesManage:      true,
+	PermAdminRolesManage: true,
+}
+
+// generateAPIKey creates a new key and its prefix
+func generateAPIKey() (string, string, error) {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	prefix := apiKeyTag + hex.EncodeToString(b)
+
+	secret, err := randomToken(32)
+	if err != nil {
+		return "", "", err
+	}
+	return prefix + "_" + secret, prefix, nil
+}
+
+// Helper for getting the prefix of a key presented by a client
+func apiKeyPrefixOf(key string) (string, bool) {
+	if !strings.HasPrefix(key, apiKeyTag) || len(key) <= apiKeyPrefixLen || key[apiKeyPrefixLen] != '_' {
+		return "", false
+	}
+	return key[:apiKeyPrefixLen], true
+}
+
+// authenticateAPIKey finds the key a client presented and checks it can still be used
+func authenticateAPIKey(ctx context.Context, s Storage, key string) (*APIKey, error) {
+	prefix, ok := apiKeyPrefixOf(key)
+	if !ok {
+		return nil, unauthorizedError("invalid api key")
+	}
+	apiKey, err := s.GetAPIKeyByPrefix(ctx, prefix)
+	if isErrorCode(err, CodeNotFound) {
+		return nil, unauthorizedError("invalid api key")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal([]byte(apiKey.KeyHash), []byte(hashToken(key))) {
+		return nil, unauthorizedError("invalid api key")
+	}
+
+	now := time.Now().UTC()
+	if apiKey.RevokedAt != nil {
+		return nil, unauthorizedError("api key has been revoked")
+	}
+	if apiKey.ExpiresAt != nil && now.After(*apiKey.ExpiresAt) {
+		return nil, unauthorizedError("api key has expired")
+	}
+
+	if apiKey.LastUsedAt == nil || now.Sub(*apiKey.LastUsedAt) > apiKeyTouchInterval {
+		if err := s.TouchAPIKey(ctx, apiKey.ID, now); err != nil {
+			log.Println("error recording api key use:", err)
+		}
+		apiKey.LastUsedAt = &now
+	}
+	return apiKey, nil
+}
+
+// checkAPIKeyRequest checks the permissions, accounts and expiry of a key being created or updated
+// The name and that there are permissions at all are checked by decodeJSON
+// A key can only be given permissions the caller holds for every account
+func checkAPIKeyRequest(ctx context.Context, s Storage, req *APIKeyRequest) error {
+	principal, ok := principalFromContext(ctx)
+	if !ok {
+		return forbiddenError("insufficient permissions")
+	}
+	for _, perm := range req.Permissions {
+		if !perm.Valid() {
+			return fieldError("permissions", "unknown permission %s", perm)
+		}
+		if nonGrantablePermissions[perm] {
+			return fieldError("permissions", "permission %s can't be given to an api key", perm)
+		}
+		if principal.Scope(perm) != ScopeAny {
+			return forbiddenError("you can't give permission %s to an api key", perm)
+		}
+	}
+
+	for _, id := range req.AccountIDs {
+		_, err := s.GetAccountByID(ctx, id)
+		if isErrorCode(err, CodeNotFound) {
+			return fieldError("account_ids", "account %d not found", id)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		return fieldError("expires_at", "expires_at must be in the future")
+	}
+	return nil
+}
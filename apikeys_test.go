@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAPIKeyPrefixOf(t *testing.T) {
+	key, prefix, err := generateAPIKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := apiKeyPrefixOf(key); !ok || got != prefix {
+		t.Errorf("apiKeyPrefixOf(%q) = %q, %v, want %q", key, got, ok, prefix)
+	}
+
+	for _, bad := range []string{"", "gbk_", prefix, prefix + "x", "abc_" + key[4:], strings.Replace(key, "_", "-", 2)} {
+		if _, ok := apiKeyPrefixOf(bad); ok {
+			t.Errorf("apiKeyPrefixOf(%q) found a prefix", bad)
+		}
+	}
+}
+
+// Helper for sending a request authenticated with an API key
+func doWithAPIKey(t *testing.T, h http.Handler, method, path, key string, body any) *httptest.ResponseRecorder {
+	t.Helper()
+	return doJSONWithHeaders(t, h, method, path, "", body, map[string]string{apiKeyHeader: key})
+}
+
+// A key can only do what it was given, for the accounts it was given, until it is revoked
+func TestAPIKeys(t *testing.T) {
+	h, store, accounts := newTestServer(t)
+	a, b := accounts[0], accounts[1]
+	admin := createTestAccount(t, store, "Keys", "Admin", 0, RoleAdmin)
+	adminToken := loginWithMFA(t, h, admin)
+
+	rec := doJSON(t, h, http.MethodPost, "/api-keys", adminToken, APIKeyRequest{
+		Name:        "batch",
+		Permissions: []Permission{PermAccountRead, PermTransferCreate},
+		AccountIDs:  []int{a.ID},
+	})
+	var created CreateAPIKeyResponse
+	decodeResponse(t, rec, &created)
+	if !strings.HasPrefix(created.Key, created.Prefix+"_") {
+		t.Fatalf("key %q doesn't start with its prefix %q", created.Key, created.Prefix)
+	}
+
+	// Only the hash is stored
+	stored, err := store.GetAPIKeyByID(context.Background(), created.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.KeyHash != hashToken(created.Key) || strings.Contains(rec.Body.String(), stored.KeyHash) {
+		t.Error("the stored key isn't a hash of the key, or the hash was sent back")
+	}
+
+	if rec := doWithAPIKey(t, h, http.MethodGet, fmt.Sprintf("/account/%d", a.ID), created.Key, nil); rec.Code != http.StatusOK {
+		t.Errorf("reading a granted account got status %d: %s", rec.Code, rec.Body)
+	}
+	rec = doWithAPIKey(t, h, http.MethodGet, fmt.Sprintf("/account/%d", b.ID), created.Key, nil)
+	expectError(t, rec, http.StatusForbidden, CodeForbidden)
+	rec = doWithAPIKey(t, h, http.MethodGet, "/accounts", created.Key, nil)
+	expectError(t, rec, http.StatusForbidden, CodeForbidden)
+
+	rec = doWithAPIKey(t, h, http.MethodPost, "/transfer", created.Key, TransferRequest{FromAccountNumber: a.AccountNumber, ToAccountNumber: b.AccountNumber, Amount: 10})
+	if rec.Code != http.StatusOK {
+		t.Errorf("transfer from a granted account got status %d: %s", rec.Code, rec.Body)
+	}
+	rec = doWithAPIKey(t, h, http.MethodPost, "/transfer", created.Key, TransferRequest{FromAccountNumber: b.AccountNumber, ToAccountNumber: a.AccountNumber, Amount: 10})
+	expectError(t, rec, http.StatusForbidden, CodeForbidden)
+
+	var listed APIKey
+	decodeResponse(t, doJSON(t, h, http.MethodGet, fmt.Sprintf("/api-keys/%d", created.ID), adminToken, nil), &listed)
+	if listed.LastUsedAt == nil {
+		t.Error("last_used_at wasn't set")
+	}
+
+	// Moving the key to the other account
+	path := fmt.Sprintf("/api-keys/%d", created.ID)
+	rec = doJSON(t, h, http.MethodPut, path, adminToken, APIKeyRequest{Name: "batch", Permissions: []Permission{PermAccountRead}, AccountIDs: []int{b.ID}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("updating got status %d: %s", rec.Code, rec.Body)
+	}
+	if rec := doWithAPIKey(t, h, http.MethodGet, fmt.Sprintf("/account/%d", b.ID), created.Key, nil); rec.Code != http.StatusOK {
+		t.Errorf("reading the newly granted account got status %d: %s", rec.Code, rec.Body)
+	}
+
+	rec = doWithAPIKey(t, h, http.MethodGet, fmt.Sprintf("/account/%d", b.ID), created.Key[:len(created.Key)-1]+"x", nil)
+	expectError(t, rec, http.StatusUnauthorized, CodeUnauthorized)
+
+	rec = doJSON(t, h, http.MethodDelete, path, adminToken, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("revoking got status %d: %s", rec.Code, rec.Body)
+	}
+	rec = doWithAPIKey(t, h, http.MethodGet, fmt.Sprintf("/account/%d", b.ID), created.Key, nil)
+	expectError(t, rec, http.StatusUnauthorized, CodeUnauthorized)
+	rec = doJSON(t, h, http.MethodPut, path, adminToken, APIKeyRequest{Name: "batch", Permissions: []Permission{PermAccountRead}})
+	expectError(t, rec, http.StatusConflict, CodeConflict)
+}
+
+func TestAPIKeyExpires(t *testing.T) {
+	h, store, accounts := newTestServer(t)
+	adminToken := loginWithMFA(t, h, createTestAccount(t, store, "Keys", "Admin", 0, RoleAdmin))
+
+	rec := doJSON(t, h, http.MethodPost, "/api-keys", adminToken, APIKeyRequest{Name: "reader", Permissions: []Permission{PermAccountRead}})
+	var created CreateAPIKeyResponse
+	decodeResponse(t, rec, &created)
+
+	past := time.Now().Add(-time.Minute).UTC()
+	key, err := store.GetAPIKeyByID(context.Background(), created.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key.ExpiresAt = &past
+	if err := store.UpdateAPIKey(context.Background(), key); err != nil {
+		t.Fatal(err)
+	}
+	rec = doWithAPIKey(t, h, http.MethodGet, fmt.Sprintf("/account/%d", accounts[0].ID), created.Key, nil)
+	expectError(t, rec, http.StatusUnauthorized, CodeUnauthorized)
+}
+
+// Keys can't be given more than the admin holds, or the power to hand out more access
+func TestCreateAPIKeyRejectsBadRequests(t *testing.T) {
+	h, store, _ := newTestServer(t)
+	adminToken := loginWithMFA(t, h, createTestAccount(t, store, "Keys", "Admin", 0, RoleAdmin))
+	past := time.Now().Add(-time.Hour)
+
+	tests := []struct {
+		name   string
+		req    APIKeyRequest
+		status int
+		code   ErrorCode
+	}{
+		{"no name", APIKeyRequest{Permissions: []Permission{PermAccountRead}}, http.StatusBadRequest, CodeValidation},
+		{"no permissions", APIKeyRequest{Name: "k"}, http.StatusBadRequest, CodeValidation},
+		{"unknown permission", APIKeyRequest{Name: "k", Permissions: []Permission{"vault:open"}}, http.StatusBadRequest, CodeValidation},
+		{"managing keys", APIKeyRequest{Name: "k", Permissions: []Permission{PermAPIKeysManage}}, http.StatusBadRequest, CodeValidation},
+		{"managing roles", APIKeyRequest{Name: "k", Permissions: []Permission{PermRolesManage}}, http.StatusBadRequest, CodeValidation},
+		{"superadmin roles", APIKeyRequest{Name: "k", Permissions: []Permission{PermAdminRolesManage}}, http.StatusBadRequest, CodeValidation},
+		{"unknown account", APIKeyRequest{Name: "k", Permissions: []Permission{PermAccountRead}, AccountIDs: []int{999}}, http.StatusBadRequest, CodeValidation},
+		{"already expired", APIKeyRequest{Name: "k", Permissions: []Permission{PermAccountRead}, ExpiresAt: &past}, http.StatusBadRequest, CodeValidation},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := doJSON(t, h, http.MethodPost, "/api-keys", adminToken, tt.req)
+			expectError(t, rec, tt.status, tt.code)
+		})
+	}
+
+	// Only admins reach the endpoint, but the check doesn't rely on that
+	teller := NewAccountPrincipal(&Account{ID: 99, Roles: []Role{RoleTeller}})
+	ctx := context.WithValue(context.Background(), principalContextKey, teller)
+	err := checkAPIKeyRequest(ctx, store, &APIKeyRequest{Name: "k", Permissions: []Permission{PermSecurityEventsRead}})
+	if !isErrorCode(err, CodeForbidden) {
+		t.Errorf("teller giving a permission they don't hold got %v, want forbidden", err)
+	}
+}
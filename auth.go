@@ -1,9 +1,9 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http"
-	"os"
 	"strings"
 	"time"
 
@@ -17,33 +17,57 @@ func (a *Account) ComparePassword(pw string) bool {
 }
 
 // Helper for making JWT token
-// Creates a JWT token with the account number and user ID as claims
-func createJWTToken(account *Account) (string, error) {
+// Creates a short-lived access token with the account number and user ID as claims
+// jti identifies the token so it can be revoked, sid is the refresh token family it belongs to
+// mfa records whether the login passed two-factor authentication
+// iat_us is the issue time in microseconds, so a password change can be told apart from a
+// login in the same second
+// The token is signed with the keyring's active key, see keys.go
+func createJWTToken(keys *Keyring, account *Account, familyID string, mfa bool) (string, error) {
+	jti, err := randomToken(16)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
 	claims := jwt.MapClaims{
 		"account_number": account.AccountNumber,
 		"user_id":        account.ID,
-		"exp":            time.Now().Add(time.Hour * 24).Unix(),
-		"token_type":     "Bearer",
+		"iat":            now.Unix(),
+		"iat_us":         now.UnixMicro(),
+		"exp":            now.Add(accessTokenTTL).Unix(),
+		"jti":            jti,
+		"sid":            familyID,
+		"mfa":            mfa,
+		"token_type":     tokenTypeAccess,
 	}
-	secret := os.Getenv("JWT_SECRET")
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 
-	return token.SignedString([]byte(secret))
+	return keys.Sign(claims)
 }
 
 // Helper for validating JWT token
-// Parses the token and checks if it is valid based on the secret
-func validateJWTToken(token string) (*jwt.Token, error) {
-	secret := os.Getenv("JWT_SECRET")
-
-	return jwt.Parse(token, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+// Parses the token and checks its signature against the key named by its kid
+// Tokens on the revocation list are rejected even if they haven't expired
+func validateJWTToken(ctx context.Context, keys *Keyring, tokenStr string, s Storage) (*jwt.Token, error) {
+	token, err := keys.Parse(tokenStr)
+	if err != nil {
+		return nil, unauthorizedError("invalid token")
+	}
 
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
+	claims := token.Claims.(jwt.MapClaims)
+	jti, _ := claims["jti"].(string)
+	if jti == "" {
+		return nil, unauthorizedError("invalid token")
+	}
+	revoked, err := s.IsAccessTokenRevoked(ctx, jti)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, unauthorizedError("token has been revoked")
+	}
 
-		return []byte(secret), nil
-	})
+	return token, nil
 }
 
 // Helper for getting user ID from JWT token claims
@@ -56,56 +80,113 @@ func getIDFromClaims(token *jwt.Token) (int, error) {
 	return int(id), nil
 }
 
+// Helper for getting the token's identity from its claims
+// This is what logout needs to revoke the token and its refresh token family
+func sessionFromClaims(token *jwt.Token) *Session {
+	claims := token.Claims.(jwt.MapClaims)
+	session := &Session{}
+	session.TokenID, _ = claims["jti"].(string)
+	session.FamilyID, _ = claims["sid"].(string)
+	session.MFA, _ = claims["mfa"].(bool)
+	if iat, err := claims.GetIssuedAt(); err == nil && iat != nil {
+		session.IssuedAt = iat.Time
+	}
+	// Tokens from before iat_us was added only have the second they were issued in
+	if iatMicros, ok := claims["iat_us"].(float64); ok {
+		session.IssuedAt = time.UnixMicro(int64(iatMicros))
+	}
+	if exp, err := claims.GetExpirationTime(); err == nil && exp != nil {
+		session.ExpiresAt = exp.Time
+	}
+	return session
+}
+
+// Helper for checking a token wasn't issued before the account's password changed
+// Both times are in microseconds, older tokens without iat_us only have whole seconds and
+// are rejected if they come from the same second as the change
+func tokenStillValid(account *Account, session *Session) bool {
+	if account.TokensValidAfter == nil {
+		return true
+	}
+	return !session.IssuedAt.Before(*account.TokensValidAfter)
+}
+
 // Middleware for JWT authentication
 // 1. Validates the token
-// 2. Checks if the user is an admin if the endpoint is admin-only
-// 3. Checks if the user is accessing their own account by ID
+// 2. Loads the account the token belongs to
+// 3. Stores a Principal with the account's permissions in the request context
 // If any of the above checks fail, the middleware returns an error
-func withJWTAuth(adminOnly bool, handlerFunc http.HandlerFunc, s Storage) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		fmt.Println("call to JWT middleware")
-
-		authHeader := r.Header.Get("Authorization")
-		if authHeader == "" {
-			WriteJSON(w, http.StatusUnauthorized, ApiError{Error: "no token provided"})
-			return
-		}
-		tokenStr := strings.TrimPrefix(authHeader, "Bearer ")
-
-		token, err := validateJWTToken(tokenStr)
-		if err != nil {
-			WriteJSON(w, http.StatusInternalServerError, ApiError{Error: "error validating token"})
-			return
-		}
-		if !token.Valid {
-			WriteJSON(w, http.StatusUnauthorized, ApiError{Error: "token is invalid. unauthorized"})
-			return
-		}
-
-		userID, err := getIDFromClaims(token)
-		if err != nil {
-			WriteJSON(w, http.StatusInternalServerError, ApiError{Error: "error getting user ID from token"})
-			return
-		}
-
-		account, err := s.GetAccountByID(userID)
-		if err != nil {
-			WriteJSON(w, http.StatusInternalServerError, ApiError{Error: "error getting account"})
-			return
-		}
-
-		// Check if the user is an admin if the endpoint is admin-only
-		if adminOnly && !account.IsAdmin {
-			WriteJSON(w, http.StatusUnauthorized, ApiError{Error: "insufficient permissions"})
-			return
-		}
-
-		// Check if the user is accessing their own account by ID
-		if !account.IsAdmin && r.URL.Path != fmt.Sprintf("/account/%d", userID) {
-			WriteJSON(w, http.StatusUnauthorized, ApiError{Error: "insufficient permissions"})
-			return
-		}
-
-		handlerFunc(w, r)
+// Requests with an X-API-Key header are authenticated with the API key instead, see apikeys.go
+// Deciding what the caller may do is left to authorize in authz.go
+func withJWTAuth(s Storage, keys *Keyring) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if key := r.Header.Get(apiKeyHeader); key != "" {
+				apiKey, err := authenticateAPIKey(r.Context(), s, key)
+				if err != nil {
+					writeError(w, r, err)
+					return
+				}
+				ctx := context.WithValue(r.Context(), principalContextKey, NewAPIKeyPrincipal(apiKey))
+				next.ServeHTTP(w, r.WithContext(ctx))
+				return
+			}
+
+			authHeader := r.Header.Get("Authorization")
+			if authHeader == "" {
+				writeError(w, r, unauthorizedError("no token provided"))
+				return
+			}
+			tokenStr := strings.TrimPrefix(authHeader, "Bearer ")
+
+			// Malformed, expired and revoked tokens are all the client's problem, so they are 401s
+			// Only a failure to check the revocation list is a 500
+			token, err := validateJWTToken(r.Context(), keys, tokenStr, s)
+			if err != nil {
+				writeError(w, r, err)
+				return
+			}
+			// MFA tokens from the first step of a login are not access tokens
+			if !token.Valid || tokenType(token) != tokenTypeAccess {
+				writeError(w, r, unauthorizedError("invalid token"))
+				return
+			}
+
+			userID, err := getIDFromClaims(token)
+			if err != nil {
+				writeError(w, r, unauthorizedError("invalid token"))
+				return
+			}
+
+			account, err := s.GetAccountByID(r.Context(), userID)
+			if isErrorCode(err, CodeNotFound) {
+				writeError(w, r, unauthorizedError("invalid token"))
+				return
+			}
+			if err != nil {
+				writeError(w, r, err)
+				return
+			}
+
+			// Tokens stop working as soon as the account is closed or deleted
+			if account.Status == StatusClosed {
+				writeError(w, r, unauthorizedError("account is closed"))
+				return
+			}
+
+			// Tokens issued before the password last changed no longer work
+			session := sessionFromClaims(token)
+			if !tokenStillValid(account, session) {
+				writeError(w, r, unauthorizedError("invalid token"))
+				return
+			}
+
+			// Make the caller available to the handlers and middleware further down
+			principal := NewAccountPrincipal(account)
+			principal.Session = session
+			principal.MFARequired = mfaRequired(account) && !principal.Session.MFA
+			ctx := context.WithValue(r.Context(), principalContextKey, principal)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
 	}
 }
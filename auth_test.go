@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// A password change stops older tokens working, but a login straight after it, usually in
+// the same second, has to get a token that works
+func TestChangePasswordRevokesOlderTokens(t *testing.T) {
+	h, _, accounts := newTestServer(t)
+	account := accounts[0]
+	path := fmt.Sprintf("/account/%d", account.ID)
+
+	old := login(t, h, account)
+	rec := doJSON(t, h, http.MethodPost, path+"/password", old, ChangePasswordRequest{CurrentPassword: "password", NewPassword: "N3w-password!"})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("changing the password got status %d: %s", rec.Code, rec.Body)
+	}
+
+	rec = doJSON(t, h, http.MethodPost, "/login", "", LoginRequest{AccountNumber: account.AccountNumber, Password: "N3w-password!"})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("login with the new password got status %d: %s", rec.Code, rec.Body)
+	}
+	var resp LoginResponse
+	decodeResponse(t, rec, &resp)
+
+	rec = doJSON(t, h, http.MethodGet, path, resp.Token, nil)
+	if rec.Code != http.StatusOK {
+		t.Errorf("token from after the change got status %d: %s", rec.Code, rec.Body)
+	}
+	rec = doJSON(t, h, http.MethodGet, path, old, nil)
+	expectError(t, rec, http.StatusUnauthorized, CodeUnauthorized)
+}
+
+func TestTokenStillValid(t *testing.T) {
+	changed := time.Date(2024, 3, 1, 12, 0, 0, 500000000, time.UTC)
+	account := &Account{TokensValidAfter: &changed}
+
+	tests := []struct {
+		name     string
+		issuedAt time.Time
+		valid    bool
+	}{
+		{"later in the same second", changed.Add(time.Microsecond), true},
+		{"at the change", changed, true},
+		{"earlier in the same second", changed.Add(-time.Microsecond), false},
+		// Tokens without iat_us only know their second, which starts before the change
+		{"whole second of the change", changed.Truncate(time.Second), false},
+		{"next second", changed.Truncate(time.Second).Add(time.Second), true},
+	}
+	for _, tt := range tests {
+		if got := tokenStillValid(account, &Session{IssuedAt: tt.issuedAt}); got != tt.valid {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.valid)
+		}
+	}
+
+	if !tokenStillValid(&Account{}, &Session{}) {
+		t.Error("token for an account whose password never changed was rejected")
+	}
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Role is a named set of permissions assigned to an account
+// Roles are stored in the account_roles table
+type Role string
+
+const (
+	RoleCustomer Role = "customer"
+	RoleTeller   Role = "teller"
+	RoleAuditor  Role = "auditor"
+	RoleAdmin    Role = "admin"
+	// Superadmins are admins who can also grant the admin roles, accounts have it alongside admin
+	RoleSuperAdmin Role = "superadmin"
+)
+
+// privilegedRoles can only be granted or revoked by a caller with PermAdminRolesManage
+var privilegedRoles = map[Role]bool{
+	RoleAdmin:      true,
+	RoleSuperAdmin: true,
+}
+
+// Permission is an action a route requires
+type Permission string
+
+const (
+	PermAccountsList       Permission = "accounts:list"
+	PermAccountsCreate     Permission = "accounts:create"
+	PermAccountRead        Permission = "account:read"
+	PermAccountUpdate      Permission = "account:update"
+	PermAccountDelete      Permission = "account:delete"
+	PermAccountStatus      Permission = "account:status"
+	PermTransactionsRead   Permission = "transactions:read"
+	PermTransferCreate     Permission = "transfers:create"
+	PermRolesManage        Permission = "roles:manage"
+	PermLoginUnlock        Permission = "login:unlock"
+	PermSecurityEventsRead Permission = "security_events:read"
+	PermPasswordChange     Permission = "account:password"
+	PermPasswordReset      Permission = "account:password_reset"
+	PermAPIKeysManage      Permission = "api_keys:manage"
+	// Field-level permissions, checked by checkAccountChanges on top of account:update
+	PermAccountNumberChange Permission = "account:number"
+	PermAdminRolesManage    Permission = "roles:admin"
+)
+
+// Scope says which resources a permission covers
+// ScopeOwn only covers resources owned by the caller's own account, ScopeAny covers all of them
+type Scope int
+
+const (
+	ScopeNone Scope = iota
+	ScopeOwn
+	ScopeAny
+)
+
+// rolePermissions is the permission model
+// Customers look after their own account, tellers serve customers, auditors can
+// read everything and change nothing, and admins can do anything except hand out admin
+var rolePermissions = map[Role]map[Permission]Scope{
+	RoleCustomer: {
+		PermAccountRead:      ScopeOwn,
+		PermTransactionsRead: ScopeOwn,
+		PermTransferCreate:   ScopeOwn,
+		PermPasswordChange:   ScopeOwn,
+	},
+	RoleTeller: {
+		PermAccountsList:     ScopeAny,
+		PermAccountsCreate:   ScopeAny,
+		PermAccountRead:      ScopeAny,
+		PermAccountUpdate:    ScopeAny,
+		PermAccountStatus:    ScopeAny,
+		PermTransactionsRead: ScopeAny,
+		PermTransferCreate:   ScopeAny,
+		PermPasswordChange:   ScopeOwn,
+	},
+	RoleAuditor: {
+		PermAccountsList:       ScopeAny,
+		PermAccountRead:        ScopeAny,
+		PermTransactionsRead:   ScopeAny,
+		PermSecurityEventsRead: ScopeAny,
+		PermPasswordChange:     ScopeOwn,
+	},
+	RoleAdmin: {
+		PermAccountsList:        ScopeAny,
+		PermAccountsCreate:      ScopeAny,
+		PermAccountRead:         ScopeAny,
+		PermAccountUpdate:       ScopeAny,
+		PermAccountDelete:       ScopeAny,
+		PermAccountStatus:       ScopeAny,
+		PermTransactionsRead:    ScopeAny,
+		PermTransferCreate:      ScopeAny,
+		PermRolesManage:         ScopeAny,
+		PermLoginUnlock:         ScopeAny,
+		PermSecurityEventsRead:  ScopeAny,
+		PermPasswordChange:      ScopeOwn,
+		PermPasswordReset:       ScopeAny,
+		PermAPIKeysManage:       ScopeAny,
+		PermAccountNumberChange: ScopeAny,
+	},
+	RoleSuperAdmin: {
+		PermAdminRolesManage: ScopeAny,
+	},
+}
+
+// Valid reports whether the role is one of the known roles
+func (r Role) Valid() bool {
+	_, ok := rolePermissions[r]
+	return ok
+}
+
+// Valid reports whether the permission is held by any role
+func (p Permission) Valid() bool {
+	for _, perms := range rolePermissions {
+		if _, ok := perms[p]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// HasRole reports whether the account has been assigned a role
+func (a *Account) HasRole(role Role) bool {
+	for _, r := range a.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Principal is the authenticated caller of a request
+// It is built by withJWTAuth and read by authorize and the handlers
+// Callers using an API key have no Account. If the key is limited to some accounts
+// its permissions have ScopeOwn and the accounts are in Accounts
+type Principal struct {
+	Account     *Account
+	APIKey      *APIKey
+	Accounts    []int
+	Permissions map[Permission]Scope
+	Session     *Session
+	// MFARequired is set for admins who logged in without a second factor
+	// They can't use any permissions until they enroll and log in again with a code
+	MFARequired bool
+}
+
+// Session identifies the access token a request was made with
+type Session struct {
+	TokenID   string
+	FamilyID  string
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+	MFA       bool
+}
+
+// NewAccountPrincipal builds a principal with the combined permissions of the account's roles
+// When roles grant the same permission the widest scope wins
+func NewAccountPrincipal(account *Account) *Principal {
+	perms := map[Permission]Scope{}
+	for _, role := range account.Roles {
+		for perm, scope := range rolePermissions[role] {
+			if scope > perms[perm] {
+				perms[perm] = scope
+			}
+		}
+	}
+
+	return &Principal{
+		Account:     account,
+		Permissions: perms,
+	}
+}
+
+// NewAPIKeyPrincipal builds a principal with the permissions granted to an API key
+func NewAPIKeyPrincipal(key *APIKey) *Principal {
+	scope := ScopeAny
+	if len(key.AccountIDs) > 0 {
+		scope = ScopeOwn
+	}
+	perms := map[Permission]Scope{}
+	for _, perm := range key.Permissions {
+		perms[perm] = scope
+	}
+
+	return &Principal{
+		APIKey:      key,
+		Accounts:    key.AccountIDs,
+		Permissions: perms,
+	}
+}
+
+// CallerID identifies the caller, this is what idempotency keys are scoped to
+func (p *Principal) CallerID() string {
+	if p.APIKey != nil {
+		return "api_key:" + strconv.Itoa(p.APIKey.ID)
+	}
+	return "account:" + strconv.Itoa(p.Account.ID)
+}
+
+// String describes the caller for security events
+func (p *Principal) String() string {
+	if p.APIKey != nil {
+		return fmt.Sprintf("api key %s (%s)", p.APIKey.Prefix, p.APIKey.Name)
+	}
+	return fmt.Sprintf("account %d", p.Account.AccountNumber)
+}
+
+// Scope returns how widely the principal holds a permission
+func (p *Principal) Scope(perm Permission) Scope {
+	return p.Permissions[perm]
+}
+
+// Can reports whether the principal may use a permission on a resource owned by ownerID
+func (p *Principal) Can(perm Permission, ownerID int) bool {
+	switch p.Scope(perm) {
+	case ScopeAny:
+		return true
+	case ScopeOwn:
+		if ownerID == ownerCheckedByHandler && p.APIKey != nil {
+			return true
+		}
+		if p.Account != nil && p.Account.ID == ownerID {
+			return true
+		}
+		for _, id := range p.Accounts {
+			if id == ownerID {
+				return true
+			}
+		}
+		return false
+	default:
+		return false
+	}
+}
+
+// ownerResolver finds the account that owns the resource a request is about
+type ownerResolver func(r *http.Request) (int, error)
+
+// accountFromURL resolves the owner from the route's {id} parameter
+// This covers /account/{id} and everything under it
+func accountFromURL(r *http.Request) (int, error) {
+	idStr := chi.URLParam(r, "id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return 0, validationError("invalid id %s", idStr)
+	}
+	return id, nil
+}
+
+// ownerCheckedByHandler is returned by callerAccount for API keys limited to some accounts
+// Which account the request is about is in the body, so the handler has to check it with Can
+const ownerCheckedByHandler = -1
+
+// callerAccount resolves the owner to the caller's own account
+// It is used where the handler itself scopes the request to the caller, like transfers
+func callerAccount(r *http.Request) (int, error) {
+	principal, ok := principalFromContext(r.Context())
+	if !ok {
+		return 0, unauthorizedError("unauthorized")
+	}
+	if principal.Account == nil {
+		return ownerCheckedByHandler, nil
+	}
+	return principal.Account.ID, nil
+}
+
+// Middleware for authorization, runs after withJWTAuth
+// Each route declares the permission it needs and how to find the owner of the resource
+// A nil resolver means the route isn't about one account, so the permission must be held with ScopeAny
+func authorize(perm Permission, resolve ownerResolver) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			principal, ok := principalFromContext(r.Context())
+			if !ok {
+				writeError(w, r, unauthorizedError("unauthorized"))
+				return
+			}
+			if principal.MFARequired {
+				writeError(w, r, forbiddenError("two-factor authentication is required for this account, set it up at /mfa/enroll and log in again"))
+				return
+			}
+
+			allowed := principal.Scope(perm) == ScopeAny
+			if !allowed && resolve != nil {
+				ownerID, err := resolve(r)
+				if err != nil {
+					writeError(w, r, err)
+					return
+				}
+				allowed = principal.Can(perm, ownerID)
+			}
+
+			if !allowed {
+				writeError(w, r, forbiddenError("insufficient permissions"))
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Key for storing the authenticated principal in the request context
+type contextKey string
+
+const principalContextKey contextKey = "principal"
+
+// Helper for getting the principal set by withJWTAuth
+func principalFromContext(ctx context.Context) (*Principal, bool) {
+	principal, ok := ctx.Value(principalContextKey).(*Principal)
+	return principal, ok
+}
+
+// Helper for getting the authenticated account set by withJWTAuth
+func accountFromContext(ctx context.Context) (*Account, bool) {
+	principal, ok := principalFromContext(ctx)
+	if !ok || principal.Account == nil {
+		return nil, false
+	}
+	return principal.Account, true
+}
+
+// checkCanAssignRoles checks that every role is known and that the caller may assign them
+// Keeping an account's roles as they are is always allowed, anything else needs roles:manage
+func checkCanAssignRoles(ctx context.Context, roles []Role, current []Role) error {
+	for _, role := range roles {
+		if !role.Valid() {
+			return fieldError("roles", "invalid role %s", role)
+		}
+	}
+	if sameRoles(roles, current) {
+		return nil
+	}
+
+	principal, ok := principalFromContext(ctx)
+	if !ok || principal.Scope(PermRolesManage) != ScopeAny {
+		return forbiddenError("insufficient permissions to assign roles")
+	}
+	if !samePrivilegedRoles(roles, current) && principal.Scope(PermAdminRolesManage) != ScopeAny {
+		return forbiddenError("only superadmins can grant or revoke the admin and superadmin roles")
+	}
+	return nil
+}
+
+// samePrivilegedRoles reports whether two lists hold the same admin roles
+func samePrivilegedRoles(a, b []Role) bool {
+	var privA, privB []Role
+	for _, role := range a {
+		if privilegedRoles[role] {
+			privA = append(privA, role)
+		}
+	}
+	for _, role := range b {
+		if privilegedRoles[role] {
+			privB = append(privB, role)
+		}
+	}
+	return sameRoles(privA, privB)
+}
+
+// checkAccountChanges checks the caller may make each change to an account
+// account:update covers the names, the account number and the roles need their own permissions
+// A changed account number must have a check digit, legacy numbers can only be kept
+func checkAccountChanges(ctx context.Context, current *Account, req *UpdateAccountRequest) error {
+	if req.AccountNumber != current.AccountNumber {
+		principal, ok := principalFromContext(ctx)
+		if !ok || !principal.Can(PermAccountNumberChange, current.ID) {
+			return forbiddenError("insufficient permissions to change account_number")
+		}
+		if !ValidAccountNumber(req.AccountNumber) {
+			return fieldError("account_number", "not a valid account number")
+		}
+	}
+	return checkCanAssignRoles(ctx, req.Roles, current.Roles)
+}
+
+// sameRoles reports whether two lists hold the same roles, ignoring order and duplicates
+func sameRoles(a, b []Role) bool {
+	set := map[Role]bool{}
+	for _, role := range a {
+		set[role] = true
+	}
+	other := map[Role]bool{}
+	for _, role := range b {
+		if !set[role] {
+			return false
+		}
+		other[role] = true
+	}
+	return len(set) == len(other)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+// Each role against routes that don't change anything for a permitted caller
+// Status changes and deletes are refused for other reasons once they are allowed,
+// so a 409 there means the permission check passed
+func TestPermissionMatrix(t *testing.T) {
+	h, store, accounts := newTestServer(t)
+	customer, other := accounts[0], accounts[1]
+
+	tokens := map[Role]string{
+		RoleCustomer: login(t, h, customer),
+		RoleTeller:   login(t, h, createTestAccount(t, store, "Matrix", "Teller", 0, RoleTeller)),
+		RoleAuditor:  login(t, h, createTestAccount(t, store, "Matrix", "Auditor", 0, RoleAuditor)),
+		RoleAdmin:    loginWithMFA(t, h, createTestAccount(t, store, "Matrix", "Admin", 0, RoleAdmin)),
+	}
+
+	routes := []struct {
+		method, path string
+		body         any
+		want         map[Role]int
+	}{
+		{http.MethodGet, "/accounts", nil, map[Role]int{RoleCustomer: 403, RoleTeller: 200, RoleAuditor: 200, RoleAdmin: 200}},
+		{http.MethodGet, fmt.Sprintf("/account/%d", other.ID), nil, map[Role]int{RoleCustomer: 403, RoleTeller: 200, RoleAuditor: 200, RoleAdmin: 200}},
+		{http.MethodGet, fmt.Sprintf("/account/%d/transactions", other.ID), nil, map[Role]int{RoleCustomer: 403, RoleTeller: 200, RoleAuditor: 200, RoleAdmin: 200}},
+		{http.MethodPost, fmt.Sprintf("/account/%d/status", other.ID), AccountStatusRequest{Status: StatusActive}, map[Role]int{RoleCustomer: 403, RoleTeller: 409, RoleAuditor: 403, RoleAdmin: 409}},
+		{http.MethodDelete, fmt.Sprintf("/account/%d", other.ID), nil, map[Role]int{RoleCustomer: 403, RoleTeller: 403, RoleAuditor: 403, RoleAdmin: 409}},
+		{http.MethodGet, "/security/events", nil, map[Role]int{RoleCustomer: 403, RoleTeller: 403, RoleAuditor: 200, RoleAdmin: 200}},
+		{http.MethodGet, "/api-keys", nil, map[Role]int{RoleCustomer: 403, RoleTeller: 403, RoleAuditor: 403, RoleAdmin: 200}},
+	}
+	for _, route := range routes {
+		for role, want := range route.want {
+			rec := doJSON(t, h, route.method, route.path, tokens[role], route.body)
+			if rec.Code != want {
+				t.Errorf("%s %s as %s got status %d, want %d: %s", route.method, route.path, role, rec.Code, want, rec.Body)
+			}
+		}
+	}
+
+	// Customers reach their own account and its sub-resources, whatever the query string
+	for _, path := range []string{
+		fmt.Sprintf("/account/%d", customer.ID),
+		fmt.Sprintf("/account/%d?fields=all", customer.ID),
+		fmt.Sprintf("/account/%d/transactions?limit=1", customer.ID),
+	} {
+		if rec := doJSON(t, h, http.MethodGet, path, tokens[RoleCustomer], nil); rec.Code != http.StatusOK {
+			t.Errorf("GET %s as its owner got status %d: %s", path, rec.Code, rec.Body)
+		}
+	}
+
+	rec := doJSON(t, h, http.MethodGet, "/accounts", "", nil)
+	expectError(t, rec, http.StatusUnauthorized, CodeUnauthorized)
+}
+
+// Admins who haven't set up a second factor can't use their permissions yet
+func TestAdminWithoutMFAIsForbidden(t *testing.T) {
+	h, store, _ := newTestServer(t)
+	token := login(t, h, createTestAccount(t, store, "Half", "Admin", 0, RoleAdmin))
+
+	rec := doJSON(t, h, http.MethodGet, "/accounts", token, nil)
+	expectError(t, rec, http.StatusForbidden, CodeForbidden)
+}
+
+func TestCheckCanAssignRoles(t *testing.T) {
+	principal := func(roles ...Role) context.Context {
+		p := NewAccountPrincipal(&Account{ID: 99, Roles: roles})
+		return context.WithValue(context.Background(), principalContextKey, p)
+	}
+	customer := []Role{RoleCustomer}
+
+	tests := []struct {
+		name   string
+		ctx    context.Context
+		roles  []Role
+		code   ErrorCode
+		passes bool
+	}{
+		{"unchanged roles need no permission", principal(RoleTeller), []Role{RoleCustomer, RoleCustomer}, "", true},
+		{"tellers can't assign roles", principal(RoleTeller), []Role{RoleTeller}, CodeForbidden, false},
+		{"admins can make tellers", principal(RoleAdmin), []Role{RoleCustomer, RoleTeller}, "", true},
+		{"admins can't make admins", principal(RoleAdmin), []Role{RoleAdmin}, CodeForbidden, false},
+		{"superadmins can make admins", principal(RoleAdmin, RoleSuperAdmin), []Role{RoleAdmin}, "", true},
+		{"unknown roles are invalid", principal(RoleAdmin, RoleSuperAdmin), []Role{"janitor"}, CodeValidation, false},
+	}
+	for _, tt := range tests {
+		err := checkCanAssignRoles(tt.ctx, tt.roles, customer)
+		if tt.passes && err != nil {
+			t.Errorf("%s: got %v", tt.name, err)
+		}
+		if !tt.passes && !isErrorCode(err, tt.code) {
+			t.Errorf("%s: got %v, want code %s", tt.name, err, tt.code)
+		}
+	}
+}
+
+// Roles are stored with the account and come back when it is read
+func TestRolesAreStored(t *testing.T) {
+	store := NewMemoryStore()
+	acc := createTestAccount(t, store, "Two", "Hats", 0, RoleTeller, RoleAuditor)
+
+	got, err := store.GetAccountByID(context.Background(), acc.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameRoles(got.Roles, []Role{RoleTeller, RoleAuditor}) {
+		t.Errorf("got roles %v", got.Roles)
+	}
+	principal := NewAccountPrincipal(got)
+	if principal.Scope(PermSecurityEventsRead) != ScopeAny || principal.Scope(PermAccountsCreate) != ScopeAny {
+		t.Error("an account with two roles doesn't hold the permissions of both")
+	}
+	if principal.Scope(PermAPIKeysManage) != ScopeNone {
+		t.Error("an account holds a permission none of its roles grant")
+	}
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Config is everything the server can be configured with
+// Each setting is looked up in this order, the first place it is set wins:
+//
+//  1. the command line flag, if it has one
+//  2. the environment variable, also read from a .env file if there is one
+//  3. the config file given with --config or CONFIG_FILE, see parseConfigFile
+//  4. the default from defaultConfig
+//
+// The tags name the setting in each place. secret settings are redacted when the config is printed
+type Config struct {
+	ListenAddr      string        `file:"server.listen_addr" env:"LISTEN_ADDR" flag:"listen-addr" usage:"address to listen on"`
+	RequestTimeout  time.Duration `file:"server.request_timeout" env:"REQUEST_TIMEOUT"`
+	ShutdownTimeout time.Duration `file:"server.shutdown_timeout" env:"SHUTDOWN_TIMEOUT"`
+
+	Store       string `file:"database.store" env:"STORE" flag:"store" usage:"storage backend to use: postgres or memory"`
+	PostgresURL string `file:"database.url" env:"POSTGRES_URL" secret:"url"`
+
+	JWTSecret       string        `file:"auth.jwt_secret" env:"JWT_SECRET" secret:"true"`
+	JWTKeysDir      string        `file:"auth.jwt_keys_dir" env:"JWT_KEYS_DIR"`
+	JWTSigningKeyID string        `file:"auth.jwt_signing_key_id" env:"JWT_SIGNING_KEY_ID"`
+	AccessTokenTTL  time.Duration `file:"auth.access_token_ttl" env:"ACCESS_TOKEN_TTL"`
+	RefreshTokenTTL time.Duration `file:"auth.refresh_token_ttl" env:"REFRESH_TOKEN_TTL"`
+	BcryptCost      int           `file:"auth.bcrypt_cost" env:"BCRYPT_COST"`
+	MFAKey          string        `file:"auth.mfa_encryption_key" env:"MFA_ENCRYPTION_KEY" secret:"true"`
+
+	Notifier   string `file:"notify.notifier" env:"NOTIFIER"`
+	NotifyFile string `file:"notify.file" env:"NOTIFY_FILE"`
+}
+
+// defaultConfig is the config before anything is loaded
+func defaultConfig() *Config {
+	return &Config{
+		ListenAddr:      ":5555",
+		RequestTimeout:  15 * time.Second,
+		ShutdownTimeout: 30 * time.Second,
+		Store:           "postgres",
+		AccessTokenTTL:  15 * time.Minute,
+		RefreshTokenTTL: 30 * 24 * time.Hour,
+		BcryptCost:      bcrypt.DefaultCost,
+		Notifier:        "log",
+	}
+}
+
+// LoadConfig builds the config from the defaults, the config file, the environment and the
+// flags already parsed into fs
+// Only flags that were actually given override the other sources. The config isn't checked
+// here since the migrate command only needs the database, see Validate
+func LoadConfig(fs *flag.FlagSet, configFile string) (*Config, error) {
+	// Variables already in the environment win over the .env file
+	if err := godotenv.Load(); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("error loading .env file: %w", err)
+	}
+
+	cfg := defaultConfig()
+	if configFile == "" {
+		configFile = os.Getenv("CONFIG_FILE")
+	}
+	if configFile != "" {
+		data, err := os.ReadFile(configFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading config file: %w", err)
+		}
+		values, err := parseConfigFile(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", configFile, err)
+		}
+		if err := cfg.set("file", values); err != nil {
+			return nil, fmt.Errorf("%s: %w", configFile, err)
+		}
+	}
+
+	// Empty variables count as unset, like the blanks in .env.template
+	env := map[string]string{}
+	for _, f := range configFields() {
+		if name := f.Tag.Get("env"); name != "" {
+			if v := os.Getenv(name); v != "" {
+				env[name] = v
+			}
+		}
+	}
+	if err := cfg.set("env", env); err != nil {
+		return nil, err
+	}
+
+	// fs has other flags too, like --seed, only the ones for settings are picked out
+	settings := map[string]bool{}
+	for _, f := range configFields() {
+		settings[f.Tag.Get("flag")] = true
+	}
+	given := map[string]string{}
+	fs.Visit(func(f *flag.Flag) {
+		if settings[f.Name] {
+			given[f.Name] = f.Value.String()
+		}
+	})
+	if err := cfg.set("flag", given); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// registerConfigFlags adds a flag to fs for every setting with a flag tag
+// The flags are only read back by LoadConfig, which is how it knows which were given
+func registerConfigFlags(fs *flag.FlagSet) {
+	defaults := reflect.ValueOf(defaultConfig()).Elem()
+	for i, f := range configFields() {
+		if name := f.Tag.Get("flag"); name != "" {
+			fs.String(name, fmt.Sprint(defaults.Field(i).Interface()), f.Tag.Get("usage"))
+		}
+	}
+}
+
+// Helper for the fields of Config, in order
+func configFields() []reflect.StructField {
+	t := reflect.TypeOf(Config{})
+	fields := make([]reflect.StructField, t.NumField())
+	for i := range fields {
+		fields[i] = t.Field(i)
+	}
+	return fields
+}
+
+// set sets the fields named by values, keyed by the field's tag for the source
+// Names no field has are an error so typos in the config file don't go unnoticed
+func (c *Config) set(source string, values map[string]string) error {
+	rv := reflect.ValueOf(c).Elem()
+	known := map[string]bool{}
+	for i, f := range configFields() {
+		name := f.Tag.Get(source)
+		if name == "" {
+			continue
+		}
+		known[name] = true
+		raw, ok := values[name]
+		if !ok {
+			continue
+		}
+		if err := setConfigValue(rv.Field(i), raw); err != nil {
+			return fmt.Errorf("invalid %s %s: %w", source, name, err)
+		}
+	}
+	for name := range values {
+		if !known[name] {
+			return fmt.Errorf("unknown setting %s", name)
+		}
+	}
+	return nil
+}
+
+// Helper for parsing a setting into a field of its type
+func setConfigValue(fv reflect.Value, raw string) error {
+	raw = strings.TrimSpace(raw)
+	switch fv.Interface().(type) {
+	case string:
+		fv.SetString(raw)
+	case time.Duration:
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		fv.SetInt(int64(d))
+	case int:
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return fmt.Errorf("%q is not a whole number", raw)
+		}
+		fv.SetInt(int64(n))
+	default:
+		panic(fmt.Sprintf("config fields can't be %s", fv.Type()))
+	}
+	return nil
+}
+
+// Validate checks the config is complete and makes sense, reporting every problem at once
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	_, _, err := net.SplitHostPort(c.ListenAddr)
+	check(err == nil, "listen address %q must be host:port or :port", c.ListenAddr)
+	check(c.RequestTimeout > 0, "request timeout must be positive")
+	check(c.ShutdownTimeout > 0, "shutdown timeout must be positive")
+	// Otherwise a slow request could still be running when its idempotency key is taken over
+	check(c.RequestTimeout < idempotencyStaleAfter, "request timeout must be less than %s", idempotencyStaleAfter)
+
+	switch c.Store {
+	case "postgres":
+		check(c.PostgresURL != "", "POSTGRES_URL must be set when the store is postgres")
+	case "memory":
+	default:
+		check(false, "unknown store %q, must be postgres or memory", c.Store)
+	}
+
+	check(c.JWTSecret != "" || c.JWTKeysDir != "", "no signing key configured, set JWT_KEYS_DIR or JWT_SECRET")
+	check(c.AccessTokenTTL > 0, "access token lifetime must be positive")
+	check(c.RefreshTokenTTL >= c.AccessTokenTTL, "refresh token lifetime must be at least the access token lifetime")
+	check(c.BcryptCost >= bcrypt.MinCost && c.BcryptCost <= bcrypt.MaxCost, "bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+
+	if c.MFAKey == "" {
+		check(false, "MFA_ENCRYPTION_KEY is not set")
+	} else {
+		key, err := base64.StdEncoding.DecodeString(c.MFAKey)
+		check(err == nil && len(key) == 32, "MFA_ENCRYPTION_KEY must be 32 base64 encoded bytes")
+	}
+
+	switch c.Notifier {
+	case "log":
+	case "file":
+		check(c.NotifyFile != "", "NOTIFY_FILE must be set when NOTIFIER is file")
+	default:
+		check(false, "unknown notifier %q, must be log or file", c.Notifier)
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid config: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// Apply sets the package level settings that aren't passed around explicitly
+func (c *Config) Apply() {
+	accessTokenTTL = c.AccessTokenTTL
+	refreshTokenTTL = c.RefreshTokenTTL
+	bcryptCost = c.BcryptCost
+}
+
+// String prints the config in the config file format with secrets redacted
+// Secret URLs and key/value connection strings keep everything but the password so
+// the host and database still show
+func (c *Config) String() string {
+	var b strings.Builder
+	rv := reflect.ValueOf(c).Elem()
+	for i, f := range configFields() {
+		value := fmt.Sprint(rv.Field(i).Interface())
+		switch secret := f.Tag.Get("secret"); {
+		case value == "" || secret == "":
+		case secret == "url":
+			value = redactConnString(value)
+		default:
+			value = "[redacted]"
+		}
+		if rv.Field(i).Kind() == reflect.String || rv.Field(i).Type() == reflect.TypeOf(time.Duration(0)) {
+			value = strconv.Quote(value)
+		}
+		fmt.Fprintf(&b, "%s = %s\n", f.Tag.Get("file"), value)
+	}
+	return b.String()
+}
+
+// dsnPassword matches the password in a key/value connection string like
+// "host=db user=bank password='s3cret word' dbname=bank", quoted or not
+var dsnPassword = regexp.MustCompile(`(?i)(\bpassword\s*=\s*)('(?:[^'\\]|\\.)*'|\S*)`)
+
+// Helper for redacting the password in a connection string, either a URL or key/value pairs
+func redactConnString(value string) string {
+	if !strings.Contains(value, "://") {
+		return dsnPassword.ReplaceAllString(value, "${1}xxxxx")
+	}
+	u, err := url.Parse(value)
+	if err != nil {
+		return "[redacted]"
+	}
+	return u.Redacted()
+}
+
+// parseConfigFile reads a config file written in a small subset of TOML
+//
+//	# comments
+//	[server]
+//	listen_addr = ":5555"
+//	request_timeout = "15s"
+//
+//	[auth]
+//	bcrypt_cost = 12
+//
+// Values are double or single quoted strings, or bare numbers. Keys are returned as section.key
+func parseConfigFile(data []byte) (map[string]string, error) {
+	values := map[string]string{}
+	section := ""
+	for n, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("line %d: invalid section header", n+1)
+			}
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+
+		key, raw, ok := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("line %d: expected key = value", n+1)
+		}
+		value, err := parseConfigValue(strings.TrimSpace(raw))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n+1, err)
+		}
+		if section != "" {
+			key = section + "." + key
+		}
+		if _, dup := values[key]; dup {
+			return nil, fmt.Errorf("line %d: %s is set twice", n+1, key)
+		}
+		values[key] = value
+	}
+	return values, nil
+}
+
+// Helper for reading one value from a config file, dropping a trailing comment
+func parseConfigValue(raw string) (string, error) {
+	switch {
+	case strings.HasPrefix(raw, `"`):
+		// Find the closing quote, skipping escaped ones
+		for i := 1; i < len(raw); i++ {
+			switch raw[i] {
+			case '\\':
+				i++
+			case '"':
+				if rest := strings.TrimSpace(raw[i+1:]); rest != "" && !strings.HasPrefix(rest, "#") {
+					return "", fmt.Errorf("unexpected %s after value", rest)
+				}
+				return strconv.Unquote(raw[:i+1])
+			}
+		}
+		return "", fmt.Errorf("unterminated string")
+	case strings.HasPrefix(raw, "'"):
+		end := strings.Index(raw[1:], "'")
+		if end < 0 {
+			return "", fmt.Errorf("unterminated string")
+		}
+		if rest := strings.TrimSpace(raw[end+2:]); rest != "" && !strings.HasPrefix(rest, "#") {
+			return "", fmt.Errorf("unexpected %s after value", rest)
+		}
+		return raw[1 : end+1], nil
+	default:
+		value, _, _ := strings.Cut(raw, "#")
+		value = strings.TrimSpace(value)
+		if _, err := strconv.ParseInt(value, 10, 64); err != nil {
+			return "", fmt.Errorf("%s must be quoted", value)
+		}
+		return value, nil
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/base64"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Helper for writing a config file into a temporary directory
+func writeConfigFile(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "gobank.toml")
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// Helper for loading the config with the given command line
+func loadTestConfig(t *testing.T, configFile string, args ...string) (*Config, error) {
+	t.Helper()
+	fs := flag.NewFlagSet("gobank", flag.ContinueOnError)
+	registerConfigFlags(fs)
+	fs.Bool("seed", false, "")
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return LoadConfig(fs, configFile)
+}
+
+// Helper for clearing the environment variables for every setting, so the ones the
+// tests run with don't leak in
+func clearConfigEnv(t *testing.T) {
+	t.Helper()
+	t.Setenv("CONFIG_FILE", "")
+	for _, f := range configFields() {
+		t.Setenv(f.Tag.Get("env"), "")
+	}
+}
+
+// A flag beats the environment, which beats the config file, which beats the default
+func TestLoadConfigPrecedence(t *testing.T) {
+	clearConfigEnv(t)
+	path := writeConfigFile(t, `
+# listen_addr is also set by the environment and a flag
+[server]
+listen_addr = ":1111"
+request_timeout = "5s" # trailing comment
+
+[database]
+store = 'memory'
+
+[auth]
+bcrypt_cost = 4
+`)
+	t.Setenv("LISTEN_ADDR", ":2222")
+	t.Setenv("REQUEST_TIMEOUT", "7s")
+
+	cfg, err := loadTestConfig(t, path, "--listen-addr", ":3333", "--seed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := defaultConfig()
+	want.ListenAddr = ":3333"
+	want.RequestTimeout = 7 * time.Second
+	want.Store = "memory"
+	want.BcryptCost = 4
+	if *cfg != *want {
+		t.Errorf("got config\n%s\nwant\n%s", cfg, want)
+	}
+
+	// Flags left at their defaults don't override anything
+	cfg, err = loadTestConfig(t, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ListenAddr != ":2222" || cfg.Store != "memory" {
+		t.Errorf("without flags got listen address %q and store %q", cfg.ListenAddr, cfg.Store)
+	}
+
+	// The config file can also come from the environment
+	t.Setenv("CONFIG_FILE", path)
+	cfg, err = loadTestConfig(t, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Store != "memory" {
+		t.Errorf("config file from CONFIG_FILE wasn't read, store is %q", cfg.Store)
+	}
+}
+
+func TestLoadConfigRejectsBadSettings(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		env  map[string]string
+	}{
+		{"unknown file setting", "[server]\nlisten_adr = \":1\"", nil},
+		{"unquoted string", "[server]\nlisten_addr = :1", nil},
+		{"unterminated string", "[server]\nlisten_addr = \":1", nil},
+		{"text after value", "[server]\nlisten_addr = \":1\" x", nil},
+		{"set twice", "[server]\nlisten_addr = \":1\"\nlisten_addr = \":2\"", nil},
+		{"bad section", "[server\nlisten_addr = \":1\"", nil},
+		{"bad duration in file", "[server]\nrequest_timeout = \"soon\"", nil},
+		{"bad number in env", "", map[string]string{"BCRYPT_COST": "high"}},
+		{"bad duration in env", "", map[string]string{"SHUTDOWN_TIMEOUT": "30"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearConfigEnv(t)
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			path := ""
+			if tt.file != "" {
+				path = writeConfigFile(t, tt.file)
+			}
+			if _, err := loadTestConfig(t, path); err == nil {
+				t.Error("config loaded")
+			}
+		})
+	}
+}
+
+// Helper for a config that passes Validate
+func validTestConfig() *Config {
+	cfg := defaultConfig()
+	cfg.PostgresURL = "postgres://bank:s3cret@db:5432/bank"
+	cfg.JWTSecret = "jwt-secret"
+	cfg.MFAKey = base64.StdEncoding.EncodeToString(make([]byte, 32))
+	return cfg
+}
+
+func TestConfigValidate(t *testing.T) {
+	if err := validTestConfig().Validate(); err != nil {
+		t.Fatalf("valid config failed: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		change func(*Config)
+	}{
+		{"listen address without port", func(c *Config) { c.ListenAddr = "localhost" }},
+		{"no request timeout", func(c *Config) { c.RequestTimeout = 0 }},
+		{"request timeout past idempotency", func(c *Config) { c.RequestTimeout = idempotencyStaleAfter }},
+		{"no shutdown timeout", func(c *Config) { c.ShutdownTimeout = 0 }},
+		{"postgres without URL", func(c *Config) { c.PostgresURL = "" }},
+		{"unknown store", func(c *Config) { c.Store = "sqlite" }},
+		{"no signing key", func(c *Config) { c.JWTSecret = "" }},
+		{"refresh shorter than access", func(c *Config) { c.RefreshTokenTTL = time.Minute }},
+		{"bcrypt cost too high", func(c *Config) { c.BcryptCost = 40 }},
+		{"no MFA key", func(c *Config) { c.MFAKey = "" }},
+		{"short MFA key", func(c *Config) { c.MFAKey = base64.StdEncoding.EncodeToString(make([]byte, 16)) }},
+		{"file notifier without file", func(c *Config) { c.Notifier = "file" }},
+		{"unknown notifier", func(c *Config) { c.Notifier = "pager" }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := validTestConfig()
+			tt.change(cfg)
+			if err := cfg.Validate(); err == nil {
+				t.Error("config passed")
+			}
+		})
+	}
+
+	// Every problem is reported at once
+	cfg := validTestConfig()
+	cfg.Store = "sqlite"
+	cfg.Notifier = "pager"
+	err := cfg.Validate()
+	if err == nil || !strings.Contains(err.Error(), "sqlite") || !strings.Contains(err.Error(), "pager") {
+		t.Errorf("got %v, want both problems", err)
+	}
+}
+
+// Printing the config never shows a secret, but keeps enough of the database URL to tell
+// which database it is
+func TestConfigStringRedactsSecrets(t *testing.T) {
+	cfg := validTestConfig()
+	cfg.MFAKey = "bWZhLWtleS1tZmEta2V5LW1mYS1rZXktbWZhLWtleSE="
+	out := cfg.String()
+	for _, secret := range []string{"s3cret", "jwt-secret", cfg.MFAKey} {
+		if strings.Contains(out, secret) {
+			t.Errorf("printed config contains %q:\n%s", secret, out)
+		}
+	}
+	for _, line := range []string{
+		`database.url = "postgres://bank:xxxxx@db:5432/bank"`,
+		`auth.jwt_secret = "[redacted]"`,
+		`server.listen_addr = ":5555"`,
+		`auth.bcrypt_cost = 10`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("printed config has no line %s:\n%s", line, out)
+		}
+	}
+
+	// Unset secrets show as empty rather than redacted
+	cfg.JWTSecret = ""
+	if !strings.Contains(cfg.String(), `auth.jwt_secret = ""`) {
+		t.Error("unset secret wasn't printed as empty")
+	}
+
+	// The printed config reads back as a config file
+	values, err := parseConfigFile([]byte(cfg.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values["server.request_timeout"] != "15s" || values["auth.bcrypt_cost"] != "10" {
+		t.Errorf("printed config read back as %v", values)
+	}
+}
+
+func TestRedactConnString(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"postgres://bank:s3cret@db/bank?sslmode=disable", "postgres://bank:xxxxx@db/bank?sslmode=disable"},
+		{"postgres://db/bank", "postgres://db/bank"},
+		{"host=db user=bank password=s3cret dbname=bank", "host=db user=bank password=xxxxx dbname=bank"},
+		{"host=db password = 's3cret word' dbname=bank", "host=db password = xxxxx dbname=bank"},
+		{`host=db PASSWORD='it\'s' dbname=bank`, "host=db PASSWORD=xxxxx dbname=bank"},
+		{"postgres://bank:s3cret@db:bad/bank", "[redacted]"},
+	}
+	for _, tt := range tests {
+		if got := redactConnString(tt.in); got != tt.want {
+			t.Errorf("redactConnString(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// ErrorCode is the machine-readable code sent with every error response
+// Clients should match on the code, the message is for people and can change
+type ErrorCode string
+
+const (
+	CodeValidation        ErrorCode = "validation_failed"
+	CodeUnauthorized      ErrorCode = "unauthorized"
+	CodeForbidden         ErrorCode = "forbidden"
+	CodeNotFound          ErrorCode = "not_found"
+	CodeConflict          ErrorCode = "conflict"
+	CodeInsufficientFunds ErrorCode = "insufficient_funds"
+	CodeTooManyRequests   ErrorCode = "too_many_requests"
+	CodeIdempotencyReused ErrorCode = "idempotency_key_reused"
+	CodeRequestTooLarge   ErrorCode = "request_too_large"
+	CodeVersionMismatch   ErrorCode = "version_mismatch"
+	CodeVersionRequired   ErrorCode = "version_required"
+	CodeTimeout           ErrorCode = "timeout"
+	CodeInternal          ErrorCode = "internal_error"
+)
+
+// errorStatus is the HTTP status each error code is sent with
+var errorStatus = map[ErrorCode]int{
+	CodeValidation:        http.StatusBadRequest,
+	CodeUnauthorized:      http.StatusUnauthorized,
+	CodeForbidden:         http.StatusForbidden,
+	CodeNotFound:          http.StatusNotFound,
+	CodeConflict:          http.StatusConflict,
+	CodeInsufficientFunds: http.StatusUnprocessableEntity,
+	CodeTooManyRequests:   http.StatusTooManyRequests,
+	CodeIdempotencyReused: http.StatusUnprocessableEntity,
+	CodeRequestTooLarge:   http.StatusRequestEntityTooLarge,
+	CodeVersionMismatch:   http.StatusPreconditionFailed,
+	CodeVersionRequired:   http.StatusPreconditionRequired,
+	CodeTimeout:           http.StatusServiceUnavailable,
+	CodeInternal:          http.StatusInternalServerError,
+}
+
+// Error is an error that is safe to show to the client
+// Handlers and the functions they call return these for anything the client did wrong.
+// Any other error is treated as internal: it is logged and the client only sees internal_error,
+// so database and driver messages never end up in a response
+type Error struct {
+	Code    ErrorCode
+	Message string
+	Fields  []FieldError
+}
+
+// FieldError explains what is wrong with one field of a request body or query string
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Helper for making an Error with a formatted message
+func newError(code ErrorCode, format string, args ...any) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// The request is malformed or breaks a rule about its contents
+func validationError(format string, args ...any) error {
+	return newError(CodeValidation, format, args...)
+}
+
+// A validation error about a single field
+func fieldError(field, format string, args ...any) error {
+	msg := fmt.Sprintf(format, args...)
+	return &Error{Code: CodeValidation, Message: msg, Fields: []FieldError{{Field: field, Message: msg}}}
+}
+
+// forField attaches a validation error to the request field it is about
+// Used where the same check, like the password policy, backs fields with different names
+func forField(field string, err error) error {
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.Code != CodeValidation || len(apiErr.Fields) > 0 {
+		return err
+	}
+	return &Error{Code: CodeValidation, Message: apiErr.Message, Fields: []FieldError{{Field: field, Message: apiErr.Message}}}
+}
+
+// The caller isn't authenticated, or the credentials they gave are wrong
+func unauthorizedError(format string, args ...any) error {
+	return newError(CodeUnauthorized, format, args...)
+}
+
+// The caller is authenticated but may not do this
+func forbiddenError(format string, args ...any) error {
+	return newError(CodeForbidden, format, args...)
+}
+
+// Something the request refers to doesn't exist
+func notFoundError(format string, args ...any) error {
+	return newError(CodeNotFound, format, args...)
+}
+
+// The request clashes with the current state of something, like closing an account twice
+func conflictError(format string, args ...any) error {
+	return newError(CodeConflict, format, args...)
+}
+
+// The account doesn't have enough money for a transfer
+func insufficientFundsError(format string, args ...any) error {
+	return newError(CodeInsufficientFunds, format, args...)
+}
+
+// The caller has to wait before trying again
+func tooManyRequestsError(format string, args ...any) error {
+	return newError(CodeTooManyRequests, format, args...)
+}
+
+// Something was changed by someone else since the client read it
+func versionMismatchError(expected, current int) error {
+	return newError(CodeVersionMismatch, "account was changed since version %d, it is now at version %d", expected, current)
+}
+
+// isErrorCode reports whether err is, or wraps, an Error with the given code
+func isErrorCode(err error, code ErrorCode) bool {
+	var apiErr *Error
+	return errors.As(err, &apiErr) && apiErr.Code == code
+}
+
+// writeError sends an error response for err
+// Errors wrapping an Error keep their full message, since every layer that adds context
+// to it is our own code. Anything else is logged and replaced with a generic message
+// If the request ran out of time or the client went away, the driver's error for the
+// interrupted query is reported as a timeout instead
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	requestID := middleware.GetReqID(r.Context())
+
+	var apiErr *Error
+	if !errors.As(err, &apiErr) {
+		switch ctxErr := r.Context().Err(); {
+		case errors.Is(ctxErr, context.DeadlineExceeded):
+			log.Printf("[%s] %s %s timed out: %v", requestID, r.Method, r.URL.Path, err)
+			apiErr = &Error{Code: CodeTimeout, Message: "request timed out"}
+		case errors.Is(ctxErr, context.Canceled):
+			log.Printf("[%s] %s %s was cancelled: %v", requestID, r.Method, r.URL.Path, err)
+			apiErr = &Error{Code: CodeTimeout, Message: "request was cancelled"}
+		default:
+			log.Printf("[%s] internal error on %s %s: %v", requestID, r.Method, r.URL.Path, err)
+			apiErr = &Error{Code: CodeInternal, Message: "internal server error"}
+		}
+		err = apiErr
+	}
+
+	status, ok := errorStatus[apiErr.Code]
+	if !ok {
+		status = http.StatusInternalServerError
+	}
+	WriteJSON(w, status, ApiError{
+		Error:     err.Error(),
+		Code:      apiErr.Code,
+		Fields:    apiErr.Fields,
+		RequestID: requestID,
+	})
+}
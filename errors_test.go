@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+func TestErrorCodesHaveStatuses(t *testing.T) {
+	codes := []ErrorCode{
+		CodeValidation, CodeUnauthorized, CodeForbidden, CodeNotFound, CodeConflict,
+		CodeInsufficientFunds, CodeTooManyRequests, CodeIdempotencyReused, CodeRequestTooLarge,
+		CodeVersionMismatch, CodeVersionRequired, CodeTimeout, CodeInternal,
+	}
+	for _, code := range codes {
+		if _, ok := errorStatus[code]; !ok {
+			t.Errorf("code %s has no status", code)
+		}
+	}
+}
+
+func TestForField(t *testing.T) {
+	err := forField("new_password", validationError("password is too short"))
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || len(apiErr.Fields) != 1 || apiErr.Fields[0].Field != "new_password" {
+		t.Errorf("got %#v, want a validation error on new_password", err)
+	}
+
+	// Errors that already name a field, or aren't validation errors, are left alone
+	named := fieldError("password", "password is too short")
+	if got := forField("new_password", named); got != named {
+		t.Errorf("got %v, want the error unchanged", got)
+	}
+	conflict := conflictError("taken")
+	if got := forField("new_password", conflict); got != conflict {
+		t.Errorf("got %v, want the error unchanged", got)
+	}
+}
+
+// Helper for sending a raw request body, for bodies that aren't valid JSON
+func doRaw(t *testing.T, h http.Handler, method, path, token, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+// Helper for decoding an error response
+func decodeAPIError(t *testing.T, rec *httptest.ResponseRecorder) ApiError {
+	t.Helper()
+	var apiErr ApiError
+	if err := json.Unmarshal(rec.Body.Bytes(), &apiErr); err != nil {
+		t.Fatal(err)
+	}
+	return apiErr
+}
+
+// Each kind of mistake gets its own status and code, with the fields at fault named
+func TestErrorResponses(t *testing.T) {
+	h, store, _ := newTestServer(t)
+	token := login(t, h, createTestAccount(t, store, "Error", "Teller", 0, RoleTeller))
+
+	rec := doJSON(t, h, http.MethodGet, "/accounts", "not-a-jwt", nil)
+	expectError(t, rec, http.StatusUnauthorized, CodeUnauthorized)
+
+	rec = doJSON(t, h, http.MethodGet, "/account/999", token, nil)
+	expectError(t, rec, http.StatusNotFound, CodeNotFound)
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		code   ErrorCode
+		fields []string
+	}{
+		{"malformed", `{"first_name":`, http.StatusBadRequest, CodeValidation, nil},
+		{"empty", ``, http.StatusBadRequest, CodeValidation, nil},
+		{"two objects", `{} {}`, http.StatusBadRequest, CodeValidation, nil},
+		{"unknown field", `{"first_name": "A", "last_name": "B", "password": "p", "is_admin": true}`, http.StatusBadRequest, CodeValidation, []string{"is_admin"}},
+		{"wrong type", `{"first_name": "A", "last_name": "B", "password": "p", "balance": "lots"}`, http.StatusBadRequest, CodeValidation, []string{"balance"}},
+		{"missing fields", `{"password": "p"}`, http.StatusBadRequest, CodeValidation, []string{"first_name", "last_name"}},
+		{"too large", `{"first_name": "` + strings.Repeat("a", maxRequestBodyBytes) + `"}`, http.StatusRequestEntityTooLarge, CodeRequestTooLarge, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := doRaw(t, h, http.MethodPost, "/accounts", token, tt.body)
+			expectError(t, rec, tt.status, tt.code)
+			apiErr := decodeAPIError(t, rec)
+			if len(apiErr.Fields) != len(tt.fields) {
+				t.Fatalf("got field errors %v, want ones on %v", apiErr.Fields, tt.fields)
+			}
+			for i, field := range tt.fields {
+				if apiErr.Fields[i].Field != field {
+					t.Errorf("field error %d is on %s, want %s", i, apiErr.Fields[i].Field, field)
+				}
+			}
+		})
+	}
+}
+
+// The request ID in an error response is the one from the X-Request-Id header, or a new one
+func TestErrorResponsesHaveRequestIDs(t *testing.T) {
+	h, _, _ := newTestServer(t)
+
+	req := httptest.NewRequest(http.MethodGet, "/accounts", nil)
+	req.Header.Set(middleware.RequestIDHeader, "trace-123")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if apiErr := decodeAPIError(t, rec); apiErr.RequestID != "trace-123" {
+		t.Errorf("got request ID %q, want trace-123", apiErr.RequestID)
+	}
+
+	rec = doJSON(t, h, http.MethodGet, "/accounts", "", nil)
+	if apiErr := decodeAPIError(t, rec); apiErr.RequestID == "" {
+		t.Error("error response has no request ID")
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	// Header clients send to make a POST safe to retry
+	idempotencyHeader = "Idempotency-Key"
+	// Header set on responses that were replayed from a stored result
+	idempotencyReplayedHeader = "Idempotent-Replayed"
+	maxIdempotencyKeyLength   = 255
+	// A key still marked in flight after this long is assumed to be from a crashed request
+	idempotencyStaleAfter = time.Minute
+	// How long storing or releasing a key may take once the handler is done
+	idempotencyFinishTimeout = 5 * time.Second
+)
+
+// Middleware for Idempotency-Key support on POST endpoints
+// Must run inside withJWTAuth because keys are scoped to the caller
+// 1. The first request with a key reserves it, runs the handler and stores the response
+// 2. A retry with the same key and payload gets the stored response replayed
+// 3. A retry with the same key and a different payload is rejected
+// Server errors, 401s and 429s are not stored so the client can retry them, e.g. with a two-factor code or after waiting
+func withIdempotency(s Storage) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			serveIdempotent(w, r, next, s)
+		})
+	}
+}
+
+// serveIdempotent does the work of withIdempotency for one request
+func serveIdempotent(w http.ResponseWriter, r *http.Request, next http.Handler, s Storage) {
+	key := r.Header.Get(idempotencyHeader)
+	if r.Method != "POST" || key == "" {
+		next.ServeHTTP(w, r)
+		return
+	}
+	if len(key) > maxIdempotencyKeyLength {
+		writeError(w, r, validationError("idempotency key is too long"))
+		return
+	}
+
+	principal, ok := principalFromContext(r.Context())
+	if !ok {
+		writeError(w, r, unauthorizedError("unauthorized"))
+		return
+	}
+	caller := principal.CallerID()
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, r, decodeError(err))
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	rec := &IdempotencyRecord{
+		Caller:      caller,
+		Key:         key,
+		RequestHash: hashRequest(r, body),
+		CreatedAt:   time.Now().UTC(),
+	}
+
+	reserved, err := reserveIdempotencyKey(r.Context(), s, rec)
+	if err != nil {
+		writeError(w, r, fmt.Errorf("error checking idempotency key: %v", err))
+		return
+	}
+
+	if !reserved {
+		existing, err := s.GetIdempotencyRecord(r.Context(), caller, key)
+		// Released by the request holding it since the reservation failed, the client can retry
+		if isErrorCode(err, CodeNotFound) {
+			writeError(w, r, conflictError("a request with this idempotency key is still in progress"))
+			return
+		}
+		if err != nil {
+			writeError(w, r, fmt.Errorf("error checking idempotency key: %v", err))
+			return
+		}
+		if existing.RequestHash != rec.RequestHash {
+			writeError(w, r, newError(CodeIdempotencyReused, "idempotency key was already used with a different request"))
+			return
+		}
+		if existing.StatusCode == 0 {
+			writeError(w, r, conflictError("a request with this idempotency key is still in progress"))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set(idempotencyReplayedHeader, "true")
+		w.WriteHeader(existing.StatusCode)
+		w.Write(existing.Body)
+		return
+	}
+
+	recorder := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+	next.ServeHTTP(recorder, r)
+
+	// The request's context may have run out or been cancelled by now, and the key
+	// still has to be stored or released so retries don't wait for it to go stale
+	ctx, cancel := context.WithTimeout(context.Background(), idempotencyFinishTimeout)
+	defer cancel()
+
+	if recorder.status >= 500 || recorder.status == http.StatusUnauthorized || recorder.status == http.StatusTooManyRequests {
+		if err := s.DeleteIdempotencyRecord(ctx, caller, key); err != nil {
+			log.Println("error releasing idempotency key:", err)
+		}
+		return
+	}
+
+	rec.StatusCode = recorder.status
+	rec.Body = recorder.body.Bytes()
+	if err := s.CompleteIdempotencyRecord(ctx, rec); err != nil {
+		log.Println("error storing idempotent response:", err)
+	}
+}
+
+// reserveIdempotencyKey claims a key for the caller
+// A reservation left behind by a request that never completed is taken over, but only if it
+// is still the one that was read, so two retries can't both take it over and both run
+func reserveIdempotencyKey(ctx context.Context, s Storage, rec *IdempotencyRecord) (bool, error) {
+	reserved, err := s.CreateIdempotencyRecord(ctx, rec)
+	if err != nil || reserved {
+		return reserved, err
+	}
+
+	existing, err := s.GetIdempotencyRecord(ctx, rec.Caller, rec.Key)
+	if err != nil {
+		return false, err
+	}
+	if existing.StatusCode != 0 || time.Since(existing.CreatedAt) < idempotencyStaleAfter {
+		return false, nil
+	}
+
+	return s.ReclaimIdempotencyRecord(ctx, existing, rec)
+}
+
+// hashRequest fingerprints a request so a reused key with a different payload can be detected
+func hashRequest(r *http.Request, body []byte) string {
+	h := sha256.New()
+	io.WriteString(h, r.Method+" "+r.URL.Path+"\n")
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// responseRecorder passes a response through while keeping a copy of the status and body
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rr *responseRecorder) WriteHeader(status int) {
+	rr.status = status
+	rr.ResponseWriter.WriteHeader(status)
+}
+
+func (rr *responseRecorder) Write(b []byte) (int, error) {
+	rr.body.Write(b)
+	return rr.ResponseWriter.Write(b)
+}
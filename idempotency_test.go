@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Helper for posting a transfer with an Idempotency-Key header
+func postIdempotentTransfer(t *testing.T, h http.Handler, token, key string, req TransferRequest) *httptest.ResponseRecorder {
+	t.Helper()
+	b, _ := json.Marshal(req)
+	r := httptest.NewRequest(http.MethodPost, "/transfer", bytes.NewReader(b))
+	r.Header.Set("Authorization", "Bearer "+token)
+	r.Header.Set(idempotencyHeader, key)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	return rec
+}
+
+func TestIdempotentTransferReplays(t *testing.T) {
+	h, store, accounts := newTestServer(t)
+	from, to := accounts[0], accounts[1]
+	token := login(t, h, from)
+	req := TransferRequest{ToAccountNumber: to.AccountNumber, Amount: 100}
+
+	first := postIdempotentTransfer(t, h, token, "key-1", req)
+	if first.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", first.Code, first.Body)
+	}
+	retry := postIdempotentTransfer(t, h, token, "key-1", req)
+	if retry.Code != http.StatusOK || retry.Header().Get(idempotencyReplayedHeader) != "true" {
+		t.Errorf("retry got status %d and replayed header %q, want a replay", retry.Code, retry.Header().Get(idempotencyReplayedHeader))
+	}
+	if retry.Body.String() != first.Body.String() {
+		t.Errorf("retry got %s, want the first response %s", retry.Body, first.Body)
+	}
+
+	got, err := store.GetAccountByID(context.Background(), from.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Balance != 900 {
+		t.Errorf("from account has %d, want 900 after one transfer", got.Balance)
+	}
+
+	reused := postIdempotentTransfer(t, h, token, "key-1", TransferRequest{ToAccountNumber: to.AccountNumber, Amount: 200})
+	expectError(t, reused, http.StatusUnprocessableEntity, CodeIdempotencyReused)
+
+	// A 401 asking for a two-factor code isn't stored, so the retry with the code can go through
+	needsCode := TransferRequest{ToAccountNumber: to.AccountNumber, Amount: stepUpTransferAmount}
+	postIdempotentTransfer(t, h, token, "key-2", needsCode)
+	rec := postIdempotentTransfer(t, h, token, "key-2", needsCode)
+	expectError(t, rec, http.StatusUnauthorized, CodeUnauthorized)
+	if rec.Header().Get(idempotencyReplayedHeader) == "true" {
+		t.Error("a 401 was replayed, want it to be tried again")
+	}
+}
+
+// Two retries finding the same stale reservation must not both take it over
+func TestReserveIdempotencyKeyReclaimsStaleOnce(t *testing.T) {
+	ctx := context.Background()
+	for i := 0; i < 50; i++ {
+		store := NewMemoryStore()
+		stale := &IdempotencyRecord{Caller: "account:1", Key: "k", RequestHash: "h", CreatedAt: time.Now().UTC().Add(-2 * idempotencyStaleAfter)}
+		if _, err := store.CreateIdempotencyRecord(ctx, stale); err != nil {
+			t.Fatal(err)
+		}
+
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		reserved := 0
+		for j := 0; j < 5; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				ok, err := reserveIdempotencyKey(ctx, store, &IdempotencyRecord{Caller: "account:1", Key: "k", RequestHash: "h", CreatedAt: time.Now().UTC()})
+				if err != nil {
+					t.Error(err)
+				}
+				if ok {
+					mu.Lock()
+					reserved++
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		if reserved != 1 {
+			t.Fatalf("%d requests took over the stale key, want 1", reserved)
+		}
+	}
+}
+
+func TestReserveIdempotencyKeyLeavesFreshAndCompletedKeys(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	old := time.Now().UTC().Add(-2 * idempotencyStaleAfter)
+	store.CreateIdempotencyRecord(ctx, &IdempotencyRecord{Caller: "c", Key: "fresh", RequestHash: "h", CreatedAt: time.Now().UTC()})
+	store.CreateIdempotencyRecord(ctx, &IdempotencyRecord{Caller: "c", Key: "done", RequestHash: "h", StatusCode: 200, CreatedAt: old})
+
+	for _, key := range []string{"fresh", "done"} {
+		ok, err := reserveIdempotencyKey(ctx, store, &IdempotencyRecord{Caller: "c", Key: key, RequestHash: "h", CreatedAt: time.Now().UTC()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok {
+			t.Errorf("key %s was taken over, want it left alone", key)
+		}
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+// Tokens are signed with one active key and verified with any key in the keyring
+// Asymmetric keys are loaded from JWT_KEYS_DIR, one PEM file per key named <kid>.pem
+//   - PRIVATE KEY / RSA PRIVATE KEY files can sign and verify (RS256 or EdDSA)
+//   - PUBLIC KEY files can only verify, for retired keys whose tokens haven't expired yet
+//
+// JWT_SIGNING_KEY_ID picks the active key, otherwise the private key with the last kid is used.
+// To rotate, add a new key file, point JWT_SIGNING_KEY_ID at it (or name it so it sorts last)
+// and reload. Tokens signed with the old key keep working for as long as its file stays.
+//
+// Without JWT_KEYS_DIR tokens are signed with HS256 and JWT_SECRET. When both are set JWT_SECRET
+// is only used to verify, so tokens issued before moving to asymmetric keys stay valid.
+const (
+	hmacKeyID     = "hs256"
+	minRSAKeyBits = 2048
+)
+
+// signingKey is one key in the keyring
+type signingKey struct {
+	kid    string
+	method jwt.SigningMethod
+	// private is nil for keys that can only verify
+	private crypto.PrivateKey
+	// public is what tokens are verified with, the secret itself for HS256
+	public interface{}
+}
+
+// Keyring holds the keys tokens are signed and verified with
+type Keyring struct {
+	mu     sync.RWMutex
+	dir    string
+	secret string
+	// kid of the key to sign with, otherwise the last private key in dir
+	signingKeyID string
+	active       *signingKey
+	keys         map[string]*signingKey
+}
+
+// LoadKeyring builds the keyring from the JWT_KEYS_DIR, JWT_SIGNING_KEY_ID and JWT_SECRET settings
+// It refuses to start with no usable key rather than sign tokens with an empty secret
+func LoadKeyring(dir, secret, signingKeyID string) (*Keyring, error) {
+	k := &Keyring{
+		dir:          dir,
+		secret:       secret,
+		signingKeyID: signingKeyID,
+	}
+	if err := k.Reload(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Reload re-reads the key directory, this is how keys are rotated without a restart
+// The current keys are kept if the directory can't be loaded
+func (k *Keyring) Reload() error {
+	keys := make(map[string]*signingKey)
+	var active *signingKey
+
+	if k.secret != "" {
+		hmacKey := &signingKey{
+			kid:     hmacKeyID,
+			method:  jwt.SigningMethodHS256,
+			private: []byte(k.secret),
+			public:  []byte(k.secret),
+		}
+		keys[hmacKey.kid] = hmacKey
+		active = hmacKey
+	}
+
+	if k.dir != "" {
+		loaded, err := loadKeyDir(k.dir)
+		if err != nil {
+			return err
+		}
+		for kid, key := range loaded {
+			if kid == hmacKeyID {
+				return fmt.Errorf("key ID %q is reserved", hmacKeyID)
+			}
+			keys[kid] = key
+		}
+
+		active, err = pickActiveKey(loaded, k.signingKeyID)
+		if err != nil {
+			return err
+		}
+	}
+
+	if active == nil {
+		return fmt.Errorf("no signing key configured, set JWT_KEYS_DIR or JWT_SECRET")
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys = keys
+	k.active = active
+	return nil
+}
+
+// Sign signs the claims with the active key, with the kid in the header
+func (k *Keyring) Sign(claims jwt.Claims) (string, error) {
+	k.mu.RLock()
+	key := k.active
+	k.mu.RUnlock()
+
+	token := jwt.NewWithClaims(key.method, claims)
+	token.Header["kid"] = key.kid
+	return token.SignedString(key.private)
+}
+
+// Parse verifies a token against the key named by its kid
+// The algorithm has to match the key, so a public key can never be used as an HMAC secret
+func (k *Keyring) Parse(tokenStr string) (*jwt.Token, error) {
+	return jwt.Parse(tokenStr, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		// Tokens from before key IDs were added are HS256 tokens
+		if kid == "" {
+			kid = hmacKeyID
+		}
+
+		k.mu.RLock()
+		key, ok := k.keys[kid]
+		k.mu.RUnlock()
+		if !ok {
+			return nil, fmt.Errorf("unknown signing key %q", kid)
+		}
+		if token.Method.Alg() != key.method.Alg() {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+
+		return key.public, nil
+	})
+}
+
+// JWK is a public key in JSON Web Key format
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	// RSA keys
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// Ed25519 keys
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+}
+
+// JWKS is the document served at /.well-known/jwks.json
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public keys other services can verify tokens with
+// The HS256 secret is never published
+func (k *Keyring) JWKS() JWKS {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	set := JWKS{Keys: []JWK{}}
+	for _, key := range k.keys {
+		switch pub := key.public.(type) {
+		case *rsa.PublicKey:
+			set.Keys = append(set.Keys, JWK{
+				KeyType:   "RSA",
+				KeyID:     key.kid,
+				Use:       "sig",
+				Algorithm: key.method.Alg(),
+				N:         base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+				E:         base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+			})
+		case ed25519.PublicKey:
+			set.Keys = append(set.Keys, JWK{
+				KeyType:   "OKP",
+				KeyID:     key.kid,
+				Use:       "sig",
+				Algorithm: key.method.Alg(),
+				Curve:     "Ed25519",
+				X:         base64.RawURLEncoding.EncodeToString(pub),
+			})
+		}
+	}
+
+	sort.Slice(set.Keys, func(i, j int) bool { return set.Keys[i].KeyID < set.Keys[j].KeyID })
+	return set
+}
+
+// loadKeyDir reads every <kid>.pem file in the directory
+func loadKeyDir(dir string) (map[string]*signingKey, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]*signingKey)
+	for _, path := range paths {
+		kid := strings.TrimSuffix(filepath.Base(path), ".pem")
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		key, err := parseKey(kid, data)
+		if err != nil {
+			return nil, fmt.Errorf("loading key %s: %v", path, err)
+		}
+		keys[kid] = key
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no keys found in %s", dir)
+	}
+	return keys, nil
+}
+
+// pickActiveKey returns the key named by kid, or the private key with the last kid
+func pickActiveKey(keys map[string]*signingKey, kid string) (*signingKey, error) {
+	if kid != "" {
+		key, ok := keys[kid]
+		if !ok {
+			return nil, fmt.Errorf("signing key %q not found", kid)
+		}
+		if key.private == nil {
+			return nil, fmt.Errorf("signing key %q is a public key", kid)
+		}
+		return key, nil
+	}
+
+	var active *signingKey
+	for _, key := range keys {
+		if key.private != nil && (active == nil || key.kid > active.kid) {
+			active = key
+		}
+	}
+	if active == nil {
+		return nil, fmt.Errorf("no private key to sign with")
+	}
+	return active, nil
+}
+
+// parseKey parses a PEM encoded RSA or Ed25519 key
+func parseKey(kid string, data []byte) (*signingKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found")
+	}
+
+	var parsed interface{}
+	var err error
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key := &signingKey{kid: kid}
+	switch p := parsed.(type) {
+	case *rsa.PrivateKey:
+		key.method, key.private, key.public = jwt.SigningMethodRS256, p, &p.PublicKey
+	case *rsa.PublicKey:
+		key.method, key.public = jwt.SigningMethodRS256, p
+	case ed25519.PrivateKey:
+		key.method, key.private, key.public = jwt.SigningMethodEdDSA, p, p.Public()
+	case ed25519.PublicKey:
+		key.method, key.public = jwt.SigningMethodEdDSA, p
+	default:
+		return nil, fmt.Errorf("unsupported key type %T, must be RSA or Ed25519", parsed)
+	}
+
+	if pub, ok := key.public.(*rsa.PublicKey); ok && pub.N.BitLen() < minRSAKeyBits {
+		return nil, fmt.Errorf("RSA keys must be at least %d bits", minRSAKeyBits)
+	}
+	return key, nil
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+// Helper for writing a PEM key file named <kid>.pem into a key directory
+func writeKeyFile(t *testing.T, dir, kid, blockType string, der []byte) {
+	t.Helper()
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := os.WriteFile(filepath.Join(dir, kid+".pem"), data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Helper for writing a new Ed25519 private key into a key directory
+func writeEd25519Key(t *testing.T, dir, kid string) ed25519.PublicKey {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeKeyFile(t, dir, kid, "PRIVATE KEY", der)
+	return pub
+}
+
+// Helper for signing a short test token with the keyring
+func signTestToken(t *testing.T, keys *Keyring) string {
+	t.Helper()
+	token, err := keys.Sign(jwt.MapClaims{"jti": "test", "exp": time.Now().Add(time.Minute).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// Helper for the kid a token was signed with
+func tokenKeyID(t *testing.T, keys *Keyring, token string) string {
+	t.Helper()
+	parsed, err := keys.Parse(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kid, _ := parsed.Header["kid"].(string)
+	return kid
+}
+
+func TestLoadKeyringNeedsAKey(t *testing.T) {
+	if _, err := LoadKeyring("", "", ""); err == nil {
+		t.Error("keyring with no secret and no key directory loaded")
+	}
+	if _, err := LoadKeyring(t.TempDir(), "secret", ""); err == nil {
+		t.Error("keyring with an empty key directory loaded")
+	}
+
+	dir := t.TempDir()
+	writeEd25519Key(t, dir, "a")
+	if _, err := LoadKeyring(dir, "", "missing"); err == nil {
+		t.Error("keyring with an unknown signing key ID loaded")
+	}
+
+	small, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeKeyFile(t, dir, "small", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(small))
+	if _, err := LoadKeyring(dir, "", ""); err == nil {
+		t.Error("keyring with a 1024 bit RSA key loaded")
+	}
+}
+
+// A new key takes over signing on reload, and tokens signed with the old one keep working
+// for as long as its file, even just the public half, stays in the directory
+func TestKeyringRotation(t *testing.T) {
+	dir := t.TempDir()
+	oldPub := writeEd25519Key(t, dir, "2024-01")
+	keys, err := LoadKeyring(dir, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldToken := signTestToken(t, keys)
+	if kid := tokenKeyID(t, keys, oldToken); kid != "2024-01" {
+		t.Fatalf("token signed with %q, want 2024-01", kid)
+	}
+
+	writeEd25519Key(t, dir, "2024-02")
+	der, err := x509.MarshalPKIXPublicKey(oldPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeKeyFile(t, dir, "2024-01", "PUBLIC KEY", der)
+	if err := keys.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if kid := tokenKeyID(t, keys, signTestToken(t, keys)); kid != "2024-02" {
+		t.Errorf("after rotating, token signed with %q, want 2024-02", kid)
+	}
+	if _, err := keys.Parse(oldToken); err != nil {
+		t.Errorf("token signed with the retired key stopped working: %v", err)
+	}
+
+	if err := os.Remove(filepath.Join(dir, "2024-01.pem")); err != nil {
+		t.Fatal(err)
+	}
+	if err := keys.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keys.Parse(oldToken); err == nil {
+		t.Error("token signed with a removed key still works")
+	}
+
+	// A directory that fails to load leaves the keys as they were
+	writeKeyFile(t, dir, "broken", "PRIVATE KEY", []byte("not a key"))
+	if err := keys.Reload(); err == nil {
+		t.Error("reloading a broken key file didn't fail")
+	}
+	if kid := tokenKeyID(t, keys, signTestToken(t, keys)); kid != "2024-02" {
+		t.Errorf("after a failed reload, token signed with %q, want 2024-02", kid)
+	}
+}
+
+// Other services verify tokens with the published keys alone
+func TestKeyringJWKS(t *testing.T) {
+	dir := t.TempDir()
+	edPub := writeEd25519Key(t, dir, "ed")
+	rsaKey, err := rsa.GenerateKey(rand.Reader, minRSAKeyBits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeKeyFile(t, dir, "rsa", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey))
+
+	keys, err := LoadKeyring(dir, "legacy-secret", "ed")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	set := keys.JWKS()
+	if len(set.Keys) != 2 {
+		t.Fatalf("got %d keys, want the two asymmetric ones without the HS256 secret: %+v", len(set.Keys), set.Keys)
+	}
+	ed, rs := set.Keys[0], set.Keys[1]
+	if ed.KeyID != "ed" || ed.KeyType != "OKP" || ed.Algorithm != "EdDSA" || ed.Curve != "Ed25519" {
+		t.Errorf("got Ed25519 key %+v", ed)
+	}
+	if rs.KeyID != "rsa" || rs.KeyType != "RSA" || rs.Algorithm != "RS256" {
+		t.Errorf("got RSA key %+v", rs)
+	}
+	n, err := base64.RawURLEncoding.DecodeString(rs.N)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if new(big.Int).SetBytes(n).Cmp(rsaKey.N) != 0 {
+		t.Error("JWKS has the wrong RSA modulus")
+	}
+
+	x, err := base64.RawURLEncoding.DecodeString(ed.X)
+	if err != nil {
+		t.Fatal(err)
+	}
+	published := ed25519.PublicKey(x)
+	if !published.Equal(edPub) {
+		t.Fatal("JWKS has the wrong Ed25519 key")
+	}
+	_, err = jwt.Parse(signTestToken(t, keys), func(*jwt.Token) (interface{}, error) { return published, nil })
+	if err != nil {
+		t.Errorf("token didn't verify with the published key: %v", err)
+	}
+}
+
+// A token can't pick a different algorithm than its key's, so a public key can't be
+// used as an HMAC secret
+func TestKeyringRejectsAlgorithmSwitch(t *testing.T) {
+	dir := t.TempDir()
+	pub := writeEd25519Key(t, dir, "ed")
+	keys, err := LoadKeyring(dir, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"jti": "forged"})
+	forged.Header["kid"] = "ed"
+	tokenStr, err := forged.SignedString([]byte(pub))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keys.Parse(tokenStr); err == nil {
+		t.Error("HS256 token signed with an Ed25519 public key was accepted")
+	}
+
+	unknown := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"jti": "unknown"})
+	unknown.Header["kid"] = "nope"
+	tokenStr, err = unknown.SignedString([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keys.Parse(tokenStr); err == nil {
+		t.Error("token with an unknown kid was accepted")
+	}
+}
+
+func TestHandleJWKS(t *testing.T) {
+	h, _, _ := newTestServer(t)
+	rec := doJSON(t, h, http.MethodGet, "/.well-known/jwks.json", "", nil)
+	var set JWKS
+	decodeResponse(t, rec, &set)
+	if set.Keys == nil || len(set.Keys) != 0 {
+		t.Errorf("server signing with HS256 published %+v, want an empty key list", set.Keys)
+	}
+}
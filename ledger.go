@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+)
+
+// MakeTransfer makes a transfer from one account to another
+// Accounts are addressed by their account numbers, which are resolved inside the transfer
+// checks the balance of the from account and subtracts the amount from their balance
+// then adds the amount to the to account
+// Everything runs in one unit of work, so the balances and the journal entry are
+// committed together or not at all
+// Both accounts are locked before the balance is read so concurrent transfers from
+// the same account can't both pass the insufficient funds check
+// This is used in the handleTransfer function in api.go
+func MakeTransfer(ctx context.Context, s Storage, toNumber, fromNumber int64, amount int) (*TransferReceipt, error) {
+	for _, number := range []int64{fromNumber, toNumber} {
+		if !AcceptedAccountNumber(number) {
+			return nil, validationError("invalid account number %d", number)
+		}
+	}
+	// Checked here too since the from account can be filled in after the request was validated
+	if fromNumber == toNumber {
+		return nil, fieldError("to_account_number", "can't transfer to the same account")
+	}
+	if amount <= 0 {
+		return nil, fieldError("amount", "amount must be at least 1")
+	}
+
+	var receipt *TransferReceipt
+	err := s.WithTx(ctx, func(tx TxStore) error {
+		// Resolve the account numbers to accounts
+		from, err := tx.GetAccountByNumber(fromNumber)
+		if err != nil {
+			return err
+		}
+		to, err := tx.GetAccountByNumber(toNumber)
+		if err != nil {
+			return err
+		}
+
+		// Lock both accounts until the transfer commits
+		if err := tx.LockAccounts(from.ID, to.ID); err != nil {
+			return err
+		}
+
+		// Frozen, closed and pending accounts can't send or receive money
+		// The accounts are read again now that they are locked
+		for _, id := range []int{from.ID, to.ID} {
+			acc, err := tx.GetAccountByID(id)
+			if err != nil {
+				return err
+			}
+			if err := checkCanTransfer(acc); err != nil {
+				return err
+			}
+		}
+
+		// Get the balance of the from account
+		fromBalance, err := tx.GetBalance(from.ID)
+		if err != nil {
+			return err
+		}
+
+		// Check if the from account has enough money
+		if fromBalance < int64(amount) {
+			return insufficientFundsError("insufficient funds")
+		}
+
+		// Subtract the amount from the from account
+		if err := tx.SubtractBalance(from.ID, int64(amount)); err != nil {
+			return err
+		}
+
+		// Add the amount to the to account
+		if err := tx.AddBalance(to.ID, int64(amount)); err != nil {
+			return err
+		}
+
+		// Record the transfer in the journal
+		transfer, err := tx.RecordTransfer(TransferKindTransfer, &from.ID, to.ID, int64(amount))
+		if err != nil {
+			return err
+		}
+
+		// Get the new balance of the from account for the receipt
+		balance, err := tx.GetBalance(from.ID)
+		if err != nil {
+			return err
+		}
+
+		receipt = &TransferReceipt{
+			TransferID:        transfer.ID,
+			FromAccountNumber: fromNumber,
+			ToAccountNumber:   toNumber,
+			Amount:            transfer.Amount,
+			Balance:           balance,
+			CreatedAt:         transfer.CreatedAt,
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return receipt, nil
+}
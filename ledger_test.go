@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math/rand"
+	"net/http"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Helper for creating customer accounts with an opening balance in a store
+func createTestAccounts(t *testing.T, s Storage, n int, balance int64) []*Account {
+	t.Helper()
+	accounts := make([]*Account, 0, n)
+	for i := 0; i < n; i++ {
+		accounts = append(accounts, createTestAccount(t, s, "Test", "Customer", balance, RoleCustomer))
+	}
+	return accounts
+}
+
+// Helper for creating one account with the password "password"
+// bcrypt is turned down to its minimum cost so the tests don't spend their time hashing
+func createTestAccount(t *testing.T, s Storage, firstName, lastName string, balance int64, roles ...Role) *Account {
+	t.Helper()
+	bcryptCost = bcrypt.MinCost
+
+	account, err := NewAccount(firstName, lastName, "password", roles, balance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	created, err := s.CreateAccount(context.Background(), account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return created
+}
+
+// Many requests moving money around between the same few accounts must never create or
+// destroy money or overdraw an account, and every balance must match its postings
+func TestHandleTransferConcurrentTransfersConserveMoney(t *testing.T) {
+	store := NewMemoryStore()
+	stressTransfers(t, store, createTestAccounts(t, store, 5, 1000))
+}
+
+// The same against Postgres, where it goes through the row locks and the retries on
+// serialization failures and deadlocks
+func TestPostgresHandleTransferConcurrentTransfersConserveMoney(t *testing.T) {
+	store := newPostgresTestStore(t)
+	stressTransfers(t, store, createTestAccounts(t, store, 5, 1000))
+}
+
+// Helper for hammering POST /transfer from many goroutines at once as a teller, who can
+// move money between any two accounts, then checking the accounts add up
+func stressTransfers(t *testing.T, store Storage, accounts []*Account) {
+	t.Helper()
+	const (
+		workers   = 20
+		perWorker = 50
+	)
+	ctx := context.Background()
+	h := newTestHandler(t, store)
+	teller := createTestAccount(t, store, "Stress", "Teller", 0, RoleTeller)
+	token := login(t, h, teller)
+
+	var start int64
+	for _, acc := range accounts {
+		start += acc.Balance
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	statuses := map[int]int{}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(seed))
+			for i := 0; i < perWorker; i++ {
+				from := accounts[rng.Intn(len(accounts))]
+				to := accounts[rng.Intn(len(accounts))]
+				if from.ID == to.ID {
+					continue
+				}
+				// Amounts are big enough that some transfers run out of funds
+				rec := doJSON(t, h, http.MethodPost, "/transfer", token, TransferRequest{
+					FromAccountNumber: from.AccountNumber,
+					ToAccountNumber:   to.AccountNumber,
+					Amount:            rng.Intn(400) + 1,
+				})
+				mu.Lock()
+				statuses[rec.Code]++
+				mu.Unlock()
+				if rec.Code != http.StatusOK && rec.Code != http.StatusUnprocessableEntity {
+					t.Errorf("transfer got status %d: %s", rec.Code, rec.Body)
+				}
+			}
+		}(int64(w))
+	}
+	wg.Wait()
+	if statuses[http.StatusOK] == 0 {
+		t.Errorf("no transfer went through, got statuses %v", statuses)
+	}
+
+	var total int64
+	for _, acc := range accounts {
+		got, err := store.GetAccountByID(ctx, acc.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Balance < 0 {
+			t.Errorf("account %d has a negative balance of %d", got.ID, got.Balance)
+		}
+		ledger, err := store.GetLedgerBalance(ctx, got.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ledger != got.Balance {
+			t.Errorf("account %d has a balance of %d but its postings sum to %d", got.ID, got.Balance, ledger)
+		}
+		total += got.Balance
+	}
+	if total != start {
+		t.Errorf("balances sum to %d, want %d", total, start)
+	}
+}
+
+func TestMakeTransferRejectsBadTransfers(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	accounts := createTestAccounts(t, store, 2, 100)
+	from, to := accounts[0], accounts[1]
+
+	tests := []struct {
+		name       string
+		fromNumber int64
+		toNumber   int64
+		amount     int
+		code       ErrorCode
+	}{
+		{"same account", from.AccountNumber, from.AccountNumber, 10, CodeValidation},
+		{"zero amount", from.AccountNumber, to.AccountNumber, 0, CodeValidation},
+		{"more than the balance", from.AccountNumber, to.AccountNumber, 101, CodeInsufficientFunds},
+		{"unknown account", from.AccountNumber, 1234567897, 10, CodeNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := MakeTransfer(ctx, store, tt.toNumber, tt.fromNumber, tt.amount)
+			if !isErrorCode(err, tt.code) {
+				t.Errorf("got error %v, want code %s", err, tt.code)
+			}
+		})
+	}
+
+	// None of them may have moved any money
+	for _, acc := range accounts {
+		got, err := store.GetAccountByID(ctx, acc.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Balance != 100 {
+			t.Errorf("account %d has a balance of %d, want 100", got.ID, got.Balance)
+		}
+	}
+}
+
+// cancelDuringTx is a store whose units of work see their context cancelled just as they
+// finish, like a client hanging up while a transfer is being made
+type cancelDuringTx struct {
+	Storage
+	cancel context.CancelFunc
+}
+
+func (s cancelDuringTx) WithTx(ctx context.Context, fn func(TxStore) error) error {
+	return s.Storage.WithTx(ctx, func(tx TxStore) error {
+		err := fn(tx)
+		s.cancel()
+		return err
+	})
+}
+
+// A transfer whose request goes away part way through is rolled back, not half applied
+func TestMakeTransferCancelledRollsBack(t *testing.T) {
+	checkTransferCancelledRollsBack(t, NewMemoryStore())
+}
+
+func TestPostgresMakeTransferCancelledRollsBack(t *testing.T) {
+	checkTransferCancelledRollsBack(t, newPostgresTestStore(t))
+}
+
+// Helper for making a transfer that is cancelled before it commits and checking nothing moved
+func checkTransferCancelledRollsBack(t *testing.T, store Storage) {
+	t.Helper()
+	accounts := createTestAccounts(t, store, 2, 100)
+	from, to := accounts[0], accounts[1]
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, err := MakeTransfer(ctx, cancelDuringTx{Storage: store, cancel: cancel}, to.AccountNumber, from.AccountNumber, 60)
+	// database/sql may have rolled the transaction back before Commit sees the cancellation,
+	// in which case the error is sql.ErrTxDone
+	if !errors.Is(err, context.Canceled) && !errors.Is(err, sql.ErrTxDone) {
+		t.Fatalf("got error %v, want context.Canceled", err)
+	}
+
+	for _, acc := range accounts {
+		got, err := store.GetAccountByID(context.Background(), acc.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ledger, err := store.GetLedgerBalance(context.Background(), acc.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Balance != 100 || ledger != 100 {
+			t.Errorf("account %d has balance %d and ledger %d after a cancelled transfer, want 100", acc.ID, got.Balance, ledger)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// accountTransitions lists the statuses an account can move to from each status
+// Closed is final, a closed account can't be reopened
+var accountTransitions = map[AccountStatus][]AccountStatus{
+	StatusPending: {StatusActive, StatusClosed},
+	StatusActive:  {StatusFrozen, StatusClosed},
+	StatusFrozen:  {StatusActive, StatusClosed},
+	StatusClosed:  {},
+}
+
+// Valid reports whether the status is one of the known lifecycle statuses
+func (st AccountStatus) Valid() bool {
+	_, ok := accountTransitions[st]
+	return ok
+}
+
+// canTransition reports whether an account can move from one status to another
+func canTransition(from, to AccountStatus) bool {
+	for _, allowed := range accountTransitions[from] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+// ChangeAccountStatus moves an account to a new lifecycle status
+// An account can only be closed once its balance is zero
+// This is used in the handleAccountStatus function in api.go
+func ChangeAccountStatus(ctx context.Context, s Storage, id int, status AccountStatus) (*Account, error) {
+	if !status.Valid() {
+		return nil, fieldError("status", "invalid status %s", status)
+	}
+
+	var account *Account
+	err := s.WithTx(ctx, func(tx TxStore) error {
+		acc, err := lockAccountForStatusChange(tx, id, status)
+		if err != nil {
+			return err
+		}
+
+		if err := tx.SetAccountStatus(acc.ID, status, time.Now().UTC()); err != nil {
+			return err
+		}
+
+		account, err = tx.GetAccountByID(id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return account, nil
+}
+
+// DeleteAccount soft-deletes an account
+// The account is closed, following the same rules as closing it, and deleted_at is set
+// The row and its journal entries are kept for the audit trail
+func DeleteAccount(ctx context.Context, s Storage, id int) error {
+	return s.WithTx(ctx, func(tx TxStore) error {
+		acc, err := tx.GetAccountByID(id)
+		if err != nil {
+			return err
+		}
+		if acc.DeletedAt != nil {
+			return conflictError("account already deleted")
+		}
+
+		now := time.Now().UTC()
+		if acc.Status != StatusClosed {
+			if _, err := lockAccountForStatusChange(tx, id, StatusClosed); err != nil {
+				return err
+			}
+			if err := tx.SetAccountStatus(id, StatusClosed, now); err != nil {
+				return err
+			}
+		}
+
+		return tx.MarkAccountDeleted(id, now)
+	})
+}
+
+// lockAccountForStatusChange locks an account and checks that it may move to the new status
+func lockAccountForStatusChange(tx TxStore, id int, status AccountStatus) (*Account, error) {
+	if err := tx.LockAccounts(id); err != nil {
+		return nil, err
+	}
+
+	acc, err := tx.GetAccountByID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if !canTransition(acc.Status, status) {
+		return nil, conflictError("account can't go from %s to %s", acc.Status, status)
+	}
+	if status == StatusClosed && acc.Balance != 0 {
+		return nil, conflictError("account can't be closed with a non-zero balance of %d", acc.Balance)
+	}
+
+	return acc, nil
+}
+
+// checkCanTransfer returns an error unless the account can send or receive money
+func checkCanTransfer(acc *Account) error {
+	if acc.Status != StatusActive {
+		return conflictError("account %d is %s", acc.AccountNumber, acc.Status)
+	}
+	return nil
+}
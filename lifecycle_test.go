@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCanTransition(t *testing.T) {
+	tests := []struct {
+		from, to AccountStatus
+		ok       bool
+	}{
+		{StatusPending, StatusActive, true},
+		{StatusPending, StatusClosed, true},
+		{StatusPending, StatusFrozen, false},
+		{StatusActive, StatusFrozen, true},
+		{StatusActive, StatusClosed, true},
+		{StatusActive, StatusPending, false},
+		{StatusFrozen, StatusActive, true},
+		{StatusFrozen, StatusClosed, true},
+		{StatusClosed, StatusActive, false},
+		{StatusClosed, StatusFrozen, false},
+		{StatusActive, StatusActive, false},
+	}
+	for _, tt := range tests {
+		if got := canTransition(tt.from, tt.to); got != tt.ok {
+			t.Errorf("canTransition(%s, %s) = %v, want %v", tt.from, tt.to, got, tt.ok)
+		}
+	}
+}
+
+// Helper for moving an account to a new status
+func postStatus(t *testing.T, h http.Handler, token string, id int, status AccountStatus) *httptest.ResponseRecorder {
+	t.Helper()
+	return doJSON(t, h, http.MethodPost, fmt.Sprintf("/account/%d/status", id), token, AccountStatusRequest{Status: status})
+}
+
+// A frozen account can neither send nor receive until it is unfrozen, and an account
+// with money in it can't be closed
+func TestHandleAccountStatus(t *testing.T) {
+	h, store, accounts := newTestServer(t)
+	a, b := accounts[0], accounts[1]
+	teller := createTestAccount(t, store, "Status", "Teller", 0, RoleTeller)
+	tellerToken := login(t, h, teller)
+	tokenA := login(t, h, a)
+	tokenB := login(t, h, b)
+
+	rec := postStatus(t, h, tellerToken, a.ID, StatusFrozen)
+	var frozen Account
+	decodeResponse(t, rec, &frozen)
+	if frozen.Status != StatusFrozen {
+		t.Fatalf("account is %s after freezing", frozen.Status)
+	}
+
+	rec = doJSON(t, h, http.MethodPost, "/transfer", tokenA, TransferRequest{ToAccountNumber: b.AccountNumber, Amount: 10})
+	expectError(t, rec, http.StatusConflict, CodeConflict)
+	rec = doJSON(t, h, http.MethodPost, "/transfer", tokenB, TransferRequest{ToAccountNumber: a.AccountNumber, Amount: 10})
+	expectError(t, rec, http.StatusConflict, CodeConflict)
+
+	// Frozen accounts can't skip back to pending, and the status has to be a real one
+	expectError(t, postStatus(t, h, tellerToken, a.ID, StatusPending), http.StatusConflict, CodeConflict)
+	expectError(t, postStatus(t, h, tellerToken, a.ID, "asleep"), http.StatusBadRequest, CodeValidation)
+
+	decodeResponse(t, postStatus(t, h, tellerToken, a.ID, StatusActive), &frozen)
+	rec = doJSON(t, h, http.MethodPost, "/transfer", tokenB, TransferRequest{ToAccountNumber: a.AccountNumber, Amount: 10})
+	if rec.Code != http.StatusOK {
+		t.Errorf("transfer to an unfrozen account got status %d: %s", rec.Code, rec.Body)
+	}
+
+	expectError(t, postStatus(t, h, tellerToken, a.ID, StatusClosed), http.StatusConflict, CodeConflict)
+
+	// Customers can't change their own status
+	expectError(t, postStatus(t, h, tokenA, a.ID, StatusFrozen), http.StatusForbidden, CodeForbidden)
+}
+
+// Deleting closes the account and hides it from the list, but its history stays
+func TestHandleDeleteAccount(t *testing.T) {
+	h, store, accounts := newTestServer(t)
+	admin := createTestAccount(t, store, "Delete", "Admin", 0, RoleAdmin)
+	token := loginWithMFA(t, h, admin)
+	a, b := accounts[0], accounts[1]
+
+	rec := doJSON(t, h, http.MethodDelete, fmt.Sprintf("/account/%d", a.ID), token, nil)
+	expectError(t, rec, http.StatusConflict, CodeConflict)
+
+	// Empty the account so it can be closed
+	rec = doJSON(t, h, http.MethodPost, "/transfer", login(t, h, a), TransferRequest{ToAccountNumber: b.AccountNumber, Amount: int(a.Balance)})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("emptying the account got status %d: %s", rec.Code, rec.Body)
+	}
+	rec = doJSON(t, h, http.MethodDelete, fmt.Sprintf("/account/%d", a.ID), token, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("deleting got status %d: %s", rec.Code, rec.Body)
+	}
+	rec = doJSON(t, h, http.MethodDelete, fmt.Sprintf("/account/%d", a.ID), token, nil)
+	expectError(t, rec, http.StatusConflict, CodeConflict)
+
+	deleted, err := store.GetAccountByID(context.Background(), a.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted.Status != StatusClosed || deleted.ClosedAt == nil || deleted.DeletedAt == nil {
+		t.Errorf("deleted account is %s, closed at %v, deleted at %v", deleted.Status, deleted.ClosedAt, deleted.DeletedAt)
+	}
+	ledger, err := store.GetLedgerBalance(context.Background(), a.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ledger != 0 {
+		t.Errorf("deleted account's postings sum to %d, want 0", ledger)
+	}
+
+	rec = doJSON(t, h, http.MethodPost, "/login", "", LoginRequest{AccountNumber: a.AccountNumber, Password: "password"})
+	expectError(t, rec, http.StatusForbidden, CodeForbidden)
+
+	var list AccountsResponse
+	decodeResponse(t, doJSON(t, h, http.MethodGet, "/accounts?status=closed", token, nil), &list)
+	if len(list.Accounts) != 0 {
+		t.Errorf("deleted account is listed: %v", list.Accounts)
+	}
+	decodeResponse(t, doJSON(t, h, http.MethodGet, "/accounts?status=closed&include_deleted=true", token, nil), &list)
+	if len(list.Accounts) != 1 || list.Accounts[0].ID != a.ID {
+		t.Errorf("include_deleted listed %v, want the deleted account", list.Accounts)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Failed logins are counted per account number and per IP address
+// Each failure makes the caller wait twice as long before the next attempt, and too many
+// failures lock the key out for a while. Failures are forgotten after a quiet period.
+// Unknown account numbers are counted the same way so lockouts don't reveal which numbers exist
+// Attempts are counted before they are checked and given back if they were right, see Reserve
+const (
+	maxAccountLoginFailures = 5
+	maxIPLoginFailures      = 20
+	loginLockoutDuration    = 15 * time.Minute
+	loginFailureWindow      = 15 * time.Minute
+	loginBackoffBase        = time.Second
+	loginBackoffMax         = 30 * time.Second
+
+	defaultSecurityEventsLimit = 50
+	maxSecurityEventsLimit     = 500
+)
+
+// loginGuard decides whether a login attempt may go ahead and records how it went
+type loginGuard struct {
+	ctx           context.Context
+	store         Storage
+	accountNumber int64
+	ip            string
+	// Failures on each key including this attempt, filled in by Reserve
+	reserved map[string]int
+}
+
+// newLoginGuard creates a login guard for an attempt on an account number from a request
+func newLoginGuard(s Storage, r *http.Request, accountNumber int64) *loginGuard {
+	return &loginGuard{
+		ctx:           r.Context(),
+		store:         s,
+		accountNumber: accountNumber,
+		ip:            clientIP(r),
+		reserved:      map[string]int{},
+	}
+}
+
+// Helper for the throttle keys an attempt counts against
+func (g *loginGuard) keys() []string {
+	return []string{accountThrottleKey(g.accountNumber), ipThrottleKey(g.ip)}
+}
+
+// Helper for the throttle key of an account number
+// This is used in handleUnlockAccount as well
+func accountThrottleKey(accountNumber int64) string {
+	return "account:" + strconv.FormatInt(accountNumber, 10)
+}
+
+// Helper for the throttle key of an IP address
+func ipThrottleKey(ip string) string {
+	return "ip:" + ip
+}
+
+// maxFailures is how many failures a key may have before it is locked
+func maxFailures(key string) int {
+	if strings.HasPrefix(key, "ip:") {
+		return maxIPLoginFailures
+	}
+	return maxAccountLoginFailures
+}
+
+// loginBackoff is how long to wait after the given number of failures
+func loginBackoff(failures int) time.Duration {
+	if failures <= 0 {
+		return 0
+	}
+	backoff := loginBackoffBase
+	for i := 1; i < failures && backoff < loginBackoffMax; i++ {
+		backoff *= 2
+	}
+	if backoff > loginBackoffMax {
+		backoff = loginBackoffMax
+	}
+	return backoff
+}
+
+// Reserve counts the attempt against the account number and IP before the password is checked
+// It returns how long the caller has to wait before trying again, or 0 if the attempt may go ahead
+// Counting first means parallel guesses can't all get in before any of them fails
+// An attempt that turns out to be right is given back with Passed
+func (g *loginGuard) Reserve() (time.Duration, error) {
+	now := time.Now().UTC()
+	var wait time.Duration
+	for _, key := range g.keys() {
+		t, err := g.store.GetLoginThrottle(g.ctx, key)
+		if err != nil {
+			return 0, err
+		}
+
+		until := t.LastFailureAt.Add(loginBackoff(t.Failures))
+		if t.LastFailureAt.Before(now.Add(-loginFailureWindow)) {
+			until = time.Time{}
+		}
+		if t.LockedUntil != nil && t.LockedUntil.After(until) {
+			until = *t.LockedUntil
+		}
+		if d := until.Sub(now); d > wait {
+			wait = d
+		}
+	}
+	if wait > 0 {
+		return wait, nil
+	}
+
+	for _, key := range g.keys() {
+		t, err := g.store.ReserveLoginAttempt(g.ctx, key, now, now.Add(-loginFailureWindow))
+		if err != nil {
+			return 0, err
+		}
+		g.reserved[key] = t.Failures
+		if t.Failures <= maxFailures(key) {
+			continue
+		}
+
+		// Other attempts used up what was left, this one has to wait for them
+		if err := g.Passed(); err != nil {
+			return 0, err
+		}
+		wait := loginBackoff(t.Failures)
+		if t.LockedUntil != nil && t.LockedUntil.Sub(now) > wait {
+			wait = t.LockedUntil.Sub(now)
+		}
+		return wait, nil
+	}
+	return 0, nil
+}
+
+// Failed records a failed attempt, locking the account number and IP if they ran out of attempts
+func (g *loginGuard) Failed(reason string) error {
+	now := time.Now().UTC()
+	g.recordEvent(EventLoginFailed, reason)
+
+	for key, failures := range g.reserved {
+		if failures < maxFailures(key) {
+			continue
+		}
+
+		until := now.Add(loginLockoutDuration)
+		if err := g.store.LockLogin(g.ctx, key, until); err != nil {
+			return err
+		}
+		g.recordEvent(EventLoginLocked, fmt.Sprintf("%s locked until %s after %d failures", key, until.Format(time.RFC3339), failures))
+	}
+	g.reserved = map[string]int{}
+	return nil
+}
+
+// Passed gives back the attempts counted by Reserve when the password or code was right
+// Earlier failures on the account number stay until Succeeded, so a right password
+// doesn't reset guesses at the second factor
+func (g *loginGuard) Passed() error {
+	for key := range g.reserved {
+		if err := g.store.ReleaseLoginAttempt(g.ctx, key); err != nil {
+			return err
+		}
+		delete(g.reserved, key)
+	}
+	return nil
+}
+
+// Succeeded clears the failures on the account number
+// Failures from the IP are kept, logging in to one account shouldn't reset guesses at others
+func (g *loginGuard) Succeeded() error {
+	return g.store.ClearLoginThrottle(g.ctx, accountThrottleKey(g.accountNumber))
+}
+
+// Helper for recording a security event for the attempt
+// Failing to record an event is logged but doesn't fail the login
+func (g *loginGuard) recordEvent(kind SecurityEventKind, detail string) {
+	err := g.store.RecordSecurityEvent(g.ctx, &SecurityEvent{
+		Kind:          kind,
+		AccountNumber: g.accountNumber,
+		IP:            g.ip,
+		Detail:        detail,
+		CreatedAt:     time.Now().UTC(),
+	})
+	if err != nil {
+		log.Println("error recording security event:", err)
+	}
+}
+
+// recordSecurityEvent records a security event about an account from a request
+// Failing to record an event is logged but doesn't fail the request
+func recordSecurityEvent(s Storage, r *http.Request, kind SecurityEventKind, accountNumber int64, detail string) {
+	err := s.RecordSecurityEvent(r.Context(), &SecurityEvent{
+		Kind:          kind,
+		AccountNumber: accountNumber,
+		IP:            clientIP(r),
+		Detail:        detail,
+		CreatedAt:     time.Now().UTC(),
+	})
+	if err != nil {
+		log.Println("error recording security event:", err)
+	}
+}
+
+// clientIP is the address the request came from
+// X-Forwarded-For is not trusted since any client can set it
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
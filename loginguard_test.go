@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoginBackoff(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 0},
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{5, 16 * time.Second},
+		{6, loginBackoffMax},
+		{100, loginBackoffMax},
+	}
+	for _, tt := range tests {
+		if got := loginBackoff(tt.failures); got != tt.want {
+			t.Errorf("loginBackoff(%d) = %s, want %s", tt.failures, got, tt.want)
+		}
+	}
+}
+
+// Helper for recording failures against a throttle key as if they happened a while ago,
+// so the backoff after them is already over
+func seedLoginFailures(t *testing.T, s Storage, key string, failures int) {
+	t.Helper()
+	at := time.Now().UTC().Add(-2 * loginBackoffMax)
+	for i := 0; i < failures; i++ {
+		if _, err := s.ReserveLoginAttempt(context.Background(), key, at, at.Add(-loginFailureWindow)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Each failure makes the next attempt wait, even for account numbers that don't exist
+func TestLoginFailuresBackOff(t *testing.T) {
+	h, _, accounts := newTestServer(t)
+
+	for _, number := range []int64{accounts[0].AccountNumber, 1234567897} {
+		rec := doJSON(t, h, http.MethodPost, "/login", "", LoginRequest{AccountNumber: number, Password: "wrong"})
+		expectError(t, rec, http.StatusUnauthorized, CodeUnauthorized)
+
+		rec = doJSON(t, h, http.MethodPost, "/login", "", LoginRequest{AccountNumber: number, Password: "password"})
+		expectError(t, rec, http.StatusTooManyRequests, CodeTooManyRequests)
+		if rec.Header().Get("Retry-After") != "1" {
+			t.Errorf("account number %d: got Retry-After %q, want 1", number, rec.Header().Get("Retry-After"))
+		}
+	}
+}
+
+// The last failure allowed locks the account number. The lock is stored, so it holds after
+// a restart, until it runs out or an admin lifts it
+func TestLoginLockoutAndUnlock(t *testing.T) {
+	h, store, accounts := newTestServer(t)
+	account := accounts[0]
+	seedLoginFailures(t, store, accountThrottleKey(account.AccountNumber), maxAccountLoginFailures-1)
+
+	rec := doJSON(t, h, http.MethodPost, "/login", "", LoginRequest{AccountNumber: account.AccountNumber, Password: "wrong"})
+	expectError(t, rec, http.StatusUnauthorized, CodeUnauthorized)
+
+	restarted := newTestHandler(t, store)
+	rec = doJSON(t, restarted, http.MethodPost, "/login", "", LoginRequest{AccountNumber: account.AccountNumber, Password: "password"})
+	expectError(t, rec, http.StatusTooManyRequests, CodeTooManyRequests)
+	retryAfter, err := strconv.Atoi(rec.Header().Get("Retry-After"))
+	if err != nil || retryAfter < int(loginLockoutDuration.Seconds())-5 {
+		t.Errorf("got Retry-After %q, want about %s", rec.Header().Get("Retry-After"), loginLockoutDuration)
+	}
+
+	admin := createTestAccount(t, store, "Unlock", "Admin", 0, RoleAdmin)
+	adminToken := loginWithMFA(t, h, admin)
+
+	var events []*SecurityEvent
+	decodeResponse(t, doJSON(t, h, http.MethodGet, fmt.Sprintf("/security/events?account_number=%d&kind=%s", account.AccountNumber, EventLoginLocked), adminToken, nil), &events)
+	if len(events) != 1 {
+		t.Errorf("got %d lockout events, want 1", len(events))
+	}
+
+	// Customers can't unlock themselves
+	rec = doJSON(t, h, http.MethodPost, fmt.Sprintf("/account/%d/unlock", account.ID), login(t, h, accounts[1]), nil)
+	expectError(t, rec, http.StatusForbidden, CodeForbidden)
+
+	rec = doJSON(t, h, http.MethodPost, fmt.Sprintf("/account/%d/unlock", account.ID), adminToken, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unlocking got status %d: %s", rec.Code, rec.Body)
+	}
+	login(t, h, account)
+
+	decodeResponse(t, doJSON(t, h, http.MethodGet, fmt.Sprintf("/security/events?account_number=%d", account.AccountNumber), adminToken, nil), &events)
+	kinds := map[SecurityEventKind]int{}
+	for _, event := range events {
+		kinds[event.Kind]++
+	}
+	if kinds[EventLoginFailed] != 1 || kinds[EventLoginLocked] != 1 || kinds[EventAccountUnlocked] != 1 {
+		t.Errorf("got security events %v", kinds)
+	}
+}
+
+// Failures from one address lock it out across every account number
+func TestLoginIPLockout(t *testing.T) {
+	h, store, accounts := newTestServer(t)
+	seedLoginFailures(t, store, ipThrottleKey("192.0.2.1"), maxIPLoginFailures)
+
+	loginFrom := func(addr string) *httptest.ResponseRecorder {
+		body := fmt.Sprintf(`{"account_number": %d, "password": "password"}`, accounts[0].AccountNumber)
+		req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(body))
+		req.RemoteAddr = addr
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := loginFrom("192.0.2.1:4321")
+	expectError(t, rec, http.StatusTooManyRequests, CodeTooManyRequests)
+	if rec := loginFrom("192.0.2.2:4321"); rec.Code != http.StatusOK {
+		t.Errorf("login from another address got status %d: %s", rec.Code, rec.Body)
+	}
+}
@@ -1,66 +1,189 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
-
-	"github.com/joho/godotenv"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 )
 
-func seedAccount(s Storage, firstName, lastName, password string, isAdmin bool, balance ...int64) *Account {
+func seedAccount(ctx context.Context, s Storage, firstName, lastName, password string, roles []Role, balance ...int64) *Account {
 	var bal int64
 	if len(balance) > 0 {
 		bal = balance[0]
 	}
-	account, err := NewAccount(firstName, lastName, password, isAdmin, bal)
+	account, err := NewAccount(firstName, lastName, password, roles, bal)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	acc, err := s.CreateAccount(account); 
+	acc, err := s.CreateAccount(ctx, account)
 	if err != nil {
 		log.Fatal(err)
 	}
-	if !isAdmin {
+	// The last role is the most senior, e.g. admin and superadmin
+	role := roles[len(roles)-1]
+	if role == RoleCustomer {
 		fmt.Println("NEW ACCOUNT SEEDED:", account.AccountNumber)
-	}
-	if isAdmin {
-		fmt.Println("NEW ADMIN ACCOUNT SEEDED:", account.AccountNumber)
+	} else {
+		fmt.Printf("NEW %s ACCOUNT SEEDED: %d\n", strings.ToUpper(string(role)), account.AccountNumber)
 	}
 	return acc
 }
 
-func seedAccounts(s Storage) {
-	seedAccount(s, "John", "Doe", "password", false, 1000)
-	seedAccount(s, "Cool", "Guy", "password", false, 1000)
-	seedAccount(s, "Defacto", "Admin", "password", true)
+func seedAccounts(ctx context.Context, s Storage) {
+	seedAccount(ctx, s, "John", "Doe", "password", []Role{RoleCustomer}, 1000)
+	seedAccount(ctx, s, "Cool", "Guy", "password", []Role{RoleCustomer}, 1000)
+	seedAccount(ctx, s, "Defacto", "Admin", "password", []Role{RoleAdmin})
+	seedAccount(ctx, s, "Tina", "Teller", "password", []Role{RoleTeller})
+	seedAccount(ctx, s, "Audrey", "Auditor", "password", []Role{RoleAuditor})
+	seedAccount(ctx, s, "Sunny", "Super", "password", []Role{RoleAdmin, RoleSuperAdmin})
 }
 
-func main() {
-	err := godotenv.Load()
+// newStore creates the storage backend picked with the store setting
+// The memory store keeps nothing between restarts and needs no database
+// Pending migrations are only applied when migrate is set, otherwise the server refuses
+// to start on an out of date schema
+func newStore(cfg *Config, migrate bool) (Storage, error) {
+	switch cfg.Store {
+	case "memory":
+		fmt.Println("Memory Store Created")
+		return NewMemoryStore(), nil
+	case "postgres":
+		store, err := NewPostgresStore(cfg.PostgresURL)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Println("Postgres Store Created")
+
+		if err := checkSchema(store, migrate); err != nil {
+			store.Close()
+			return nil, err
+		}
+		return store, nil
+	default:
+		return nil, fmt.Errorf("unknown store %q, must be postgres or memory", cfg.Store)
+	}
+}
+
+// Helper for bringing the schema up to date, or checking that it already is
+func checkSchema(store *PostgresStore, migrate bool) error {
+	migrator, err := store.Migrator()
+	if err != nil {
+		return err
+	}
+	if migrate {
+		if err := migrator.Up(context.Background()); err != nil {
+			return err
+		}
+		fmt.Println("Database Migrated")
+		return nil
+	}
+
+	statuses, err := migrator.Status(context.Background())
 	if err != nil {
-		log.Fatal("Error loading .env file")
+		return err
 	}
+	for _, status := range statuses {
+		if status.AppliedAt == nil {
+			return fmt.Errorf("migration %d_%s has not been applied, run gobank migrate up or start with --migrate", status.Version, status.Name)
+		}
+	}
+	return nil
+}
+
+// reloadKeysOnSignal reloads the keyring every time the process gets SIGHUP
+func reloadKeysOnSignal(keys *Keyring) {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	for range sighup {
+		if err := keys.Reload(); err != nil {
+			log.Println("error reloading signing keys:", err)
+			continue
+		}
+		log.Println("Signing keys reloaded")
+	}
+}
 
+func main() {
+	configFile := flag.String("config", "", "config file to read, see config.go for the format")
 	seed := flag.Bool("seed", false, "seed the database")
+	migrate := flag.Bool("migrate", false, "apply pending database migrations before serving")
+	printConfig := flag.Bool("print-config", false, "print the config with secrets redacted and exit")
+	registerConfigFlags(flag.CommandLine)
 	flag.Parse()
-	store, err := NewPostgresStore()
-	fmt.Println("Postgres Store Created")
+
+	cfg, err := LoadConfig(flag.CommandLine, *configFile)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	if err = store.CreateAccountTable(); err != nil {
+	// gobank migrate up|down|status manages the schema and exits
+	if args := flag.Args(); len(args) > 0 && args[0] == "migrate" {
+		if err := runMigrateCommand(context.Background(), cfg.PostgresURL, args[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *printConfig {
+		fmt.Print(cfg)
+		if err := cfg.Validate(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	// Refuse to start with a config that is incomplete or makes no sense
+	if err := cfg.Validate(); err != nil {
 		log.Fatal(err)
 	}
-	fmt.Println("Account Table Created")
+	cfg.Apply()
+	log.Printf("Config:\n%s", cfg)
+
+	// Refuse to start without a key to sign tokens with
+	keys, err := LoadKeyring(cfg.JWTKeysDir, cfg.JWTSecret, cfg.JWTSigningKeyID)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Re-read the key directory on SIGHUP so keys can be rotated without a restart
+	go reloadKeysOnSignal(keys)
+
+	// Two-factor secrets are encrypted with this, see secretbox.go
+	secrets, err := LoadSecretBox(cfg.MFAKey)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Password reset tokens are delivered through this, see notifier.go
+	notifier, err := NewNotifier(cfg.Notifier, cfg.NotifyFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	store, err := newStore(cfg, *migrate)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	if *seed {
 		fmt.Println("Seeding Database")
-		seedAccounts(store)
+		seedAccounts(context.Background(), store)
 	}
 
-	server := NewAPIServer(":5555", store)
-	server.Run()
-	fmt.Println("Server Running on :5555")
+	// SIGINT and SIGTERM stop the server, after the requests in flight have finished
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	server := NewAPIServer(cfg, store, keys, secrets, notifier)
+	err = server.Run(ctx)
+	if closeErr := store.Close(); closeErr != nil {
+		log.Println("error closing the store:", closeErr)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
 }
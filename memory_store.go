@@ -0,0 +1,1098 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStore is an in-memory implementation of the Storage interface
+// It is meant for tests and local development without a database
+// A single mutex guards all of the maps, so every method including transfers is atomic
+// Accounts and transfers are copied on the way in and out so callers can't mutate the store
+type MemoryStore struct {
+	mu             sync.RWMutex
+	accounts       map[int]*Account
+	transfers      map[int]*Transfer
+	idempotency    map[idempotencyID]*IdempotencyRecord
+	refreshTokens  map[int]*RefreshToken
+	revokedTokens  map[string]time.Time
+	loginThrottles map[string]*LoginThrottle
+	securityEvents []*SecurityEvent
+	mfaLastStep    map[int]int64
+	recoveryCodes  map[int]map[string]bool
+	resetTokens    map[int]*PasswordResetToken
+	apiKeys        map[int]*APIKey
+	nextAccountID  int
+	nextTransferID int
+	nextPostingID  int
+	nextRefreshID  int
+	nextResetID    int
+	nextAPIKeyID   int
+}
+
+// Key for idempotency records, which are scoped per caller
+type idempotencyID struct {
+	caller string
+	key    string
+}
+
+// NewMemoryStore creates a new empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		accounts:       make(map[int]*Account),
+		transfers:      make(map[int]*Transfer),
+		idempotency:    make(map[idempotencyID]*IdempotencyRecord),
+		refreshTokens:  make(map[int]*RefreshToken),
+		revokedTokens:  make(map[string]time.Time),
+		loginThrottles: make(map[string]*LoginThrottle),
+		mfaLastStep:    make(map[int]int64),
+		recoveryCodes:  make(map[int]map[string]bool),
+		resetTokens:    make(map[int]*PasswordResetToken),
+		apiKeys:        make(map[int]*APIKey),
+		nextAccountID:  1,
+		nextTransferID: 1,
+		nextPostingID:  1,
+		nextRefreshID:  1,
+		nextResetID:    1,
+		nextAPIKeyID:   1,
+	}
+}
+
+// CreateAccount stores a new account and journals its opening balance
+// Like the unique constraint in Postgres, a taken account number is replaced with a new one
+func (s *MemoryStore) CreateAccount(ctx context.Context, acc *Account) (*Account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for attempt := 1; s.accountNumberTaken(acc.AccountNumber, 0); attempt++ {
+		if attempt == maxAccountNumberAttempts {
+			return nil, conflictError("account number %d is already taken", acc.AccountNumber)
+		}
+		number, err := generateAccountNumber()
+		if err != nil {
+			return nil, err
+		}
+		acc.AccountNumber = number
+	}
+
+	acc.ID = s.nextAccountID
+	s.nextAccountID++
+	s.accounts[acc.ID] = copyAccount(acc)
+
+	if acc.Balance > 0 {
+		s.recordTransfer(TransferKindDeposit, nil, acc.ID, acc.Balance)
+	}
+
+	return acc, nil
+}
+
+// UpdateAccountByID updates the same fields as the Postgres implementation
+func (s *MemoryStore) UpdateAccountByID(ctx context.Context, id int, accountDetails *Account) (*Account, error) {
+	if accountDetails == nil {
+		return nil, fmt.Errorf("account details cannot be nil")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	acc, ok := s.accounts[id]
+	if !ok {
+		return nil, notFoundError("account not found")
+	}
+	if accountDetails.Version != 0 && accountDetails.Version != acc.Version {
+		return nil, versionMismatchError(accountDetails.Version, acc.Version)
+	}
+	if s.accountNumberTaken(accountDetails.AccountNumber, id) {
+		return nil, conflictError("account number %d is already taken", accountDetails.AccountNumber)
+	}
+	acc.FirstName = accountDetails.FirstName
+	acc.LastName = accountDetails.LastName
+	acc.AccountNumber = accountDetails.AccountNumber
+	acc.Roles = append([]Role(nil), accountDetails.Roles...)
+	acc.Version++
+
+	return copyAccount(acc), nil
+}
+
+// GetAccounts gets a page of the accounts that match the filter
+func (s *MemoryStore) GetAccounts(ctx context.Context, filter AccountFilter) ([]*Account, error) {
+	if filter.Limit < 1 {
+		return nil, fmt.Errorf("listing accounts needs a limit")
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	matches := []*Account{}
+	for id := 1; id < s.nextAccountID; id++ {
+		acc, ok := s.accounts[id]
+		if !ok || !accountMatches(acc, filter) {
+			continue
+		}
+		if filter.After != nil && !filter.After.before(acc, filter) {
+			continue
+		}
+		matches = append(matches, acc)
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		return accountLess(matches[i], matches[j], filter)
+	})
+	if len(matches) > filter.Limit {
+		matches = matches[:filter.Limit]
+	}
+
+	accounts := make([]*Account, len(matches))
+	for i, acc := range matches {
+		accounts[i] = copyAccount(acc)
+	}
+	return accounts, nil
+}
+
+// CountAccounts counts every account that matches the filter, ignoring the paging
+func (s *MemoryStore) CountAccounts(ctx context.Context, filter AccountFilter) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	count := 0
+	for _, acc := range s.accounts {
+		if accountMatches(acc, filter) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// Helper for checking an account against the filtering part of an AccountFilter
+func accountMatches(acc *Account, filter AccountFilter) bool {
+	if prefix := strings.ToLower(filter.NamePrefix); prefix != "" &&
+		!strings.HasPrefix(strings.ToLower(acc.FirstName), prefix) &&
+		!strings.HasPrefix(strings.ToLower(acc.LastName), prefix) {
+		return false
+	}
+	switch {
+	case filter.Status != "" && acc.Status != filter.Status,
+		filter.Role != "" && !acc.HasRole(filter.Role),
+		filter.MinBalance != nil && acc.Balance < *filter.MinBalance,
+		filter.MaxBalance != nil && acc.Balance > *filter.MaxBalance,
+		!filter.CreatedSince.IsZero() && acc.CreatedAt.Before(filter.CreatedSince),
+		!filter.CreatedUntil.IsZero() && !acc.CreatedAt.Before(filter.CreatedUntil),
+		!filter.IncludeDeleted && acc.DeletedAt != nil:
+		return false
+	}
+	return true
+}
+
+// accountLess reports whether a comes before b in the filter's sort order
+func accountLess(a, b *Account, filter AccountFilter) bool {
+	cmp := 0
+	switch filter.Sort {
+	case SortByLastName:
+		cmp = strings.Compare(a.LastName, b.LastName)
+	case SortByBalance:
+		cmp = compareInt64(a.Balance, b.Balance)
+	case SortByCreatedAt:
+		cmp = a.CreatedAt.Compare(b.CreatedAt)
+	}
+	if cmp == 0 {
+		cmp = compareInt64(int64(a.ID), int64(b.ID))
+	}
+	if filter.Descending {
+		return cmp > 0
+	}
+	return cmp < 0
+}
+
+// before reports whether the cursor comes before acc, i.e. acc belongs on a later page
+func (c *AccountCursor) before(acc *Account, filter AccountFilter) bool {
+	last := &Account{ID: c.ID, LastName: c.LastName, Balance: c.Balance, CreatedAt: c.CreatedAt}
+	return accountLess(last, acc, filter)
+}
+
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// GetAccountByID gets an account by ID
+func (s *MemoryStore) GetAccountByID(ctx context.Context, id int) (*Account, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	acc, ok := s.accounts[id]
+	if !ok {
+		return nil, notFoundError("account not found")
+	}
+
+	return copyAccount(acc), nil
+}
+
+// GetAccountByNumber gets an account by account number
+func (s *MemoryStore) GetAccountByNumber(ctx context.Context, number int) (*Account, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for id := 1; id < s.nextAccountID; id++ {
+		if acc, ok := s.accounts[id]; ok && acc.AccountNumber == int64(number) {
+			return copyAccount(acc), nil
+		}
+	}
+
+	return nil, notFoundError("account not found")
+}
+
+// accountNumberTaken reports whether an account other than exceptID uses the number
+// The caller must hold the lock
+func (s *MemoryStore) accountNumberTaken(number int64, exceptID int) bool {
+	for id, acc := range s.accounts {
+		if id != exceptID && acc.AccountNumber == number {
+			return true
+		}
+	}
+	return false
+}
+
+// WithTx runs fn as a unit of work against the store
+// The write lock is held for the whole of fn, so units of work are serialized
+// Changes are buffered in the memoryTx and only applied if fn returns nil
+// fn must only use the TxStore it is given, calling back into the MemoryStore would deadlock
+func (s *MemoryStore) WithTx(ctx context.Context, fn func(TxStore) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	tx := &memoryTx{s: s, accounts: make(map[int]*Account)}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	// Like a database transaction, nothing is applied if the context ended part way through
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	for id, acc := range tx.accounts {
+		s.accounts[id] = acc
+	}
+	for _, t := range tx.transfers {
+		s.transfers[t.ID] = t
+	}
+
+	return nil
+}
+
+// GetTransferByID gets a transfer and its postings from the journal
+func (s *MemoryStore) GetTransferByID(ctx context.Context, id int) (*Transfer, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	t, ok := s.transfers[id]
+	if !ok {
+		return nil, notFoundError("transfer not found")
+	}
+
+	return s.withAccountNumbers(copyTransfer(t, true)), nil
+}
+
+// GetTransfersByAccount gets the transfers touching an account, newest first
+func (s *MemoryStore) GetTransfersByAccount(ctx context.Context, accountID int, filter TransferFilter) ([]*Transfer, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	transfers := []*Transfer{}
+	for id := s.nextTransferID - 1; id > 0 && len(transfers) < filter.Limit; id-- {
+		// IDs used by a transaction that was rolled back leave gaps
+		t, ok := s.transfers[id]
+		if !ok {
+			continue
+		}
+		debit := t.FromAccountID != nil && *t.FromAccountID == accountID
+		credit := t.ToAccountID == accountID
+
+		switch {
+		case filter.Direction == DirectionDebit && !debit,
+			filter.Direction == DirectionCredit && !credit,
+			!debit && !credit,
+			filter.BeforeID > 0 && t.ID >= filter.BeforeID,
+			!filter.Since.IsZero() && t.CreatedAt.Before(filter.Since),
+			!filter.Until.IsZero() && !t.CreatedAt.Before(filter.Until):
+			continue
+		}
+
+		transfers = append(transfers, s.withAccountNumbers(copyTransfer(t, false)))
+	}
+
+	return transfers, nil
+}
+
+// GetLedgerBalance sums the postings of an account
+func (s *MemoryStore) GetLedgerBalance(ctx context.Context, accountID int) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var balance int64
+	for _, t := range s.transfers {
+		for _, p := range t.Postings {
+			if p.AccountID != nil && *p.AccountID == accountID {
+				balance += p.Amount
+			}
+		}
+	}
+
+	return balance, nil
+}
+
+// CreateIdempotencyRecord reserves an idempotency key for a caller
+func (s *MemoryStore) CreateIdempotencyRecord(ctx context.Context, rec *IdempotencyRecord) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := idempotencyID{caller: rec.Caller, key: rec.Key}
+	if _, ok := s.idempotency[id]; ok {
+		return false, nil
+	}
+
+	stored := *rec
+	s.idempotency[id] = &stored
+	return true, nil
+}
+
+// GetIdempotencyRecord gets the stored outcome of a caller's idempotency key
+func (s *MemoryStore) GetIdempotencyRecord(ctx context.Context, caller string, key string) (*IdempotencyRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rec, ok := s.idempotency[idempotencyID{caller: caller, key: key}]
+	if !ok {
+		return nil, notFoundError("idempotency key not found")
+	}
+
+	copied := *rec
+	return &copied, nil
+}
+
+// CompleteIdempotencyRecord stores the response of the first request made with a key
+func (s *MemoryStore) CompleteIdempotencyRecord(ctx context.Context, rec *IdempotencyRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.idempotency[idempotencyID{caller: rec.Caller, key: rec.Key}]
+	if !ok {
+		return notFoundError("idempotency key not found")
+	}
+	stored.StatusCode = rec.StatusCode
+	stored.Body = append([]byte(nil), rec.Body...)
+
+	return nil
+}
+
+// ReclaimIdempotencyRecord hands a stale reservation over to a new request
+// Returns false if the reservation was completed or taken over since stale was read
+func (s *MemoryStore) ReclaimIdempotencyRecord(ctx context.Context, stale *IdempotencyRecord, rec *IdempotencyRecord) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := idempotencyID{caller: rec.Caller, key: rec.Key}
+	stored, ok := s.idempotency[id]
+	if !ok || stored.StatusCode != 0 || !stored.CreatedAt.Equal(stale.CreatedAt) {
+		return false, nil
+	}
+
+	reclaimed := *rec
+	s.idempotency[id] = &reclaimed
+	return true, nil
+}
+
+// DeleteIdempotencyRecord frees an idempotency key so the request can be retried
+func (s *MemoryStore) DeleteIdempotencyRecord(ctx context.Context, caller string, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.idempotency, idempotencyID{caller: caller, key: key})
+	return nil
+}
+
+// CreateRefreshToken stores a new refresh token
+func (s *MemoryStore) CreateRefreshToken(ctx context.Context, rt *RefreshToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rt.ID = s.nextRefreshID
+	s.nextRefreshID++
+	stored := *rt
+	s.refreshTokens[rt.ID] = &stored
+	return nil
+}
+
+// GetRefreshTokenByHash gets a refresh token by the hash of the token
+func (s *MemoryStore) GetRefreshTokenByHash(ctx context.Context, hash string) (*RefreshToken, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, rt := range s.refreshTokens {
+		if rt.TokenHash == hash {
+			copied := *rt
+			return &copied, nil
+		}
+	}
+
+	return nil, notFoundError("refresh token not found")
+}
+
+// UseRefreshToken marks a refresh token as used when it is rotated
+// Returns false if the token was already used or revoked
+func (s *MemoryStore) UseRefreshToken(ctx context.Context, id int) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rt, ok := s.refreshTokens[id]
+	if !ok || rt.UsedAt != nil || rt.RevokedAt != nil {
+		return false, nil
+	}
+
+	now := time.Now().UTC()
+	rt.UsedAt = &now
+	return true, nil
+}
+
+// RevokeRefreshTokenFamily revokes every refresh token in a family
+func (s *MemoryStore) RevokeRefreshTokenFamily(ctx context.Context, familyID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().UTC()
+	for _, rt := range s.refreshTokens {
+		if rt.FamilyID == familyID && rt.RevokedAt == nil {
+			rt.RevokedAt = &now
+		}
+	}
+	return nil
+}
+
+// RevokeAccessToken adds an access token to the revocation list until it expires
+func (s *MemoryStore) RevokeAccessToken(ctx context.Context, jti string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for id, exp := range s.revokedTokens {
+		if exp.Before(now) {
+			delete(s.revokedTokens, id)
+		}
+	}
+	s.revokedTokens[jti] = expiresAt
+	return nil
+}
+
+// IsAccessTokenRevoked reports whether an access token is on the revocation list
+func (s *MemoryStore) IsAccessTokenRevoked(ctx context.Context, jti string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, revoked := s.revokedTokens[jti]
+	return revoked, nil
+}
+
+// GetLoginThrottle gets the failed logins for a throttle key
+// A key with no failures gets an empty throttle rather than an error
+func (s *MemoryStore) GetLoginThrottle(ctx context.Context, key string) (*LoginThrottle, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	t, ok := s.loginThrottles[key]
+	if !ok {
+		return &LoginThrottle{Key: key}, nil
+	}
+	return copyLoginThrottle(t), nil
+}
+
+// ReserveLoginAttempt counts a login attempt against a throttle key before it is checked
+// The count starts over if the last failure was before resetBefore
+func (s *MemoryStore) ReserveLoginAttempt(ctx context.Context, key string, at time.Time, resetBefore time.Time) (*LoginThrottle, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.loginThrottles[key]
+	if !ok {
+		t = &LoginThrottle{Key: key}
+		s.loginThrottles[key] = t
+	}
+	if t.LastFailureAt.Before(resetBefore) {
+		t.Failures = 0
+	}
+	t.Failures++
+	t.LastFailureAt = at
+
+	return copyLoginThrottle(t), nil
+}
+
+// ReleaseLoginAttempt takes back an attempt counted by ReserveLoginAttempt that didn't fail
+func (s *MemoryStore) ReleaseLoginAttempt(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if t, ok := s.loginThrottles[key]; ok && t.Failures > 0 {
+		t.Failures--
+	}
+	return nil
+}
+
+// LockLogin stops logins for a throttle key until the given time
+func (s *MemoryStore) LockLogin(ctx context.Context, key string, until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if t, ok := s.loginThrottles[key]; ok {
+		t.LockedUntil = &until
+	}
+	return nil
+}
+
+// ClearLoginThrottle forgets the failed logins for a throttle key and lifts any lockout
+func (s *MemoryStore) ClearLoginThrottle(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.loginThrottles, key)
+	return nil
+}
+
+// RecordSecurityEvent stores a security event
+func (s *MemoryStore) RecordSecurityEvent(ctx context.Context, event *SecurityEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	event.ID = len(s.securityEvents) + 1
+	stored := *event
+	s.securityEvents = append(s.securityEvents, &stored)
+	return nil
+}
+
+// GetSecurityEvents gets security events, newest first
+func (s *MemoryStore) GetSecurityEvents(ctx context.Context, filter SecurityEventFilter) ([]*SecurityEvent, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	events := []*SecurityEvent{}
+	for i := len(s.securityEvents) - 1; i >= 0; i-- {
+		event := s.securityEvents[i]
+		if filter.AccountNumber != 0 && event.AccountNumber != filter.AccountNumber {
+			continue
+		}
+		if filter.Kind != "" && event.Kind != filter.Kind {
+			continue
+		}
+		copied := *event
+		events = append(events, &copied)
+		if filter.Limit > 0 && len(events) == filter.Limit {
+			break
+		}
+	}
+	return events, nil
+}
+
+// SetMFASecret stores a new encrypted TOTP secret for an account
+// Two-factor authentication stays off until EnableMFA is called
+func (s *MemoryStore) SetMFASecret(ctx context.Context, id int, secret string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	acc, ok := s.accounts[id]
+	if !ok {
+		return notFoundError("account not found")
+	}
+	acc.MFASecret = secret
+	acc.MFAEnabled = false
+	delete(s.mfaLastStep, id)
+	return nil
+}
+
+// EnableMFA turns on two-factor authentication and replaces the recovery codes
+// The value of each code is whether it is still unused
+func (s *MemoryStore) EnableMFA(ctx context.Context, id int, recoveryCodeHashes []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	acc, ok := s.accounts[id]
+	if !ok {
+		return notFoundError("account not found")
+	}
+	acc.MFAEnabled = true
+	codes := make(map[string]bool, len(recoveryCodeHashes))
+	for _, hash := range recoveryCodeHashes {
+		codes[hash] = true
+	}
+	s.recoveryCodes[id] = codes
+	return nil
+}
+
+// DisableMFA turns off two-factor authentication and removes the secret and recovery codes
+func (s *MemoryStore) DisableMFA(ctx context.Context, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	acc, ok := s.accounts[id]
+	if !ok {
+		return notFoundError("account not found")
+	}
+	acc.MFASecret = ""
+	acc.MFAEnabled = false
+	delete(s.mfaLastStep, id)
+	delete(s.recoveryCodes, id)
+	return nil
+}
+
+// UseTOTPStep records the time step of an accepted TOTP code
+// Returns false if a code from that step or a later one was already accepted
+func (s *MemoryStore) UseTOTPStep(ctx context.Context, id int, step int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if last, ok := s.mfaLastStep[id]; ok && last >= step {
+		return false, nil
+	}
+	s.mfaLastStep[id] = step
+	return true, nil
+}
+
+// UseRecoveryCode uses up a recovery code by its hash
+// Returns false if the account has no unused code with that hash
+func (s *MemoryStore) UseRecoveryCode(ctx context.Context, id int, hash string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.recoveryCodes[id][hash] {
+		return false, nil
+	}
+	s.recoveryCodes[id][hash] = false
+	return true, nil
+}
+
+// SetPassword stores a new password hash for an account
+// Access tokens issued before validAfter stop working and every refresh token is revoked
+func (s *MemoryStore) SetPassword(ctx context.Context, id int, encryptedPassword string, validAfter time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	acc, ok := s.accounts[id]
+	if !ok {
+		return notFoundError("account not found")
+	}
+	acc.EncryptedPassword = encryptedPassword
+	acc.TokensValidAfter = &validAfter
+
+	for _, rt := range s.refreshTokens {
+		if rt.AccountID == id && rt.RevokedAt == nil {
+			revokedAt := validAfter
+			rt.RevokedAt = &revokedAt
+		}
+	}
+	return nil
+}
+
+// CreatePasswordResetToken stores a new password reset token
+// Earlier unused tokens for the account are marked used so only the newest one works
+func (s *MemoryStore) CreatePasswordResetToken(ctx context.Context, rt *PasswordResetToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, existing := range s.resetTokens {
+		if existing.AccountID == rt.AccountID && existing.UsedAt == nil {
+			usedAt := rt.CreatedAt
+			existing.UsedAt = &usedAt
+		}
+	}
+
+	rt.ID = s.nextResetID
+	s.nextResetID++
+	stored := *rt
+	s.resetTokens[rt.ID] = &stored
+	return nil
+}
+
+// GetPasswordResetTokenByHash gets a password reset token by the hash of the token
+func (s *MemoryStore) GetPasswordResetTokenByHash(ctx context.Context, hash string) (*PasswordResetToken, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, rt := range s.resetTokens {
+		if rt.TokenHash == hash {
+			copied := *rt
+			return &copied, nil
+		}
+	}
+
+	return nil, notFoundError("password reset token not found")
+}
+
+// UsePasswordResetToken marks a password reset token as used
+// Returns false if the token was already used
+func (s *MemoryStore) UsePasswordResetToken(ctx context.Context, id int) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rt, ok := s.resetTokens[id]
+	if !ok || rt.UsedAt != nil {
+		return false, nil
+	}
+
+	now := time.Now().UTC()
+	rt.UsedAt = &now
+	return true, nil
+}
+
+// CreateAPIKey stores a new API key
+func (s *MemoryStore) CreateAPIKey(ctx context.Context, key *APIKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, existing := range s.apiKeys {
+		if existing.Prefix == key.Prefix {
+			return conflictError("api key prefix %s is already taken", key.Prefix)
+		}
+	}
+
+	key.ID = s.nextAPIKeyID
+	s.nextAPIKeyID++
+	s.apiKeys[key.ID] = copyAPIKey(key)
+	return nil
+}
+
+// GetAPIKeys gets every API key, including revoked ones
+func (s *MemoryStore) GetAPIKeys(ctx context.Context) ([]*APIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	keys := []*APIKey{}
+	for id := 1; id < s.nextAPIKeyID; id++ {
+		if key, ok := s.apiKeys[id]; ok {
+			keys = append(keys, copyAPIKey(key))
+		}
+	}
+	return keys, nil
+}
+
+// GetAPIKeyByID gets an API key by its ID
+func (s *MemoryStore) GetAPIKeyByID(ctx context.Context, id int) (*APIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	key, ok := s.apiKeys[id]
+	if !ok {
+		return nil, notFoundError("api key not found")
+	}
+	return copyAPIKey(key), nil
+}
+
+// GetAPIKeyByPrefix gets an API key by its prefix
+func (s *MemoryStore) GetAPIKeyByPrefix(ctx context.Context, prefix string) (*APIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, key := range s.apiKeys {
+		if key.Prefix == prefix {
+			return copyAPIKey(key), nil
+		}
+	}
+	return nil, notFoundError("api key not found")
+}
+
+// UpdateAPIKey updates the name, permissions, accounts and expiry of an API key
+func (s *MemoryStore) UpdateAPIKey(ctx context.Context, key *APIKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.apiKeys[key.ID]
+	if !ok {
+		return notFoundError("api key not found")
+	}
+	updated := copyAPIKey(key)
+	stored.Name = updated.Name
+	stored.Permissions = updated.Permissions
+	stored.AccountIDs = updated.AccountIDs
+	stored.ExpiresAt = updated.ExpiresAt
+	return nil
+}
+
+// RevokeAPIKey stops an API key from working
+func (s *MemoryStore) RevokeAPIKey(ctx context.Context, id int, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, ok := s.apiKeys[id]
+	if !ok || key.RevokedAt != nil {
+		return notFoundError("api key not found or already revoked")
+	}
+	key.RevokedAt = &at
+	return nil
+}
+
+// Close does nothing, there is nothing to release
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// TouchAPIKey records when an API key was last used
+func (s *MemoryStore) TouchAPIKey(ctx context.Context, id int, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if key, ok := s.apiKeys[id]; ok {
+		key.LastUsedAt = &at
+	}
+	return nil
+}
+
+// copyAPIKey returns a copy that shares no slices or times with the original
+func copyAPIKey(key *APIKey) *APIKey {
+	copied := *key
+	copied.Permissions = append([]Permission(nil), key.Permissions...)
+	copied.AccountIDs = append([]int{}, key.AccountIDs...)
+	copied.ExpiresAt = copyTime(key.ExpiresAt)
+	copied.LastUsedAt = copyTime(key.LastUsedAt)
+	copied.RevokedAt = copyTime(key.RevokedAt)
+	return &copied
+}
+
+// copyTime copies an optional time
+func copyTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	copied := *t
+	return &copied
+}
+
+// copyLoginThrottle returns a copy that doesn't share the lockout time with the stored throttle
+func copyLoginThrottle(t *LoginThrottle) *LoginThrottle {
+	copied := *t
+	if t.LockedUntil != nil {
+		until := *t.LockedUntil
+		copied.LockedUntil = &until
+	}
+	return &copied
+}
+
+// recordTransfer writes a transfer and its two balancing postings to the journal
+// The caller must hold the write lock
+func (s *MemoryStore) recordTransfer(kind string, fromAcc *int, toAcc int, amount int64) *Transfer {
+	t := s.newTransfer(kind, fromAcc, toAcc, amount)
+	s.transfers[t.ID] = t
+	return t
+}
+
+// newTransfer builds a transfer and its postings, taking the next IDs
+// IDs taken by a rolled back unit of work are skipped, like a database sequence
+// The caller must hold the write lock
+func (s *MemoryStore) newTransfer(kind string, fromAcc *int, toAcc int, amount int64) *Transfer {
+	t := &Transfer{
+		ID:            s.nextTransferID,
+		Kind:          kind,
+		FromAccountID: copyID(fromAcc),
+		ToAccountID:   toAcc,
+		Amount:        amount,
+		CreatedAt:     time.Now().UTC(),
+	}
+	s.nextTransferID++
+
+	t.Postings = []*Posting{
+		{TransferID: t.ID, AccountID: copyID(fromAcc), Amount: -amount, CreatedAt: t.CreatedAt},
+		{TransferID: t.ID, AccountID: copyID(&toAcc), Amount: amount, CreatedAt: t.CreatedAt},
+	}
+	for _, p := range t.Postings {
+		p.ID = s.nextPostingID
+		s.nextPostingID++
+	}
+
+	return t
+}
+
+// memoryTx is the TxStore handed to MemoryStore.WithTx callbacks
+// Changed accounts and new transfers are buffered until the unit of work succeeds
+type memoryTx struct {
+	s         *MemoryStore
+	accounts  map[int]*Account
+	transfers []*Transfer
+}
+
+// account returns the working copy of an account, copying it from the store on first use
+func (t *memoryTx) account(id int) (*Account, error) {
+	if acc, ok := t.accounts[id]; ok {
+		return acc, nil
+	}
+
+	acc, ok := t.s.accounts[id]
+	if !ok {
+		return nil, notFoundError("account not found")
+	}
+	working := copyAccount(acc)
+	t.accounts[id] = working
+	return working, nil
+}
+
+// GetAccountByID gets an account by ID, including any buffered changes
+func (t *memoryTx) GetAccountByID(id int) (*Account, error) {
+	acc, err := t.account(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return copyAccount(acc), nil
+}
+
+// GetAccountByNumber gets an account by account number, including any buffered changes
+func (t *memoryTx) GetAccountByNumber(number int64) (*Account, error) {
+	for id, acc := range t.s.accounts {
+		if acc.AccountNumber == number {
+			return t.GetAccountByID(id)
+		}
+	}
+
+	return nil, notFoundError("account %d not found", number)
+}
+
+// LockAccounts only checks that the accounts exist
+// The store's write lock is already held for the whole unit of work
+func (t *memoryTx) LockAccounts(ids ...int) error {
+	for _, id := range ids {
+		if _, err := t.account(id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SetAccountStatus moves an account to a new lifecycle status
+func (t *memoryTx) SetAccountStatus(id int, status AccountStatus, at time.Time) error {
+	acc, err := t.account(id)
+	if err != nil {
+		return err
+	}
+
+	acc.Status = status
+	if status == StatusClosed && acc.ClosedAt == nil {
+		acc.ClosedAt = &at
+	}
+	acc.Version++
+	return nil
+}
+
+// MarkAccountDeleted soft-deletes an account
+func (t *memoryTx) MarkAccountDeleted(id int, at time.Time) error {
+	acc, err := t.account(id)
+	if err != nil {
+		return err
+	}
+
+	acc.DeletedAt = &at
+	acc.Version++
+	return nil
+}
+
+// GetBalance gets the balance of an account, including any buffered change
+func (t *memoryTx) GetBalance(id int) (int64, error) {
+	acc, err := t.account(id)
+	if err != nil {
+		return 0, err
+	}
+
+	return acc.Balance, nil
+}
+
+// AddBalance adds an amount to the balance of an account
+func (t *memoryTx) AddBalance(id int, amount int64) error {
+	acc, err := t.account(id)
+	if err != nil {
+		return err
+	}
+
+	acc.Balance += amount
+	return nil
+}
+
+// SubtractBalance subtracts an amount from the balance of an account
+func (t *memoryTx) SubtractBalance(id int, amount int64) error {
+	acc, err := t.account(id)
+	if err != nil {
+		return err
+	}
+
+	acc.Balance -= amount
+	return nil
+}
+
+// RecordTransfer buffers a transfer and its postings for the journal
+func (t *memoryTx) RecordTransfer(kind string, fromAcc *int, toAcc int, amount int64) (*Transfer, error) {
+	transfer := t.s.newTransfer(kind, fromAcc, toAcc, amount)
+	t.transfers = append(t.transfers, transfer)
+
+	return copyTransfer(transfer, true), nil
+}
+
+// copyAccount returns a copy of an account that shares no memory with the original
+func copyAccount(acc *Account) *Account {
+	copied := *acc
+	copied.Roles = append([]Role(nil), acc.Roles...)
+	if acc.ClosedAt != nil {
+		closedAt := *acc.ClosedAt
+		copied.ClosedAt = &closedAt
+	}
+	if acc.DeletedAt != nil {
+		deletedAt := *acc.DeletedAt
+		copied.DeletedAt = &deletedAt
+	}
+	if acc.TokensValidAfter != nil {
+		validAfter := *acc.TokensValidAfter
+		copied.TokensValidAfter = &validAfter
+	}
+	return &copied
+}
+
+// withAccountNumbers fills in the current account numbers of both sides of a copied transfer
+// The caller must hold the lock
+func (s *MemoryStore) withAccountNumbers(t *Transfer) *Transfer {
+	if t.FromAccountID != nil {
+		if acc, ok := s.accounts[*t.FromAccountID]; ok {
+			number := acc.AccountNumber
+			t.FromAccountNumber = &number
+		}
+	}
+	if acc, ok := s.accounts[t.ToAccountID]; ok {
+		t.ToAccountNumber = acc.AccountNumber
+	}
+	return t
+}
+
+// copyTransfer returns a deep copy of a transfer, optionally with its postings
+func copyTransfer(t *Transfer, withPostings bool) *Transfer {
+	copied := *t
+	copied.FromAccountID = copyID(t.FromAccountID)
+	copied.Postings = nil
+	if withPostings {
+		for _, p := range t.Postings {
+			posting := *p
+			posting.AccountID = copyID(p.AccountID)
+			copied.Postings = append(copied.Postings, &posting)
+		}
+	}
+	return &copied
+}
+
+func copyID(id *int) *int {
+	if id == nil {
+		return nil
+	}
+	v := *id
+	return &v
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// Callers get copies, so changing what they were given doesn't change the store
+func TestMemoryStoreReturnsCopies(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	acc := createTestAccount(t, store, "Copy", "Cat", 100, RoleCustomer)
+
+	got, err := store.GetAccountByID(ctx, acc.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got.Balance = 1000000
+	got.Roles[0] = RoleSuperAdmin
+
+	again, err := store.GetAccountByID(ctx, acc.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Balance != 100 || again.Roles[0] != RoleCustomer {
+		t.Errorf("stored account changed to balance %d and roles %v", again.Balance, again.Roles)
+	}
+}
+
+// Nothing done in a unit of work is kept if it fails
+func TestMemoryStoreWithTxRollsBack(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	accounts := createTestAccounts(t, store, 2, 100)
+	from, to := accounts[0], accounts[1]
+
+	errBoom := errors.New("boom")
+	err := store.WithTx(ctx, func(tx TxStore) error {
+		if err := tx.SubtractBalance(from.ID, 50); err != nil {
+			return err
+		}
+		if err := tx.AddBalance(to.ID, 50); err != nil {
+			return err
+		}
+		if _, err := tx.RecordTransfer(TransferKindTransfer, &from.ID, to.ID, 50); err != nil {
+			return err
+		}
+		return errBoom
+	})
+	if !errors.Is(err, errBoom) {
+		t.Fatalf("got error %v, want the one from the unit of work", err)
+	}
+
+	for _, acc := range accounts {
+		got, err := store.GetAccountByID(ctx, acc.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ledger, err := store.GetLedgerBalance(ctx, acc.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Balance != 100 || ledger != 100 {
+			t.Errorf("account %d has balance %d and ledger %d after a rollback, want 100", acc.ID, got.Balance, ledger)
+		}
+	}
+
+	// A cancelled context keeps the changes from being applied as well
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	err = store.WithTx(cancelled, func(tx TxStore) error {
+		return tx.AddBalance(to.ID, 50)
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got error %v, want context.Canceled", err)
+	}
+}
+
+func TestMemoryStoreAccounts(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	first := createTestAccount(t, store, "First", "Holder", 0, RoleCustomer)
+
+	// A taken number is swapped for a new one, like the unique constraint in Postgres
+	dup, err := NewAccount("Second", "Holder", "password", []Role{RoleCustomer})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dup.AccountNumber = first.AccountNumber
+	second, err := store.CreateAccount(ctx, dup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.AccountNumber == first.AccountNumber || second.ID == first.ID {
+		t.Errorf("second account got id %d and number %d, same as the first", second.ID, second.AccountNumber)
+	}
+
+	got, err := store.GetAccountByNumber(ctx, int(second.AccountNumber))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != second.ID {
+		t.Errorf("looking up number %d found account %d, want %d", second.AccountNumber, got.ID, second.ID)
+	}
+
+	if _, err := store.GetAccountByID(ctx, 999); !isErrorCode(err, CodeNotFound) {
+		t.Errorf("unknown id got %v, want not found", err)
+	}
+	if _, err := store.GetAccountByNumber(ctx, 1234567897); !isErrorCode(err, CodeNotFound) {
+		t.Errorf("unknown number got %v, want not found", err)
+	}
+
+	// Updates bump the version and refuse a stale one or a taken number
+	updated, err := store.UpdateAccountByID(ctx, first.ID, &Account{FirstName: "Renamed", LastName: "Holder", AccountNumber: first.AccountNumber, Roles: first.Roles, Version: first.Version})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.FirstName != "Renamed" || updated.Version != first.Version+1 {
+		t.Errorf("update gave name %q and version %d", updated.FirstName, updated.Version)
+	}
+	_, err = store.UpdateAccountByID(ctx, first.ID, &Account{FirstName: "Stale", LastName: "Holder", AccountNumber: first.AccountNumber, Roles: first.Roles, Version: first.Version})
+	if !isErrorCode(err, CodeVersionMismatch) {
+		t.Errorf("stale update got %v, want a version mismatch", err)
+	}
+	_, err = store.UpdateAccountByID(ctx, first.ID, &Account{FirstName: "Taken", LastName: "Holder", AccountNumber: second.AccountNumber, Roles: first.Roles})
+	if !isErrorCode(err, CodeConflict) {
+		t.Errorf("taking another account's number got %v, want a conflict", err)
+	}
+}
+
+func TestNewStore(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Store = "memory"
+	store, err := newStore(cfg, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.(*MemoryStore); !ok {
+		t.Errorf("store=memory gave a %T", store)
+	}
+
+	cfg.Store = "sqlite"
+	if _, err := newStore(cfg, false); err == nil {
+		t.Error("an unknown store didn't fail")
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+// Two-factor authentication with TOTP, see totp.go for the codes themselves
+// Accounts with it on log in in two steps: /login checks the password and returns a short-lived
+// MFA token, and /login/mfa exchanges that token and a code for the real tokens.
+// Admin accounts can't use their permissions until they have logged in with a second factor, and
+// transfers of stepUpTransferAmount or more need a code in the X-MFA-Code header
+const (
+	tokenTypeAccess       = "Bearer"
+	tokenTypeMFAChallenge = "mfa_challenge"
+	mfaChallengeTTL       = 5 * time.Minute
+
+	stepUpTransferAmount = 10000
+	stepUpHeader         = "X-MFA-Code"
+)
+
+// Helper for making the token returned by the first step of an MFA login
+// It can't be used as an access token, only exchanged at /login/mfa
+func createMFAChallenge(keys *Keyring, account *Account) (string, error) {
+	jti, err := randomToken(16)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"account_number": account.AccountNumber,
+		"user_id":        account.ID,
+		"iat":            now.Unix(),
+		"iat_us":         now.UnixMicro(),
+		"exp":            now.Add(mfaChallengeTTL).Unix(),
+		"jti":            jti,
+		"token_type":     tokenTypeMFAChallenge,
+	}
+	return keys.Sign(claims)
+}
+
+// Helper for validating an MFA token from the first step of a login
+func parseMFAChallenge(ctx context.Context, keys *Keyring, s Storage, tokenStr string) (*jwt.Token, error) {
+	token, err := validateJWTToken(ctx, keys, tokenStr, s)
+	if err != nil && !isErrorCode(err, CodeUnauthorized) {
+		return nil, err
+	}
+	if err != nil || !token.Valid || tokenType(token) != tokenTypeMFAChallenge {
+		return nil, unauthorizedError("invalid or expired mfa token")
+	}
+	return token, nil
+}
+
+// Helper for getting the type of a token from its claims
+func tokenType(token *jwt.Token) string {
+	claims := token.Claims.(jwt.MapClaims)
+	t, _ := claims["token_type"].(string)
+	return t
+}
+
+// Helper for the context the account's TOTP secret is encrypted with
+func mfaSecretContext(accountID int) string {
+	return "mfa_secret:account:" + strconv.Itoa(accountID)
+}
+
+// verifySecondFactor checks a TOTP code, or a recovery code once two-factor authentication is on
+// Codes are used up as they are accepted, so the same code can't be used twice
+func verifySecondFactor(ctx context.Context, s Storage, box *SecretBox, account *Account, code string) (bool, error) {
+	if account.MFASecret == "" {
+		return false, nil
+	}
+
+	secret, err := box.Open(account.MFASecret, mfaSecretContext(account.ID))
+	if err != nil {
+		return false, err
+	}
+	if step, ok := verifyTOTP(secret, code, time.Now()); ok {
+		return s.UseTOTPStep(ctx, account.ID, step)
+	}
+
+	if !account.MFAEnabled {
+		return false, nil
+	}
+	return s.UseRecoveryCode(ctx, account.ID, hashToken(normalizeRecoveryCode(code)))
+}
+
+// checkSecondFactor verifies a code for an account, with the same throttling as passwords
+// Wrong codes count as failed logins against the account number and IP, see loginguard.go
+// While throttled it sets Retry-After on w and returns a 429
+func checkSecondFactor(s Storage, box *SecretBox, w http.ResponseWriter, r *http.Request, account *Account, code string) error {
+	guard := newLoginGuard(s, r, account.AccountNumber)
+	wait, err := guard.Reserve()
+	if err != nil {
+		return fmt.Errorf("error checking login attempts: %w", err)
+	}
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		return tooManyRequestsError("too many failed attempts, try again later")
+	}
+
+	ok, err := verifySecondFactor(r.Context(), s, box, account, code)
+	if err != nil {
+		return fmt.Errorf("error checking two-factor code: %w", err)
+	}
+	if !ok {
+		if err := guard.Failed("wrong two-factor code"); err != nil {
+			return fmt.Errorf("error recording login attempt: %w", err)
+		}
+		return unauthorizedError("invalid two-factor code")
+	}
+	if err := guard.Passed(); err != nil {
+		return fmt.Errorf("error recording login attempt: %w", err)
+	}
+	return nil
+}
+
+// mfaRequired reports whether an account may only use its permissions after a second factor
+func mfaRequired(account *Account) bool {
+	return account.HasRole(RoleAdmin) || account.HasRole(RoleSuperAdmin)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Helper for turning on two-factor authentication for the account a token belongs to
+// Returns the recovery codes, which tests log in with since a TOTP code only works once
+func enableMFA(t *testing.T, h http.Handler, token string) []string {
+	t.Helper()
+	rec := doJSON(t, h, http.MethodPost, "/mfa/enroll", token, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("enrolling got status %d: %s", rec.Code, rec.Body)
+	}
+	var enroll MFAEnrollResponse
+	decodeResponse(t, rec, &enroll)
+
+	code, err := totpCode(enroll.Secret, totpStep(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec = doJSON(t, h, http.MethodPost, "/mfa/confirm", token, MFACodeRequest{Code: code})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("confirming got status %d: %s", rec.Code, rec.Body)
+	}
+	var codes MFARecoveryCodesResponse
+	decodeResponse(t, rec, &codes)
+	return codes.RecoveryCodes
+}
+
+// Helper for the first step of logging in to an account with two-factor authentication
+func loginMFAChallenge(t *testing.T, h http.Handler, account *Account) string {
+	t.Helper()
+	rec := doJSON(t, h, http.MethodPost, "/login", "", LoginRequest{AccountNumber: account.AccountNumber, Password: "password"})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("login got status %d: %s", rec.Code, rec.Body)
+	}
+	var challenge MFAChallengeResponse
+	decodeResponse(t, rec, &challenge)
+	if !challenge.MFARequired || challenge.MFAToken == "" {
+		t.Fatalf("login didn't ask for a second factor: %s", rec.Body)
+	}
+	return challenge.MFAToken
+}
+
+// Helper for logging in to an account that needs two-factor authentication, like an admin
+// Two-factor authentication is turned on first, and the login uses a recovery code
+func loginWithMFA(t *testing.T, h http.Handler, account *Account) string {
+	t.Helper()
+	recovery := enableMFA(t, h, login(t, h, account))
+	challenge := loginMFAChallenge(t, h, account)
+	rec := doJSON(t, h, http.MethodPost, "/login/mfa", "", MFALoginRequest{MFAToken: challenge, Code: recovery[0]})
+	var resp LoginResponse
+	decodeResponse(t, rec, &resp)
+	return resp.Token
+}
+
+// A wrong code makes the next one wait, and the 429 says for how long
+func TestSecondFactorThrottled(t *testing.T) {
+	h, _, accounts := newTestServer(t)
+	recovery := enableMFA(t, h, login(t, h, accounts[0]))
+	challenge := loginMFAChallenge(t, h, accounts[0])
+
+	rec := doJSON(t, h, http.MethodPost, "/login/mfa", "", MFALoginRequest{MFAToken: challenge, Code: "not-a-code"})
+	expectError(t, rec, http.StatusUnauthorized, CodeUnauthorized)
+
+	rec = doJSON(t, h, http.MethodPost, "/login/mfa", "", MFALoginRequest{MFAToken: challenge, Code: recovery[0]})
+	expectError(t, rec, http.StatusTooManyRequests, CodeTooManyRequests)
+	if seconds, err := strconv.Atoi(rec.Header().Get("Retry-After")); err != nil || seconds < 1 {
+		t.Errorf("got Retry-After %q, want a number of seconds", rec.Header().Get("Retry-After"))
+	}
+	var apiErr ApiError
+	if err := json.Unmarshal(rec.Body.Bytes(), &apiErr); err != nil {
+		t.Fatal(err)
+	}
+	if apiErr.Error != "too many failed attempts, try again later" {
+		t.Errorf("got message %q", apiErr.Error)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestLoadEmbeddedMigrations(t *testing.T) {
+	migrations, err := loadMigrations(migrationFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) == 0 {
+		t.Fatal("no migrations were embedded")
+	}
+	for i, mig := range migrations {
+		if mig.Version != i+1 {
+			t.Errorf("migration %d has version %d, versions must run 1, 2, 3...", i, mig.Version)
+		}
+		sum := sha256.Sum256([]byte(mig.Up))
+		if mig.Checksum != hex.EncodeToString(sum[:]) {
+			t.Errorf("migration %d_%s has checksum %s, which isn't of its up script", mig.Version, mig.Name, mig.Checksum)
+		}
+	}
+}
+
+func TestLoadMigrationsRejectsBadFiles(t *testing.T) {
+	up := &fstest.MapFile{Data: []byte("SELECT 1;")}
+	tests := []struct {
+		name  string
+		files fstest.MapFS
+		err   string
+	}{
+		{"no down script", fstest.MapFS{"migrations/0001_a.up.sql": up}, "needs both"},
+		{"no up script", fstest.MapFS{"migrations/0001_a.down.sql": up}, "needs both"},
+		{"no name", fstest.MapFS{"migrations/0001.up.sql": up}, "must be named"},
+		{"bad version", fstest.MapFS{"migrations/first_a.up.sql": up}, "invalid version"},
+		{"version zero", fstest.MapFS{"migrations/0000_a.up.sql": up}, "invalid version"},
+		{"bad suffix", fstest.MapFS{"migrations/0001_a.sql": up}, "must end in"},
+		{"two names", fstest.MapFS{"migrations/0001_a.up.sql": up, "migrations/0001_b.down.sql": up}, "two names"},
+	}
+	for _, tt := range tests {
+		_, err := loadMigrations(tt.files)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: got error %v, want one containing %q", tt.name, err, tt.err)
+		}
+	}
+
+	// Versions sort as numbers, whatever order the files come in
+	migrations, err := loadMigrations(fstest.MapFS{
+		"migrations/10_c.up.sql":   up,
+		"migrations/10_c.down.sql": up,
+		"migrations/2_b.up.sql":    up,
+		"migrations/2_b.down.sql":  up,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) != 2 || migrations[0].Version != 2 || migrations[1].Version != 10 {
+		t.Errorf("got migrations in the wrong order: %d, %d", migrations[0].Version, migrations[1].Version)
+	}
+}
+
+// Up, down and up again, and a migration edited after it ran is refused
+func TestPostgresMigrations(t *testing.T) {
+	store := newPostgresTestStore(t)
+	ctx := context.Background()
+	migrator, err := store.Migrator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	latest := migrator.migrations[len(migrator.migrations)-1]
+
+	// Applying again changes nothing
+	if err := migrator.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkSchema(store, false); err != nil {
+		t.Errorf("schema is up to date but the check failed: %v", err)
+	}
+
+	if err := migrator.Down(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	statuses, err := migrator.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, status := range statuses {
+		if pending := status.AppliedAt == nil; pending != (status.Version == latest.Version) {
+			t.Errorf("after going down one, migration %d_%s has applied at %v", status.Version, status.Name, status.AppliedAt)
+		}
+	}
+	if err := checkSchema(store, false); err == nil || !strings.Contains(err.Error(), latest.Name) {
+		t.Errorf("schema with a pending migration got %v, want an error naming it", err)
+	}
+	if err := migrator.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	edited := make([]*migration, len(migrator.migrations))
+	for i, mig := range migrator.migrations {
+		copied := *mig
+		edited[i] = &copied
+	}
+	edited[0].Checksum = strings.Repeat("0", 64)
+	tampered := &Migrator{db: store.db, migrations: edited}
+	if _, err := tampered.Status(ctx); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("edited migration got %v, want a checksum mismatch", err)
+	}
+
+	unknown := &Migrator{db: store.db, migrations: migrator.migrations[:len(migrator.migrations)-1]}
+	if err := unknown.Up(ctx); err == nil || !strings.Contains(err.Error(), "unknown to this binary") {
+		t.Errorf("binary missing an applied migration got %v, want an error", err)
+	}
+}
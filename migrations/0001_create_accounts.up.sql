@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS accounts(
+	id SERIAL PRIMARY KEY,
+	first_name varchar(50) NOT NULL,
+	last_name varchar(50) NOT NULL,
+	account_number BIGINT NOT NULL,
+	encrypted_password varchar(100) NOT NULL,
+	balance BIGINT NOT NULL,
+	created_at timestamp,
+	is_admin boolean DEFAULT false
+);
@@ -0,0 +1,36 @@
+-- Double-entry journal. Every movement of money is a row in transfers with exactly
+-- two rows in postings whose amounts sum to zero. A posting with a NULL account_id
+-- is the outside world, which is used for opening deposits.
+CREATE TABLE IF NOT EXISTS transfers(
+	id SERIAL PRIMARY KEY,
+	kind varchar(20) NOT NULL,
+	from_account_id INTEGER REFERENCES accounts(id),
+	to_account_id INTEGER NOT NULL REFERENCES accounts(id),
+	amount BIGINT NOT NULL CHECK (amount > 0),
+	created_at timestamp NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS postings(
+	id SERIAL PRIMARY KEY,
+	transfer_id INTEGER NOT NULL REFERENCES transfers(id),
+	account_id INTEGER REFERENCES accounts(id),
+	amount BIGINT NOT NULL,
+	created_at timestamp NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS postings_account_id_idx ON postings(account_id);
+CREATE INDEX IF NOT EXISTS postings_transfer_id_idx ON postings(transfer_id);
+
+-- Accounts that already have a balance but no postings get an opening deposit
+-- so that the journal reconciles with accounts.balance
+WITH opening AS (
+	INSERT INTO transfers (kind, to_account_id, amount, created_at)
+	SELECT 'deposit', a.id, a.balance, now() FROM accounts a
+	WHERE a.balance > 0
+	AND NOT EXISTS (SELECT 1 FROM postings p WHERE p.account_id = a.id)
+	RETURNING id, to_account_id, amount, created_at
+)
+INSERT INTO postings (transfer_id, account_id, amount, created_at)
+SELECT id, to_account_id, amount, created_at FROM opening
+UNION ALL
+SELECT id, NULL, -amount, created_at FROM opening;
@@ -0,0 +1,10 @@
+-- Stored responses for requests made with an Idempotency-Key header
+CREATE TABLE IF NOT EXISTS idempotency_keys(
+	account_id INTEGER NOT NULL REFERENCES accounts(id),
+	idempotency_key varchar(255) NOT NULL,
+	request_hash char(64) NOT NULL,
+	status_code INTEGER NOT NULL DEFAULT 0,
+	response_body bytea,
+	created_at timestamp NOT NULL,
+	PRIMARY KEY (account_id, idempotency_key)
+);
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS accounts_status_idx;
+ALTER TABLE accounts DROP COLUMN deleted_at;
+ALTER TABLE accounts DROP COLUMN closed_at;
+ALTER TABLE accounts DROP COLUMN status;
@@ -0,0 +1,8 @@
+-- Account lifecycle. Accounts are never hard-deleted so their history survives:
+-- closing sets closed_at and deleting additionally sets deleted_at
+ALTER TABLE accounts ADD COLUMN status varchar(20) NOT NULL DEFAULT 'active'
+	CHECK (status IN ('pending', 'active', 'frozen', 'closed'));
+ALTER TABLE accounts ADD COLUMN closed_at timestamp;
+ALTER TABLE accounts ADD COLUMN deleted_at timestamp;
+
+CREATE INDEX accounts_status_idx ON accounts(status);
@@ -0,0 +1 @@
+ALTER TABLE accounts DROP CONSTRAINT IF EXISTS accounts_account_number_key;
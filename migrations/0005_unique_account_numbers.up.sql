@@ -0,0 +1,11 @@
+-- Account numbers must be unique now that logins and transfers look accounts up by them.
+-- Duplicates left over from the old random numbers have to be fixed by hand first.
+-- Numbers issued before check digits were added stay as they are, see AcceptedAccountNumber.
+DO $$
+BEGIN
+	IF EXISTS (SELECT account_number FROM accounts GROUP BY account_number HAVING COUNT(*) > 1) THEN
+		RAISE EXCEPTION 'duplicate account numbers exist, resolve them before applying this migration';
+	END IF;
+END $$;
+
+ALTER TABLE accounts ADD CONSTRAINT accounts_account_number_key UNIQUE (account_number);
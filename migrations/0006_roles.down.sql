@@ -0,0 +1,7 @@
+ALTER TABLE accounts ADD COLUMN is_admin boolean DEFAULT false;
+
+UPDATE accounts SET is_admin = true
+WHERE id IN (SELECT account_id FROM account_roles WHERE role = 'admin');
+
+DROP TABLE IF EXISTS account_roles;
+DROP TABLE IF EXISTS roles;
@@ -0,0 +1,22 @@
+-- Roles replace the single is_admin flag. What each role may do is defined in authz.go
+CREATE TABLE roles(
+	name varchar(20) PRIMARY KEY,
+	description text NOT NULL
+);
+
+INSERT INTO roles (name, description) VALUES
+	('customer', 'Manages their own account'),
+	('teller', 'Serves customers: opens, updates and freezes accounts and moves money'),
+	('auditor', 'Reads every account and transaction, changes nothing'),
+	('admin', 'Can do anything, including assigning roles');
+
+CREATE TABLE account_roles(
+	account_id INTEGER NOT NULL REFERENCES accounts(id),
+	role varchar(20) NOT NULL REFERENCES roles(name),
+	PRIMARY KEY (account_id, role)
+);
+
+INSERT INTO account_roles (account_id, role)
+SELECT id, CASE WHEN COALESCE(is_admin, false) THEN 'admin' ELSE 'customer' END FROM accounts;
+
+ALTER TABLE accounts DROP COLUMN is_admin;
@@ -0,0 +1,21 @@
+-- Rotating refresh tokens. Only a hash of each token is stored.
+-- Tokens descending from one login share a family_id so a reused token can revoke them all.
+CREATE TABLE refresh_tokens(
+	id SERIAL PRIMARY KEY,
+	account_id INTEGER NOT NULL REFERENCES accounts(id),
+	family_id varchar(64) NOT NULL,
+	token_hash char(64) NOT NULL UNIQUE,
+	expires_at timestamp NOT NULL,
+	created_at timestamp NOT NULL,
+	used_at timestamp,
+	revoked_at timestamp
+);
+
+CREATE INDEX refresh_tokens_family_id_idx ON refresh_tokens(family_id);
+
+-- Access tokens revoked before they expire, by jti
+-- Rows can be removed once expires_at has passed since the token is dead anyway
+CREATE TABLE revoked_tokens(
+	jti varchar(64) PRIMARY KEY,
+	expires_at timestamp NOT NULL
+);
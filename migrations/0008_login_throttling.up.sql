@@ -0,0 +1,20 @@
+-- Failed login attempts, keyed by "account:<number>" or "ip:<address>"
+-- Kept in the database so lockouts survive restarts
+CREATE TABLE login_throttles(
+	throttle_key varchar(100) PRIMARY KEY,
+	failures INTEGER NOT NULL,
+	last_failure_at timestamp NOT NULL,
+	locked_until timestamp
+);
+
+-- Security relevant events such as failed logins, lockouts and unlocks, for review
+CREATE TABLE security_events(
+	id SERIAL PRIMARY KEY,
+	kind varchar(50) NOT NULL,
+	account_number bigint,
+	ip varchar(64) NOT NULL DEFAULT '',
+	detail text NOT NULL DEFAULT '',
+	created_at timestamp NOT NULL
+);
+
+CREATE INDEX security_events_account_number_idx ON security_events(account_number, id);
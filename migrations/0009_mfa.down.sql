@@ -0,0 +1,5 @@
+ALTER TABLE refresh_tokens DROP COLUMN IF EXISTS mfa;
+DROP TABLE IF EXISTS mfa_recovery_codes;
+ALTER TABLE accounts DROP COLUMN IF EXISTS mfa_last_step;
+ALTER TABLE accounts DROP COLUMN IF EXISTS mfa_enabled;
+ALTER TABLE accounts DROP COLUMN IF EXISTS mfa_secret;
@@ -0,0 +1,17 @@
+-- TOTP two-factor authentication
+-- mfa_secret is encrypted by the application, see secretbox.go. mfa_last_step stops a code being replayed
+ALTER TABLE accounts ADD COLUMN mfa_secret text;
+ALTER TABLE accounts ADD COLUMN mfa_enabled boolean NOT NULL DEFAULT false;
+ALTER TABLE accounts ADD COLUMN mfa_last_step bigint;
+
+-- Single-use recovery codes for when the authenticator is lost. Only hashes are stored
+CREATE TABLE mfa_recovery_codes(
+	id SERIAL PRIMARY KEY,
+	account_id INTEGER NOT NULL REFERENCES accounts(id),
+	code_hash char(64) NOT NULL,
+	used_at timestamp,
+	UNIQUE (account_id, code_hash)
+);
+
+-- Whether the login a refresh token family came from passed two-factor authentication
+ALTER TABLE refresh_tokens ADD COLUMN mfa boolean NOT NULL DEFAULT false;
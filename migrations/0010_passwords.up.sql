@@ -0,0 +1,14 @@
+-- Access tokens issued before this are rejected, it is set when the password changes
+ALTER TABLE accounts ADD COLUMN tokens_valid_after timestamp;
+
+-- Single-use password reset tokens issued by admins. Only hashes are stored
+CREATE TABLE password_reset_tokens(
+	id SERIAL PRIMARY KEY,
+	account_id INTEGER NOT NULL REFERENCES accounts(id),
+	token_hash char(64) NOT NULL UNIQUE,
+	expires_at timestamp NOT NULL,
+	created_at timestamp NOT NULL,
+	used_at timestamp
+);
+
+CREATE INDEX password_reset_tokens_account_id_idx ON password_reset_tokens(account_id);
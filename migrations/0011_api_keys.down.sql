@@ -0,0 +1,10 @@
+-- Stored responses for API keys have no account to go back to
+DELETE FROM idempotency_keys WHERE caller NOT LIKE 'account:%';
+ALTER TABLE idempotency_keys ADD COLUMN account_id INTEGER REFERENCES accounts(id);
+UPDATE idempotency_keys SET account_id = substring(caller from 9)::integer;
+ALTER TABLE idempotency_keys ALTER COLUMN account_id SET NOT NULL;
+ALTER TABLE idempotency_keys DROP CONSTRAINT idempotency_keys_pkey;
+ALTER TABLE idempotency_keys DROP COLUMN caller;
+ALTER TABLE idempotency_keys ADD PRIMARY KEY (account_id, idempotency_key);
+
+DROP TABLE IF EXISTS api_keys;
@@ -0,0 +1,24 @@
+-- API keys for services. Only a hash of each key is stored, prefix is the start of the key
+-- An empty account_ids means the key isn't limited to particular accounts
+CREATE TABLE api_keys(
+	id SERIAL PRIMARY KEY,
+	name varchar(100) NOT NULL,
+	prefix varchar(32) NOT NULL UNIQUE,
+	key_hash char(64) NOT NULL,
+	permissions text[] NOT NULL,
+	account_ids integer[] NOT NULL DEFAULT '{}',
+	created_by INTEGER NOT NULL REFERENCES accounts(id),
+	created_at timestamp NOT NULL,
+	expires_at timestamp,
+	last_used_at timestamp,
+	revoked_at timestamp
+);
+
+-- Idempotency keys were scoped to an account, now they are scoped to the caller
+-- which is either 'account:<id>' or 'api_key:<id>'
+ALTER TABLE idempotency_keys ADD COLUMN caller varchar(64);
+UPDATE idempotency_keys SET caller = 'account:' || account_id;
+ALTER TABLE idempotency_keys ALTER COLUMN caller SET NOT NULL;
+ALTER TABLE idempotency_keys DROP CONSTRAINT idempotency_keys_pkey;
+ALTER TABLE idempotency_keys DROP COLUMN account_id;
+ALTER TABLE idempotency_keys ADD PRIMARY KEY (caller, idempotency_key);
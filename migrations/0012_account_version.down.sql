@@ -0,0 +1,4 @@
+DELETE FROM account_roles WHERE role = 'superadmin';
+DELETE FROM roles WHERE name = 'superadmin';
+
+ALTER TABLE accounts DROP COLUMN version;
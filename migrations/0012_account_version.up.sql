@@ -0,0 +1,8 @@
+-- version is bumped whenever an account's details, roles or status change
+-- Clients send it back in If-Match so two edits can't silently overwrite each other
+ALTER TABLE accounts ADD COLUMN version INTEGER NOT NULL DEFAULT 1;
+
+-- Superadmins are admins who can also grant and revoke the admin and superadmin roles
+-- No account gets it here, promote the first one directly in the database
+INSERT INTO roles (name, description) VALUES
+	('superadmin', 'Grants and revokes the admin and superadmin roles');
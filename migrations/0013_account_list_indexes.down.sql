@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS account_roles_role_idx;
+DROP INDEX IF EXISTS accounts_last_name_prefix_idx;
+DROP INDEX IF EXISTS accounts_first_name_prefix_idx;
+DROP INDEX IF EXISTS accounts_last_name_id_idx;
+DROP INDEX IF EXISTS accounts_balance_id_idx;
+DROP INDEX IF EXISTS accounts_created_at_id_idx;
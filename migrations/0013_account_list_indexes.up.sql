@@ -0,0 +1,8 @@
+-- Indexes for listing accounts, see GetAccounts
+-- Each sort order pages with a keyset on (column, id), and names are searched by lower case prefix
+CREATE INDEX accounts_created_at_id_idx ON accounts (created_at, id);
+CREATE INDEX accounts_balance_id_idx ON accounts (balance, id);
+CREATE INDEX accounts_last_name_id_idx ON accounts (last_name, id);
+CREATE INDEX accounts_first_name_prefix_idx ON accounts (lower(first_name) text_pattern_ops);
+CREATE INDEX accounts_last_name_prefix_idx ON accounts (lower(last_name) text_pattern_ops);
+CREATE INDEX account_roles_role_idx ON account_roles (role);
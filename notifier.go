@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Notification is a message for an account holder, like a password reset link
+type Notification struct {
+	AccountID     int       `json:"account_id"`
+	AccountNumber int64     `json:"account_number"`
+	Subject       string    `json:"subject"`
+	Body          string    `json:"body"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// Notifier delivers notifications to account holders
+// Real delivery (email, SMS) can be added by implementing this
+type Notifier interface {
+	Notify(Notification) error
+}
+
+// NewNotifier creates the notifier picked with the NOTIFIER setting
+// "log" (the default) writes to the server log, "file" appends JSON lines to path
+func NewNotifier(kind, path string) (Notifier, error) {
+	switch kind {
+	case "", "log":
+		return LogNotifier{}, nil
+	case "file":
+		if path == "" {
+			return nil, fmt.Errorf("NOTIFY_FILE must be set when NOTIFIER is file")
+		}
+		return &FileNotifier{path: path}, nil
+	default:
+		return nil, fmt.Errorf("unknown notifier %q, must be log or file", kind)
+	}
+}
+
+// LogNotifier writes notifications to the server log
+// Only meant for local development since the log would hold reset tokens
+type LogNotifier struct{}
+
+// Notify writes the notification to the log
+func (LogNotifier) Notify(n Notification) error {
+	log.Printf("NOTIFY account %d: %s\n%s", n.AccountNumber, n.Subject, n.Body)
+	return nil
+}
+
+// FileNotifier appends notifications to a file as JSON lines
+// Useful for picking up reset tokens in tests and local development
+type FileNotifier struct {
+	mu   sync.Mutex
+	path string
+}
+
+// Notify appends the notification to the file
+func (f *FileNotifier) Notify(n Notification) error {
+	line, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	file, err := os.OpenFile(f.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Password policy
+// bcrypt only looks at the first 72 bytes, so longer passwords are refused rather than silently cut short
+const (
+	minPasswordLength = 10
+	maxPasswordLength = 72
+	// How many of lower case, upper case, digits and symbols a password needs
+	minPasswordCharClasses = 3
+
+	passwordResetTTL = time.Hour
+)
+
+// bcrypt work factor for new password hashes, set from the config at startup
+// Existing hashes keep the cost they were made with
+var bcryptCost = bcrypt.DefaultCost
+
+// commonPasswords are refused even if they meet the rest of the policy
+var commonPasswords = map[string]bool{
+	"password123":  true,
+	"password1234": true,
+	"passw0rd123":  true,
+	"qwerty12345":  true,
+	"welcome1234":  true,
+	"letmein1234":  true,
+	"iloveyou123":  true,
+	"admin123456":  true,
+	"p@ssw0rd123":  true,
+	"changeme123":  true,
+}
+
+// checkPasswordPolicy checks a new password for an account
+// The account is used to refuse passwords containing the holder's name or account number
+func checkPasswordPolicy(password string, account *Account) error {
+	if len(password) < minPasswordLength {
+		return validationError("password must be at least %d characters", minPasswordLength)
+	}
+	if len(password) > maxPasswordLength {
+		return validationError("password must be at most %d bytes", maxPasswordLength)
+	}
+
+	var lower, upper, digit, symbol bool
+	for _, c := range password {
+		switch {
+		case unicode.IsLower(c):
+			lower = true
+		case unicode.IsUpper(c):
+			upper = true
+		case unicode.IsDigit(c):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+	classes := 0
+	for _, has := range []bool{lower, upper, digit, symbol} {
+		if has {
+			classes++
+		}
+	}
+	if classes < minPasswordCharClasses {
+		return validationError("password must contain at least %d of lower case letters, upper case letters, digits and symbols", minPasswordCharClasses)
+	}
+
+	lowered := strings.ToLower(password)
+	if commonPasswords[lowered] {
+		return validationError("password is too common")
+	}
+	if account != nil {
+		for _, part := range []string{account.FirstName, account.LastName} {
+			if len(part) >= 3 && strings.Contains(lowered, strings.ToLower(part)) {
+				return validationError("password must not contain your name")
+			}
+		}
+		if account.AccountNumber != 0 && strings.Contains(password, strconv.FormatInt(account.AccountNumber, 10)) {
+			return validationError("password must not contain your account number")
+		}
+	}
+
+	return nil
+}
+
+// Helper for hashing a password to store
+func hashPassword(password string) (string, error) {
+	encpw, err := bcrypt.GenerateFromPassword([]byte(password), bcryptCost)
+	if err != nil {
+		return "", err
+	}
+	return string(encpw), nil
+}
+
+// checkNewPassword checks a password can replace the account's current one
+func checkNewPassword(account *Account, newPassword string) error {
+	if err := checkPasswordPolicy(newPassword, account); err != nil {
+		return err
+	}
+	if account.ComparePassword(newPassword) {
+		return validationError("new password must be different from the current password")
+	}
+	return nil
+}
+
+// changePassword checks and stores a new password for an account
+func changePassword(ctx context.Context, s Storage, account *Account, newPassword string) error {
+	if err := checkNewPassword(account, newPassword); err != nil {
+		return err
+	}
+	return storePassword(ctx, s, account, newPassword)
+}
+
+// storePassword hashes and stores a new password for an account
+// Every refresh token is revoked and access tokens issued before now stop working
+// The time is cut to microseconds, which is what Postgres keeps and what tokens carry
+func storePassword(ctx context.Context, s Storage, account *Account, newPassword string) error {
+	encpw, err := hashPassword(newPassword)
+	if err != nil {
+		return err
+	}
+	return s.SetPassword(ctx, account.ID, encpw, time.Now().UTC().Truncate(time.Microsecond))
+}
+
+// createPasswordResetToken issues a single-use reset token for an account
+// Any earlier unused tokens for the account stop working
+func createPasswordResetToken(ctx context.Context, s Storage, account *Account) (string, *PasswordResetToken, error) {
+	token, err := randomToken(32)
+	if err != nil {
+		return "", nil, err
+	}
+
+	now := time.Now().UTC()
+	rt := &PasswordResetToken{
+		AccountID: account.ID,
+		TokenHash: hashToken(token),
+		ExpiresAt: now.Add(passwordResetTTL),
+		CreatedAt: now,
+	}
+	if err := s.CreatePasswordResetToken(ctx, rt); err != nil {
+		return "", nil, err
+	}
+
+	return token, rt, nil
+}
+
+// resetPassword sets a new password with a reset token
+// The token is only used up once the new password has passed the policy
+func resetPassword(ctx context.Context, s Storage, token, newPassword string) (*Account, error) {
+	rt, err := s.GetPasswordResetTokenByHash(ctx, hashToken(token))
+	if err != nil && !isErrorCode(err, CodeNotFound) {
+		return nil, err
+	}
+	if err != nil || rt.UsedAt != nil || time.Now().After(rt.ExpiresAt) {
+		return nil, unauthorizedError("invalid or expired reset token")
+	}
+
+	account, err := s.GetAccountByID(ctx, rt.AccountID)
+	if isErrorCode(err, CodeNotFound) {
+		return nil, unauthorizedError("invalid or expired reset token")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if account.Status == StatusClosed {
+		return nil, forbiddenError("account is closed")
+	}
+	if err := checkNewPassword(account, newPassword); err != nil {
+		return nil, forField("new_password", err)
+	}
+
+	used, err := s.UsePasswordResetToken(ctx, rt.ID)
+	if err != nil {
+		return nil, err
+	}
+	if !used {
+		return nil, unauthorizedError("invalid or expired reset token")
+	}
+
+	if err := storePassword(ctx, s, account, newPassword); err != nil {
+		return nil, err
+	}
+	return account, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// applyMergePatch applies a JSON Merge Patch (RFC 7386) from the request body to doc
+// doc must be a pointer to a request struct filled in with the current values. The patched
+// result is decoded back into it the same way decodeJSON would, so unknown fields are rejected,
+// a null removes a field and leaves it at its zero value, and the validate tags are checked
+func applyMergePatch(r *http.Request, doc any) error {
+	dec := json.NewDecoder(r.Body)
+	dec.UseNumber()
+	var patch any
+	if err := dec.Decode(&patch); err != nil {
+		return decodeError(err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return validationError("request body must be a single JSON object")
+	}
+	if _, ok := patch.(map[string]any); !ok {
+		return validationError("request body must be a JSON object")
+	}
+
+	current, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	var target any
+	dec = json.NewDecoder(bytes.NewReader(current))
+	dec.UseNumber()
+	if err := dec.Decode(&target); err != nil {
+		return err
+	}
+	merged, err := json.Marshal(mergePatch(target, patch))
+	if err != nil {
+		return err
+	}
+
+	// Start from the zero value so fields removed by the patch don't keep their old values
+	rv := reflect.ValueOf(doc).Elem()
+	rv.Set(reflect.Zero(rv.Type()))
+	dec = json.NewDecoder(bytes.NewReader(merged))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(doc); err != nil {
+		return decodeError(err)
+	}
+	return validateStruct(doc)
+}
+
+// mergePatch is the MergePatch function from RFC 7386 section 2
+func mergePatch(target, patch any) any {
+	patchObj, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	targetObj, ok := target.(map[string]any)
+	if !ok {
+		targetObj = map[string]any{}
+	}
+	for key, value := range patchObj {
+		if value == nil {
+			delete(targetObj, key)
+			continue
+		}
+		targetObj[key] = mergePatch(targetObj[key], value)
+	}
+	return targetObj
+}
+
+// An account's ETag is its version, see Account.Version
+func accountETag(acc *Account) string {
+	return `"` + strconv.Itoa(acc.Version) + `"`
+}
+
+// ifMatchVersion reads the version the client expects from the If-Match header
+// ok is false when there is no header. "*" matches any version and gives 0
+func ifMatchVersion(r *http.Request) (version int, ok bool, err error) {
+	header := strings.TrimSpace(r.Header.Get("If-Match"))
+	if header == "" {
+		return 0, false, nil
+	}
+	if header == "*" {
+		return 0, true, nil
+	}
+
+	unquoted, err := strconv.Unquote(header)
+	if err == nil {
+		version, err = strconv.Atoi(unquoted)
+	}
+	if err != nil || version < 1 {
+		return 0, true, validationError("If-Match must be a single ETag from a previous response")
+	}
+	return version, true, nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// The examples from RFC 7386 appendix A
+func TestMergePatch(t *testing.T) {
+	tests := []struct {
+		target, patch, want string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"a":"foo"}`, `null`, `null`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		{`{"e":null}`, `{"a":1}`, `{"e":null,"a":1}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	}
+	for _, tt := range tests {
+		var target, patch, want any
+		for _, doc := range []struct {
+			src string
+			dst *any
+		}{{tt.target, &target}, {tt.patch, &patch}, {tt.want, &want}} {
+			if err := json.Unmarshal([]byte(doc.src), doc.dst); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := mergePatch(target, patch); !reflect.DeepEqual(got, want) {
+			t.Errorf("merging %s into %s gave %v, want %s", tt.patch, tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestIfMatchVersion(t *testing.T) {
+	tests := []struct {
+		header  string
+		version int
+		ok      bool
+		invalid bool
+	}{
+		{"", 0, false, false},
+		{"*", 0, true, false},
+		{`"3"`, 3, true, false},
+		{` "3" `, 3, true, false},
+		{"3", 0, true, true},
+		{`W/"3"`, 0, true, true},
+		{`"0"`, 0, true, true},
+		{`"3", "4"`, 0, true, true},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPatch, "/", nil)
+		r.Header.Set("If-Match", tt.header)
+		version, ok, err := ifMatchVersion(r)
+		if version != tt.version || ok != tt.ok || (err != nil) != tt.invalid {
+			t.Errorf("If-Match %q gave %d, %v, %v", tt.header, version, ok, err)
+		}
+	}
+}
+
+// Helper for patching an account with an If-Match header
+func patchAccount(t *testing.T, h http.Handler, token string, id int, etag string, patch any) *httptest.ResponseRecorder {
+	t.Helper()
+	headers := map[string]string{}
+	if etag != "" {
+		headers["If-Match"] = etag
+	}
+	return doJSONWithHeaders(t, h, http.MethodPatch, fmt.Sprintf("/account/%d", id), token, patch, headers)
+}
+
+// A patch changes only the fields it names, and only if nobody changed the account
+// since the client read it
+func TestHandlePatchAccount(t *testing.T) {
+	h, store, accounts := newTestServer(t)
+	account := accounts[0]
+	token := login(t, h, createTestAccount(t, store, "Patch", "Teller", 0, RoleTeller))
+	path := fmt.Sprintf("/account/%d", account.ID)
+
+	rec := doJSON(t, h, http.MethodGet, path, token, nil)
+	etag := rec.Header().Get("ETag")
+	if etag != accountETag(account) {
+		t.Fatalf("got ETag %q, want %q", etag, accountETag(account))
+	}
+
+	rec = patchAccount(t, h, token, account.ID, etag, map[string]any{"last_name": "Patched"})
+	var patched Account
+	decodeResponse(t, rec, &patched)
+	if patched.LastName != "Patched" || patched.FirstName != account.FirstName || patched.AccountNumber != account.AccountNumber || !sameRoles(patched.Roles, account.Roles) {
+		t.Errorf("patch changed more than the last name: %+v", patched)
+	}
+	if patched.Version != account.Version+1 || rec.Header().Get("ETag") != accountETag(&patched) {
+		t.Errorf("got version %d and ETag %q after the patch", patched.Version, rec.Header().Get("ETag"))
+	}
+
+	// The response is what was saved
+	var saved Account
+	decodeResponse(t, doJSON(t, h, http.MethodGet, path, token, nil), &saved)
+	if saved.LastName != "Patched" || saved.Version != patched.Version {
+		t.Errorf("saved account is %+v", saved)
+	}
+
+	// The old ETag is out of date, for PATCH and PUT alike
+	rec = patchAccount(t, h, token, account.ID, etag, map[string]any{"first_name": "Lost"})
+	expectError(t, rec, http.StatusPreconditionFailed, CodeVersionMismatch)
+	rec = doJSONWithHeaders(t, h, http.MethodPut, path, token, UpdateAccountRequest{
+		FirstName:     "Lost",
+		LastName:      "Update",
+		AccountNumber: account.AccountNumber,
+		Roles:         account.Roles,
+	}, map[string]string{"If-Match": etag})
+	expectError(t, rec, http.StatusPreconditionFailed, CodeVersionMismatch)
+
+	rec = patchAccount(t, h, token, account.ID, "", map[string]any{"first_name": "Blind"})
+	expectError(t, rec, http.StatusPreconditionRequired, CodeVersionRequired)
+
+	current := accountETag(&patched)
+	tests := []struct {
+		name   string
+		patch  any
+		status int
+		code   ErrorCode
+	}{
+		{"removing the roles", map[string]any{"roles": nil}, http.StatusBadRequest, CodeValidation},
+		{"removing a required field", map[string]any{"first_name": nil}, http.StatusBadRequest, CodeValidation},
+		{"unknown field", map[string]any{"is_admin": true}, http.StatusBadRequest, CodeValidation},
+		{"not an object", []string{"last_name"}, http.StatusBadRequest, CodeValidation},
+		{"changing the account number", map[string]any{"account_number": 1234567897}, http.StatusForbidden, CodeForbidden},
+		{"granting a role", map[string]any{"roles": []Role{RoleCustomer, RoleTeller}}, http.StatusForbidden, CodeForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := patchAccount(t, h, token, account.ID, current, tt.patch)
+			expectError(t, rec, tt.status, tt.code)
+		})
+	}
+}
+
+// Changing the account number and admin roles need more than account:update
+func TestPatchAccountFieldPermissions(t *testing.T) {
+	h, store, accounts := newTestServer(t)
+	account := accounts[0]
+	admin := createTestAccount(t, store, "Patch", "Admin", 0, RoleAdmin)
+	token := loginWithMFA(t, h, admin)
+
+	rec := patchAccount(t, h, token, account.ID, "*", map[string]any{"account_number": 1234567897, "roles": []Role{RoleCustomer, RoleTeller}})
+	var patched Account
+	decodeResponse(t, rec, &patched)
+	if patched.AccountNumber != 1234567897 || !patched.HasRole(RoleTeller) {
+		t.Errorf("admin's patch saved %+v", patched)
+	}
+
+	rec = patchAccount(t, h, token, account.ID, "*", map[string]any{"roles": []Role{RoleCustomer, RoleAdmin}})
+	expectError(t, rec, http.StatusForbidden, CodeForbidden)
+
+	superadmin := createTestAccount(t, store, "Patch", "Superadmin", 0, RoleAdmin, RoleSuperAdmin)
+	rec = patchAccount(t, h, loginWithMFA(t, h, superadmin), account.ID, "*", map[string]any{"roles": []Role{RoleCustomer, RoleAdmin}})
+	if rec.Code != http.StatusOK {
+		t.Errorf("superadmin granting admin got status %d: %s", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+)
+
+// SecretBox encrypts secrets stored in the database, like TOTP secrets, with AES-256-GCM
+// The key comes from MFA_ENCRYPTION_KEY as 32 base64 encoded bytes, e.g. from `openssl rand -base64 32`
+// Each secret is bound to the row it belongs to, so a ciphertext copied to another account won't decrypt
+type SecretBox struct {
+	aead cipher.AEAD
+}
+
+// LoadSecretBox creates the secret box from the MFA_ENCRYPTION_KEY setting
+// It refuses to start without a key rather than store secrets in the clear
+func LoadSecretBox(encoded string) (*SecretBox, error) {
+	if encoded == "" {
+		return nil, fmt.Errorf("MFA_ENCRYPTION_KEY is not set")
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("MFA_ENCRYPTION_KEY is not valid base64: %v", err)
+	}
+	return NewSecretBox(key)
+}
+
+// NewSecretBox creates a secret box with a 32 byte key
+func NewSecretBox(key []byte) (*SecretBox, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("encryption key must be 32 bytes, got %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &SecretBox{aead: aead}, nil
+}
+
+// Seal encrypts a secret for the row named by context
+// The result is the nonce followed by the ciphertext, base64 encoded
+func (b *SecretBox) Seal(plaintext, context string) (string, error) {
+	nonce := make([]byte, b.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := b.aead.Seal(nonce, nonce, []byte(plaintext), []byte(context))
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Open decrypts a secret sealed for the row named by context
+func (b *SecretBox) Open(sealed, context string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return "", err
+	}
+	if len(data) < b.aead.NonceSize() {
+		return "", fmt.Errorf("encrypted secret is too short")
+	}
+	nonce, ciphertext := data[:b.aead.NonceSize()], data[b.aead.NonceSize():]
+	plaintext, err := b.aead.Open(nil, nonce, ciphertext, []byte(context))
+	if err != nil {
+		return "", fmt.Errorf("could not decrypt secret")
+	}
+	return string(plaintext), nil
+}
@@ -1,27 +1,83 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
-	"log"
-	"os"
+	"sort"
+	"strings"
+	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 // Storage is an interface for storing and retrieving accounts
 // All of these methods are required to be implemented
+// Every method takes the context of the request it is for, so a query stops when the client
+// goes away or the request runs out of time
 type Storage interface {
-	CreateAccount(*Account) (*Account, error)
-	DeleteAccount(int) error
-	UpdateAccountByID(int, *Account) (*Account, error)
-	GetAccounts() ([]*Account, error)
+	CreateAccount(context.Context, *Account) (*Account, error)
+	UpdateAccountByID(context.Context, int, *Account) (*Account, error)
+	GetAccounts(context.Context, AccountFilter) ([]*Account, error)
+	CountAccounts(context.Context, AccountFilter) (int, error)
+	GetAccountByID(context.Context, int) (*Account, error)
+	GetAccountByNumber(context.Context, int) (*Account, error)
+	WithTx(context.Context, func(TxStore) error) error
+	GetTransferByID(context.Context, int) (*Transfer, error)
+	GetTransfersByAccount(context.Context, int, TransferFilter) ([]*Transfer, error)
+	GetLedgerBalance(context.Context, int) (int64, error)
+	CreateIdempotencyRecord(context.Context, *IdempotencyRecord) (bool, error)
+	GetIdempotencyRecord(context.Context, string, string) (*IdempotencyRecord, error)
+	CompleteIdempotencyRecord(context.Context, *IdempotencyRecord) error
+	ReclaimIdempotencyRecord(context.Context, *IdempotencyRecord, *IdempotencyRecord) (bool, error)
+	DeleteIdempotencyRecord(context.Context, string, string) error
+	CreateRefreshToken(context.Context, *RefreshToken) error
+	GetRefreshTokenByHash(context.Context, string) (*RefreshToken, error)
+	UseRefreshToken(context.Context, int) (bool, error)
+	RevokeRefreshTokenFamily(context.Context, string) error
+	RevokeAccessToken(context.Context, string, time.Time) error
+	IsAccessTokenRevoked(context.Context, string) (bool, error)
+	GetLoginThrottle(context.Context, string) (*LoginThrottle, error)
+	ReserveLoginAttempt(context.Context, string, time.Time, time.Time) (*LoginThrottle, error)
+	ReleaseLoginAttempt(context.Context, string) error
+	LockLogin(context.Context, string, time.Time) error
+	ClearLoginThrottle(context.Context, string) error
+	RecordSecurityEvent(context.Context, *SecurityEvent) error
+	GetSecurityEvents(context.Context, SecurityEventFilter) ([]*SecurityEvent, error)
+	SetMFASecret(context.Context, int, string) error
+	EnableMFA(context.Context, int, []string) error
+	DisableMFA(context.Context, int) error
+	UseTOTPStep(context.Context, int, int64) (bool, error)
+	UseRecoveryCode(context.Context, int, string) (bool, error)
+	SetPassword(context.Context, int, string, time.Time) error
+	CreatePasswordResetToken(context.Context, *PasswordResetToken) error
+	GetPasswordResetTokenByHash(context.Context, string) (*PasswordResetToken, error)
+	UsePasswordResetToken(context.Context, int) (bool, error)
+	CreateAPIKey(context.Context, *APIKey) error
+	GetAPIKeys(context.Context) ([]*APIKey, error)
+	GetAPIKeyByID(context.Context, int) (*APIKey, error)
+	GetAPIKeyByPrefix(context.Context, string) (*APIKey, error)
+	UpdateAPIKey(context.Context, *APIKey) error
+	RevokeAPIKey(context.Context, int, time.Time) error
+	TouchAPIKey(context.Context, int, time.Time) error
+	Close() error
+}
+
+// TxStore is the unit of work handed to Storage.WithTx
+// Everything done through it is committed together or not at all
+// Its methods use the context given to WithTx, so cancelling that rolls the whole unit back
+// Multi-step operations like MakeTransfer are written against this, not a specific database
+type TxStore interface {
 	GetAccountByID(int) (*Account, error)
-	GetAccountByNumber(int) (*Account, error)
-	GetAdminStatus(int) (bool, error)
-	MakeTransfer(int, int, int) (*Account, error)
-	AddBalanceTx(*sql.Tx, int, int) error
-	SubtractBalanceTx(*sql.Tx, int, int) error
+	GetAccountByNumber(int64) (*Account, error)
+	LockAccounts(...int) error
+	SetAccountStatus(int, AccountStatus, time.Time) error
+	MarkAccountDeleted(int, time.Time) error
+	GetBalance(int) (int64, error)
+	AddBalance(int, int64) error
+	SubtractBalance(int, int64) error
+	RecordTransfer(string, *int, int, int64) (*Transfer, error)
 }
 
 // PostgresStore is an implementation of the Storage interface
@@ -32,18 +88,18 @@ type PostgresStore struct {
 }
 
 // NewPostgresStore creates a new PostgresStore and connects to the database
-func NewPostgresStore() (*PostgresStore, error) {
-	connectionString := os.Getenv("POSTGRES_URL")
+func NewPostgresStore(connectionString string) (*PostgresStore, error) {
 	if connectionString == "" {
-		log.Fatal("POSTGRES_URL environment variable not set")
+		return nil, fmt.Errorf("POSTGRES_URL environment variable not set")
 	}
 	db, err := sql.Open("postgres", connectionString)
 	if err != nil {
-		log.Fatalf("failed to connect to the database: %v", err)
+		return nil, fmt.Errorf("failed to connect to the database: %w", err)
 	}
 
 	if err := db.Ping(); err != nil {
-		return nil, err
+		db.Close()
+		return nil, fmt.Errorf("failed to connect to the database: %w", err)
 	}
 
 	return &PostgresStore{
@@ -51,29 +107,44 @@ func NewPostgresStore() (*PostgresStore, error) {
 	}, nil
 }
 
-// CreateAccountTable creates the accounts table if it doesn't exist\
-// This is called in main.go when the server starts
-func (s *PostgresStore) CreateAccountTable() error {
-	query := `CREATE TABLE if not exists accounts(
-		id SERIAL PRIMARY KEY,
-		first_name varchar(50) NOT NULL,
-		last_name varchar(50) NOT NULL,
-		account_number BIGINT NOT NULL,
-		encrypted_password varchar(100) NOT NULL,
-		balance BIGINT NOT NULL,
-		created_at timestamp,
-		is_admin boolean DEFAULT false
-		)`
-	_, err := s.db.Exec(query)
-	if err == nil {
-		fmt.Println("Account Table Initialized")
-	}
-	return err
+// Close closes the connection pool
+// Call it once the server has stopped, queries still running are left to finish first
+func (s *PostgresStore) Close() error {
+	return s.db.Close()
 }
 
 // CreateAccount creates a new account in the database.
 // Takes a pointer to an account
-func (s *PostgresStore) CreateAccount(acc *Account) (*Account, error) {
+// If the account number is already taken a new one is generated and the insert is retried
+func (s *PostgresStore) CreateAccount(ctx context.Context, acc *Account) (*Account, error) {
+	for attempt := 1; ; attempt++ {
+		err := s.insertAccount(ctx, acc)
+		if err == nil {
+			return acc, nil
+		}
+		if !isUniqueViolation(err, "accounts_account_number_key") {
+			return nil, err
+		}
+		if attempt == maxAccountNumberAttempts {
+			return nil, conflictError("account number %d is already taken", acc.AccountNumber)
+		}
+
+		number, err := generateAccountNumber()
+		if err != nil {
+			return nil, err
+		}
+		acc.AccountNumber = number
+	}
+}
+
+// insertAccount inserts an account and sets its ID
+// An opening balance is journaled as a deposit in the same transaction
+func (s *PostgresStore) insertAccount(ctx context.Context, acc *Account) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
 	query := `INSERT INTO accounts (
 			first_name,
 			last_name,
@@ -81,11 +152,11 @@ func (s *PostgresStore) CreateAccount(acc *Account) (*Account, error) {
 			encrypted_password,
 			balance,
 			created_at,
-			is_admin
+			status
 			) VALUES (
 				$1, $2, $3, $4, $5, $6, $7
 			) RETURNING id`
-	row:= s.db.QueryRow(
+	row := tx.QueryRowContext(ctx,
 		query,
 		acc.FirstName,
 		acc.LastName,
@@ -93,86 +164,148 @@ func (s *PostgresStore) CreateAccount(acc *Account) (*Account, error) {
 		acc.EncryptedPassword,
 		acc.Balance,
 		acc.CreatedAt,
-		acc.IsAdmin,
+		acc.Status,
 	)
 
-	err := row.Scan(&acc.ID)
+	err = row.Scan(&acc.ID)
 	if err != nil {
-		return nil, err
+		tx.Rollback()
+		return err
 	}
 
-	return acc, nil
-}
-
-// DeleteAccount deletes an account from the database
-// In the future, this should probably be a soft delete
-// I should create a new column called deleted_at and set it to the current time
-// Or I could create a new table called deleted_accounts and move the account there
-func (s *PostgresStore) DeleteAccount(id int) error {
-	// Check that the account exists
-	_, err := s.GetAccountByID(id)
-	if err != nil {
+	if err = setAccountRolesTx(ctx, tx, acc.ID, acc.Roles); err != nil {
+		tx.Rollback()
 		return err
 	}
-	
-	// Delete the account
-	query := `DELETE FROM accounts WHERE id=$1`
-	_, err = s.db.Query(query, id)
-	if err != nil {
-		return err
+
+	if acc.Balance > 0 {
+		_, err = (&postgresTx{ctx: ctx, tx: tx}).RecordTransfer(TransferKindDeposit, nil, acc.ID, acc.Balance)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
 	}
 
-	return nil
+	return tx.Commit()
 }
 
 // UpdateAccount updates an account in the database
-// This is not implemented yet
-// Ideas for implementation:
-// parameterize this function so that it can take a map of fields to update
-// or take a pointer to an account and update all of the fields
-func (s *PostgresStore) UpdateAccountByID(id int, accountDetails *Account) (*Account, error) {
-	// Make sure the account exists
+// Takes a pointer to an account and updates the name, account number and roles
+// The roles are replaced in the same transaction
+// If accountDetails.Version is set the update only happens if the account is still at that version
+// Returns the account as it was saved, with its new version
+func (s *PostgresStore) UpdateAccountByID(ctx context.Context, id int, accountDetails *Account) (*Account, error) {
+	//Check to make sure accountDetails is not nil
+	if accountDetails == nil {
+		return nil, fmt.Errorf("account details cannot be nil")
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
 	query := `
 		UPDATE accounts
 		SET 
 		first_name=$1, 
 		last_name=$2, 
 		account_number=$3,
-		is_admin=$4
-		WHERE id=$5`
-	//Check to make sure accountDetails is not nil
-	if accountDetails == nil {
-		return nil, fmt.Errorf("account details cannot be nil")
-	}
-	
-	_, err := s.db.Query(
+		version=version+1
+		WHERE id=$4 AND ($5=0 OR version=$5)`
+	res, err := tx.ExecContext(ctx,
 		query,
 		accountDetails.FirstName,
 		accountDetails.LastName,
 		accountDetails.AccountNumber,
-		accountDetails.IsAdmin,
 		id,
+		accountDetails.Version,
 	)
-
+	if isUniqueViolation(err, "accounts_account_number_key") {
+		tx.Rollback()
+		return nil, conflictError("account number %d is already taken", accountDetails.AccountNumber)
+	}
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	n, err := res.RowsAffected()
 	if err != nil {
+		tx.Rollback()
 		return nil, err
 	}
+	if n == 0 {
+		// Either the account doesn't exist or it has moved on from the expected version
+		var current int
+		err := tx.QueryRowContext(ctx, "SELECT version FROM accounts WHERE id=$1", id).Scan(&current)
+		tx.Rollback()
+		if err == sql.ErrNoRows {
+			return nil, notFoundError("account not found")
+		}
+		if err != nil {
+			return nil, err
+		}
+		return nil, versionMismatchError(accountDetails.Version, current)
+	}
 
-	// Get the updated account from the database
-	account, err := s.GetAccountByID(id)
+	if err = setAccountRolesTx(ctx, tx, id, accountDetails.Roles); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	// Read the account back before committing so the result is exactly what was saved
+	account, err := scanAccount(tx.QueryRowContext(ctx, "SELECT "+accountColumns+" FROM accounts WHERE id=$1", id))
 	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
 		return nil, err
 	}
 
 	return account, nil
 }
 
+// setAccountRolesTx replaces the roles of an account
+func setAccountRolesTx(ctx context.Context, tx *sql.Tx, id int, roles []Role) error {
+	if _, err := tx.ExecContext(ctx, "DELETE FROM account_roles WHERE account_id=$1", id); err != nil {
+		return err
+	}
+
+	for _, role := range roles {
+		_, err := tx.ExecContext(ctx,
+			"INSERT INTO account_roles (account_id, role) VALUES ($1, $2) ON CONFLICT DO NOTHING",
+			id, role,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 // GetAccountByID gets an account from the database by ID
 // This is used in the handleAccountByID function in api.go
-func (s *PostgresStore) GetAccountByID(id int) (*Account, error) {
+// Soft-deleted accounts are still returned so their history can be read
+func (s *PostgresStore) GetAccountByID(ctx context.Context, id int) (*Account, error) {
+	query := `SELECT ` + accountColumns + ` FROM accounts WHERE id=$1`
+	return scanAccount(s.db.QueryRowContext(ctx, query, id))
+}
+
+// accountColumns is the column list scanAccount expects
+// Columns are listed explicitly so adding one in a migration can't shift the scan
+// The roles are collected from account_roles into an array
+const accountColumns = `id, first_name, last_name, account_number, encrypted_password,
+	balance, created_at, status, closed_at, deleted_at, COALESCE(mfa_secret, ''), mfa_enabled, tokens_valid_after, version,
+	ARRAY(SELECT role FROM account_roles WHERE account_roles.account_id = accounts.id ORDER BY role)`
+
+// scanAccount scans an accounts row selected with accountColumns
+func scanAccount(row scanner) (*Account, error) {
 	account := new(Account)
-	query := `SELECT * FROM accounts WHERE id=$1`
-	row := s.db.QueryRow(query, id)
+	var closedAt, deletedAt, tokensValidAfter sql.NullTime
+	var roles []string
 	err := row.Scan(
 		&account.ID,
 		&account.FirstName,
@@ -181,180 +314,1180 @@ func (s *PostgresStore) GetAccountByID(id int) (*Account, error) {
 		&account.EncryptedPassword,
 		&account.Balance,
 		&account.CreatedAt,
-		&account.IsAdmin,
+		&account.Status,
+		&closedAt,
+		&deletedAt,
+		&account.MFASecret,
+		&account.MFAEnabled,
+		&tokensValidAfter,
+		&account.Version,
+		pq.Array(&roles),
 	)
+	if err == sql.ErrNoRows {
+		return nil, notFoundError("account not found")
+	}
 	if err != nil {
 		return nil, err
 	}
+	account.Roles = make([]Role, len(roles))
+	for i, role := range roles {
+		account.Roles[i] = Role(role)
+	}
+	account.ClosedAt = timeFromNullable(closedAt)
+	account.DeletedAt = timeFromNullable(deletedAt)
+	account.TokensValidAfter = timeFromNullable(tokensValidAfter)
 
 	return account, nil
 }
 
 // GetAccountByNumber gets an account from the database by account number
+// Account numbers are unique, so there is at most one match
 // This is used in the handleAccount function in api.go
-func (s *PostgresStore) GetAccountByNumber(number int) (*Account, error) {
-	rows, err := s.db.Query("SELECT * FROM accounts WHERE account_number=$1", number)
+func (s *PostgresStore) GetAccountByNumber(ctx context.Context, number int) (*Account, error) {
+	row := s.db.QueryRowContext(ctx, "SELECT "+accountColumns+" FROM accounts WHERE account_number=$1", number)
+	account, err := scanAccount(row)
+	if err == sql.ErrNoRows {
+		return nil, notFoundError("account not found")
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	if rows.Next() {
-		account := new(Account)
-		err := rows.Scan(
-			&account.ID,
-			&account.FirstName,
-			&account.LastName,
-			&account.AccountNumber,
-			&account.EncryptedPassword,
-			&account.Balance,
-			&account.CreatedAt,
-			&account.IsAdmin,
+	return account, nil
+}
+
+// This gets a page of the accounts from the database that match the filter
+// Pages use a keyset on the sort column and the ID, so later pages cost the same as the first
+// Soft-deleted accounts are left out unless the filter asks for them
+func (s *PostgresStore) GetAccounts(ctx context.Context, filter AccountFilter) ([]*Account, error) {
+	if filter.Limit < 1 {
+		return nil, fmt.Errorf("listing accounts needs a limit")
+	}
+	conditions, args := accountFilterConditions(filter)
+
+	// The column name goes into the query, so only known sorts are allowed
+	var column string
+	var value any
+	after := filter.After
+	if after == nil {
+		after = &AccountCursor{}
+	}
+	switch filter.Sort {
+	case "", SortByID:
+		column = "id"
+	case SortByLastName:
+		column, value = "last_name", after.LastName
+	case SortByBalance:
+		column, value = "balance", after.Balance
+	case SortByCreatedAt:
+		column, value = "created_at", after.CreatedAt
+	default:
+		return nil, fmt.Errorf("can't sort accounts by %s", filter.Sort)
+	}
+	op, order := ">", "ASC"
+	if filter.Descending {
+		op, order = "<", "DESC"
+	}
+	if filter.After != nil {
+		if value == nil {
+			args = append(args, after.ID)
+			conditions = append(conditions, fmt.Sprintf("id %s $%d", op, len(args)))
+		} else {
+			args = append(args, value, after.ID)
+			conditions = append(conditions, fmt.Sprintf("(%s, id) %s ($%d, $%d)", column, op, len(args)-1, len(args)))
+		}
+	}
+	args = append(args, filter.Limit)
+
+	orderBy := "id " + order
+	if column != "id" {
+		orderBy = column + " " + order + ", " + orderBy
+	}
+	query := fmt.Sprintf("SELECT %s FROM accounts WHERE %s ORDER BY %s LIMIT $%d",
+		accountColumns, strings.Join(conditions, " AND "), orderBy, len(args))
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	accounts := []*Account{}
+	for rows.Next() {
+		account, err := scanAccount(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		accounts = append(accounts, account)
+	}
+
+	return accounts, rows.Err()
+}
+
+// CountAccounts counts every account that matches the filter, ignoring the paging
+func (s *PostgresStore) CountAccounts(ctx context.Context, filter AccountFilter) (int, error) {
+	conditions, args := accountFilterConditions(filter)
+	var count int
+	query := "SELECT COUNT(*) FROM accounts WHERE " + strings.Join(conditions, " AND ")
+	if err := s.db.QueryRowContext(ctx, query, args...).Scan(&count); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// Helper for turning the filtering part of an AccountFilter into WHERE conditions
+func accountFilterConditions(filter AccountFilter) ([]string, []any) {
+	args := []any{}
+	conditions := []string{"TRUE"}
+	if filter.NamePrefix != "" {
+		// Escape LIKE's wildcards so they match themselves
+		prefix := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(strings.ToLower(filter.NamePrefix))
+		args = append(args, prefix+"%")
+		conditions = append(conditions, fmt.Sprintf("(lower(first_name) LIKE $%d OR lower(last_name) LIKE $%d)", len(args), len(args)))
+	}
+	if filter.Status != "" {
+		args = append(args, filter.Status)
+		conditions = append(conditions, fmt.Sprintf("status=$%d", len(args)))
+	}
+	if filter.Role != "" {
+		args = append(args, filter.Role)
+		conditions = append(conditions, fmt.Sprintf("EXISTS (SELECT 1 FROM account_roles WHERE account_roles.account_id = accounts.id AND role=$%d)", len(args)))
+	}
+	if filter.MinBalance != nil {
+		args = append(args, *filter.MinBalance)
+		conditions = append(conditions, fmt.Sprintf("balance >= $%d", len(args)))
+	}
+	if filter.MaxBalance != nil {
+		args = append(args, *filter.MaxBalance)
+		conditions = append(conditions, fmt.Sprintf("balance <= $%d", len(args)))
+	}
+	if !filter.CreatedSince.IsZero() {
+		args = append(args, filter.CreatedSince)
+		conditions = append(conditions, fmt.Sprintf("created_at >= $%d", len(args)))
+	}
+	if !filter.CreatedUntil.IsZero() {
+		args = append(args, filter.CreatedUntil)
+		conditions = append(conditions, fmt.Sprintf("created_at < $%d", len(args)))
+	}
+	if !filter.IncludeDeleted {
+		conditions = append(conditions, "deleted_at IS NULL")
+	}
+	return conditions, args
+}
+
+// Transactions that fail with a serialization failure or a deadlock are retried this many times
+const maxTxAttempts = 3
+
+// WithTx runs fn inside a database transaction
+// The transaction is committed if fn returns nil and rolled back otherwise
+// If Postgres aborts the transaction with a serialization failure or a deadlock the whole
+// of fn is run again in a new transaction, so fn must not have side effects outside of tx
+func (s *PostgresStore) WithTx(ctx context.Context, fn func(TxStore) error) error {
+	var err error
+	for attempt := 1; attempt <= maxTxAttempts; attempt++ {
+		err = s.runTx(ctx, fn)
+		if !isRetryableTxError(err) {
+			return err
+		}
+
+		// Back off a little before trying again so the competing transaction can finish
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(attempt) * 10 * time.Millisecond):
+		}
+	}
+
+	return err
+}
+
+func (s *PostgresStore) runTx(ctx context.Context, fn func(TxStore) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if err := fn(&postgresTx{ctx: ctx, tx: tx}); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// isUniqueViolation reports whether err is Postgres rejecting a duplicate for the given constraint
+func isUniqueViolation(err error, constraint string) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == "23505" && pqErr.Constraint == constraint
+	}
+	return false
+}
+
+// isRetryableTxError reports whether Postgres aborted a transaction in a way that is safe to retry
+// 40001 is serialization_failure and 40P01 is deadlock_detected
+func isRetryableTxError(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == "40001" || pqErr.Code == "40P01"
+	}
+	return false
+}
+
+// postgresTx is the TxStore handed to WithTx callbacks
+// It wraps the *sql.Tx so database/sql doesn't leak out of this file
+// Every query runs with the context passed to WithTx
+type postgresTx struct {
+	ctx context.Context
+	tx  *sql.Tx
+}
+
+// GetAccountByID gets an account by ID inside the transaction
+func (t *postgresTx) GetAccountByID(id int) (*Account, error) {
+	return scanAccount(t.tx.QueryRowContext(t.ctx, "SELECT "+accountColumns+" FROM accounts WHERE id=$1", id))
+}
+
+// GetAccountByNumber gets an account by account number inside the transaction
+func (t *postgresTx) GetAccountByNumber(number int64) (*Account, error) {
+	account, err := scanAccount(t.tx.QueryRowContext(t.ctx, "SELECT "+accountColumns+" FROM accounts WHERE account_number=$1", number))
+	if err == sql.ErrNoRows {
+		return nil, notFoundError("account %d not found", number)
+	}
+	return account, err
+}
+
+// SetAccountStatus moves an account to a new lifecycle status
+// closed_at is set the first time the account is closed
+func (t *postgresTx) SetAccountStatus(id int, status AccountStatus, at time.Time) error {
+	query := `UPDATE accounts
+		SET status=$1,
+		closed_at=CASE WHEN $1='closed' THEN COALESCE(closed_at, $2) ELSE closed_at END,
+		version=version+1
+		WHERE id=$3`
+	return t.execOne(query, status, at, id)
+}
+
+// MarkAccountDeleted soft-deletes an account by setting deleted_at
+func (t *postgresTx) MarkAccountDeleted(id int, at time.Time) error {
+	return t.execOne("UPDATE accounts SET deleted_at=$1, version=version+1 WHERE id=$2", at, id)
+}
+
+// execOne runs a statement that must change exactly one account
+func (t *postgresTx) execOne(query string, args ...any) error {
+	res, err := t.tx.ExecContext(t.ctx, query, args...)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return notFoundError("account not found")
+	}
+
+	return nil
+}
+
+// LockAccounts locks the rows of the given accounts until the transaction ends
+// Rows are always locked in ascending ID order so two transfers between the same
+// accounts in opposite directions can't deadlock each other
+func (t *postgresTx) LockAccounts(ids ...int) error {
+	for _, id := range sortedUniqueIDs(ids) {
+		var locked int
+		err := t.tx.QueryRowContext(t.ctx, "SELECT id FROM accounts WHERE id=$1 FOR UPDATE", id).Scan(&locked)
+		if err == sql.ErrNoRows {
+			return notFoundError("account not found")
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GetBalance gets the balance of an account inside the transaction
+func (t *postgresTx) GetBalance(id int) (int64, error) {
+	var balance int64
+	row := t.tx.QueryRowContext(t.ctx, "SELECT balance FROM accounts WHERE id=$1", id)
+	err := row.Scan(&balance)
+	if err != nil {
+		return 0, err
+	}
+
+	return balance, nil
+}
+
+// AddBalance adds an amount to the balance of an account
+// The update is relative to the stored balance so it can't overwrite a concurrent change
+func (t *postgresTx) AddBalance(id int, amount int64) error {
+	return t.updateBalance(id, amount)
+}
+
+// SubtractBalance subtracts an amount from the balance of an account
+func (t *postgresTx) SubtractBalance(id int, amount int64) error {
+	return t.updateBalance(id, -amount)
+}
+
+func (t *postgresTx) updateBalance(id int, delta int64) error {
+	return t.execOne("UPDATE accounts SET balance = balance + $1 WHERE id=$2", delta, id)
+}
+
+// RecordTransfer writes a transfer and its two balancing postings to the journal
+// fromAcc is nil when the money comes from outside the bank (opening deposits)
+func (t *postgresTx) RecordTransfer(kind string, fromAcc *int, toAcc int, amount int64) (*Transfer, error) {
+	transfer := &Transfer{
+		Kind:          kind,
+		FromAccountID: fromAcc,
+		ToAccountID:   toAcc,
+		Amount:        amount,
+		CreatedAt:     time.Now().UTC(),
+	}
+
+	query := `INSERT INTO transfers (
+			kind,
+			from_account_id,
+			to_account_id,
+			amount,
+			created_at
+			) VALUES (
+				$1, $2, $3, $4, $5
+			) RETURNING id`
+	row := t.tx.QueryRowContext(t.ctx, query, kind, nullableID(fromAcc), toAcc, amount, transfer.CreatedAt)
+	if err := row.Scan(&transfer.ID); err != nil {
+		return nil, err
+	}
+
+	// The debit from the source and the credit to the destination always sum to zero
+	postings := []*Posting{
+		{TransferID: transfer.ID, AccountID: fromAcc, Amount: -amount, CreatedAt: transfer.CreatedAt},
+		{TransferID: transfer.ID, AccountID: &toAcc, Amount: amount, CreatedAt: transfer.CreatedAt},
+	}
+	for _, p := range postings {
+		row := t.tx.QueryRowContext(t.ctx,
+			`INSERT INTO postings (transfer_id, account_id, amount, created_at)
+			VALUES ($1, $2, $3, $4) RETURNING id`,
+			p.TransferID,
+			nullableID(p.AccountID),
+			p.Amount,
+			p.CreatedAt,
 		)
+		if err := row.Scan(&p.ID); err != nil {
+			return nil, err
+		}
+	}
+	transfer.Postings = postings
+
+	return transfer, nil
+}
+
+// GetTransferByID gets a transfer and its postings from the journal
+func (s *PostgresStore) GetTransferByID(ctx context.Context, id int) (*Transfer, error) {
+	row := s.db.QueryRowContext(ctx, transferQuery+" WHERE t.id=$1", id)
+	transfer, err := scanTransfer(row)
+	if err != nil {
+		return nil, err
+	}
+
+	transfer.Postings, err = s.getPostingsByTransfer(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return transfer, nil
+}
+
+// GetTransfersByAccount gets the transfers touching an account, newest first
+// The filter narrows by direction and date range and pages with a keyset cursor on the transfer ID
+// Postings are not loaded here, use GetTransferByID for the full journal entry
+func (s *PostgresStore) GetTransfersByAccount(ctx context.Context, accountID int, filter TransferFilter) ([]*Transfer, error) {
+	args := []any{accountID}
+	conditions := []string{}
+
+	switch filter.Direction {
+	case DirectionDebit:
+		conditions = append(conditions, "t.from_account_id=$1")
+	case DirectionCredit:
+		conditions = append(conditions, "t.to_account_id=$1")
+	default:
+		conditions = append(conditions, "(t.from_account_id=$1 OR t.to_account_id=$1)")
+	}
+	if filter.BeforeID > 0 {
+		args = append(args, filter.BeforeID)
+		conditions = append(conditions, fmt.Sprintf("t.id < $%d", len(args)))
+	}
+	if !filter.Since.IsZero() {
+		args = append(args, filter.Since)
+		conditions = append(conditions, fmt.Sprintf("t.created_at >= $%d", len(args)))
+	}
+	if !filter.Until.IsZero() {
+		args = append(args, filter.Until)
+		conditions = append(conditions, fmt.Sprintf("t.created_at < $%d", len(args)))
+	}
+	args = append(args, filter.Limit)
+
+	query := fmt.Sprintf(`%s
+		WHERE %s
+		ORDER BY t.id DESC
+		LIMIT $%d`, transferQuery, strings.Join(conditions, " AND "), len(args))
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	transfers := []*Transfer{}
+	for rows.Next() {
+		transfer, err := scanTransfer(rows)
 		if err != nil {
 			return nil, err
 		}
+		transfers = append(transfers, transfer)
+	}
+
+	return transfers, rows.Err()
+}
 
-		return account, nil
+// GetLedgerBalance sums the postings of an account
+// This should always equal accounts.balance; a mismatch means the two have drifted
+func (s *PostgresStore) GetLedgerBalance(ctx context.Context, accountID int) (int64, error) {
+	var balance int64
+	row := s.db.QueryRowContext(ctx, "SELECT COALESCE(SUM(amount), 0) FROM postings WHERE account_id=$1", accountID)
+	if err := row.Scan(&balance); err != nil {
+		return 0, err
 	}
 
-	return nil, fmt.Errorf("account not found")
+	return balance, nil
 }
 
-// This gets all of the accounts from the database
-func (s *PostgresStore) GetAccounts() ([]*Account, error) {
-	rows, err := s.db.Query("SELECT * FROM accounts")
+func (s *PostgresStore) getPostingsByTransfer(ctx context.Context, transferID int) ([]*Posting, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT id, transfer_id, account_id, amount, created_at
+		FROM postings WHERE transfer_id=$1 ORDER BY id`, transferID)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
-	accounts := []*Account{}
+	postings := []*Posting{}
 	for rows.Next() {
-		account := new(Account)
+		posting := new(Posting)
+		var accountID sql.NullInt64
 		err := rows.Scan(
-			&account.ID,
-			&account.FirstName,
-			&account.LastName,
-			&account.AccountNumber,
-			&account.EncryptedPassword,
-			&account.Balance,
-			&account.CreatedAt,
-			&account.IsAdmin,
+			&posting.ID,
+			&posting.TransferID,
+			&accountID,
+			&posting.Amount,
+			&posting.CreatedAt,
 		)
 		if err != nil {
 			return nil, err
 		}
+		posting.AccountID = idFromNullable(accountID)
+		postings = append(postings, posting)
+	}
 
-		accounts = append(accounts, account)
+	return postings, rows.Err()
+}
+
+// transferQuery selects transfers with the account numbers on both sides, for scanTransfer
+const transferQuery = `SELECT t.id, t.kind, t.from_account_id, t.to_account_id, t.amount, t.created_at,
+		fa.account_number, ta.account_number
+		FROM transfers t
+		LEFT JOIN accounts fa ON fa.id = t.from_account_id
+		JOIN accounts ta ON ta.id = t.to_account_id`
+
+// scanner is satisfied by both *sql.Row and *sql.Rows
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanTransfer(row scanner) (*Transfer, error) {
+	transfer := new(Transfer)
+	var fromAccountID, fromAccountNumber sql.NullInt64
+	err := row.Scan(
+		&transfer.ID,
+		&transfer.Kind,
+		&fromAccountID,
+		&transfer.ToAccountID,
+		&transfer.Amount,
+		&transfer.CreatedAt,
+		&fromAccountNumber,
+		&transfer.ToAccountNumber,
+	)
+	if err != nil {
+		return nil, err
+	}
+	transfer.FromAccountID = idFromNullable(fromAccountID)
+	if fromAccountNumber.Valid {
+		transfer.FromAccountNumber = &fromAccountNumber.Int64
 	}
 
-	return accounts, nil
+	return transfer, nil
 }
 
-// GetAdminStatus gets the admin status of an account
-// This is used in the withAdminAuth middleware in auth.go
-func (s *PostgresStore) GetAdminStatus(id int) (bool, error) {
-	var isAdmin bool
-	row := s.db.QueryRow("SELECT is_admin FROM accounts WHERE id=$1", id)
-	err := row.Scan(&isAdmin)
+// Helpers for the nullable account ID columns in the journal
+func nullableID(id *int) sql.NullInt64 {
+	if id == nil {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: int64(*id), Valid: true}
+}
+
+func idFromNullable(id sql.NullInt64) *int {
+	if !id.Valid {
+		return nil
+	}
+	v := int(id.Int64)
+	return &v
+}
+
+func timeFromNullable(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	v := t.Time
+	return &v
+}
+
+// CreateIdempotencyRecord reserves an idempotency key for a caller
+// Returns false if the caller has already used the key
+func (s *PostgresStore) CreateIdempotencyRecord(ctx context.Context, rec *IdempotencyRecord) (bool, error) {
+	query := `INSERT INTO idempotency_keys (
+			caller,
+			idempotency_key,
+			request_hash,
+			created_at
+			) VALUES (
+				$1, $2, $3, $4
+			) ON CONFLICT (caller, idempotency_key) DO NOTHING`
+	res, err := s.db.ExecContext(ctx, query, rec.Caller, rec.Key, rec.RequestHash, rec.CreatedAt)
 	if err != nil {
 		return false, err
 	}
 
-	return isAdmin, nil
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return n == 1, nil
 }
 
-func (s *PostgresStore) GetBalanceTx(tx *sql.Tx, id int) (int64, error) {
-    var balance int64
-    row := tx.QueryRow("SELECT balance FROM accounts WHERE id=$1", id)
-    err := row.Scan(&balance)
-    if err != nil {
-        return 0, err
-    }
+// GetIdempotencyRecord gets the stored outcome of a caller's idempotency key
+func (s *PostgresStore) GetIdempotencyRecord(ctx context.Context, caller string, key string) (*IdempotencyRecord, error) {
+	rec := new(IdempotencyRecord)
+	query := `SELECT caller, idempotency_key, request_hash, status_code, response_body, created_at
+		FROM idempotency_keys WHERE caller=$1 AND idempotency_key=$2`
+	row := s.db.QueryRowContext(ctx, query, caller, key)
+	err := row.Scan(
+		&rec.Caller,
+		&rec.Key,
+		&rec.RequestHash,
+		&rec.StatusCode,
+		&rec.Body,
+		&rec.CreatedAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, notFoundError("idempotency key not found")
+	}
+	if err != nil {
+		return nil, err
+	}
 
-    return balance, nil
+	return rec, nil
 }
 
-func (s *PostgresStore) AddBalanceTx(tx *sql.Tx, id int, amount int) error {
-    balance, err := s.GetBalanceTx(tx, id)
-    if err != nil {
-        return err
-    }
+// CompleteIdempotencyRecord stores the response of the first request made with a key
+func (s *PostgresStore) CompleteIdempotencyRecord(ctx context.Context, rec *IdempotencyRecord) error {
+	query := `UPDATE idempotency_keys
+		SET status_code=$1, response_body=$2
+		WHERE caller=$3 AND idempotency_key=$4`
+	_, err := s.db.ExecContext(ctx, query, rec.StatusCode, rec.Body, rec.Caller, rec.Key)
+	return err
+}
 
-    balance += int64(amount)
-    _, err = tx.Exec("UPDATE accounts SET balance=$1 WHERE id=$2", balance, id)
-    if err != nil {
-        return err
-    }
+// ReclaimIdempotencyRecord hands a stale reservation over to a new request
+// Returns false if the reservation was completed or taken over since stale was read
+func (s *PostgresStore) ReclaimIdempotencyRecord(ctx context.Context, stale *IdempotencyRecord, rec *IdempotencyRecord) (bool, error) {
+	query := `UPDATE idempotency_keys
+		SET request_hash=$1, created_at=$2
+		WHERE caller=$3 AND idempotency_key=$4 AND status_code=0 AND created_at=$5`
+	res, err := s.db.ExecContext(ctx, query, rec.RequestHash, rec.CreatedAt, rec.Caller, rec.Key, stale.CreatedAt)
+	if err != nil {
+		return false, err
+	}
 
-    return nil
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return n == 1, nil
 }
 
-func (s *PostgresStore) SubtractBalanceTx(tx *sql.Tx, id int, amount int) error {
-    balance, err := s.GetBalanceTx(tx, id)
-    if err != nil {
-        return err
-    }
+// DeleteIdempotencyRecord frees an idempotency key so the request can be retried
+func (s *PostgresStore) DeleteIdempotencyRecord(ctx context.Context, caller string, key string) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE caller=$1 AND idempotency_key=$2", caller, key)
+	return err
+}
+
+// CreateRefreshToken stores a new refresh token
+func (s *PostgresStore) CreateRefreshToken(ctx context.Context, rt *RefreshToken) error {
+	query := `INSERT INTO refresh_tokens (
+			account_id,
+			family_id,
+			token_hash,
+			expires_at,
+			created_at,
+			mfa
+			) VALUES (
+				$1, $2, $3, $4, $5, $6
+			) RETURNING id`
+	row := s.db.QueryRowContext(ctx, query, rt.AccountID, rt.FamilyID, rt.TokenHash, rt.ExpiresAt, rt.CreatedAt, rt.MFA)
+	return row.Scan(&rt.ID)
+}
 
-    balance -= int64(amount)
-    _, err = tx.Exec("UPDATE accounts SET balance=$1 WHERE id=$2", balance, id)
-    if err != nil {
-        return err
-    }
+// GetRefreshTokenByHash gets a refresh token by the hash of the token
+func (s *PostgresStore) GetRefreshTokenByHash(ctx context.Context, hash string) (*RefreshToken, error) {
+	rt := new(RefreshToken)
+	var usedAt, revokedAt sql.NullTime
+	query := `SELECT id, account_id, family_id, token_hash, expires_at, created_at, used_at, revoked_at, mfa
+		FROM refresh_tokens WHERE token_hash=$1`
+	err := s.db.QueryRowContext(ctx, query, hash).Scan(
+		&rt.ID,
+		&rt.AccountID,
+		&rt.FamilyID,
+		&rt.TokenHash,
+		&rt.ExpiresAt,
+		&rt.CreatedAt,
+		&usedAt,
+		&revokedAt,
+		&rt.MFA,
+	)
+	if err == sql.ErrNoRows {
+		return nil, notFoundError("refresh token not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	rt.UsedAt = timeFromNullable(usedAt)
+	rt.RevokedAt = timeFromNullable(revokedAt)
 
-    return nil
+	return rt, nil
 }
 
-// MakeTransfer makes a transfer from one account to another
-// checks the balance of the from account and subtracts the amount from their balance
-// then adds the amount to the to account
-// This is used in the handleTransfer function in api.go
-func (s *PostgresStore) MakeTransfer(toAcc, fromAcc, amount int) (*Account, error) {
-	// Begin a transaction
-	tx, err := s.db.Begin()
+// UseRefreshToken marks a refresh token as used when it is rotated
+// Returns false if the token was already used or revoked, so only one caller can rotate it
+func (s *PostgresStore) UseRefreshToken(ctx context.Context, id int) (bool, error) {
+	query := `UPDATE refresh_tokens SET used_at=$1
+		WHERE id=$2 AND used_at IS NULL AND revoked_at IS NULL`
+	res, err := s.db.ExecContext(ctx, query, time.Now().UTC(), id)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return n == 1, nil
+}
+
+// RevokeRefreshTokenFamily revokes every refresh token in a family
+func (s *PostgresStore) RevokeRefreshTokenFamily(ctx context.Context, familyID string) error {
+	query := `UPDATE refresh_tokens SET revoked_at=$1 WHERE family_id=$2 AND revoked_at IS NULL`
+	_, err := s.db.ExecContext(ctx, query, time.Now().UTC(), familyID)
+	return err
+}
+
+// RevokeAccessToken adds an access token to the revocation list until it expires
+// Entries for tokens that have expired since are cleared out at the same time
+func (s *PostgresStore) RevokeAccessToken(ctx context.Context, jti string, expiresAt time.Time) error {
+	if _, err := s.db.ExecContext(ctx, "DELETE FROM revoked_tokens WHERE expires_at < $1", time.Now().UTC()); err != nil {
+		return err
+	}
+
+	query := `INSERT INTO revoked_tokens (jti, expires_at) VALUES ($1, $2) ON CONFLICT (jti) DO NOTHING`
+	_, err := s.db.ExecContext(ctx, query, jti, expiresAt.UTC())
+	return err
+}
+
+// IsAccessTokenRevoked reports whether an access token is on the revocation list
+func (s *PostgresStore) IsAccessTokenRevoked(ctx context.Context, jti string) (bool, error) {
+	var revoked bool
+	row := s.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM revoked_tokens WHERE jti=$1)", jti)
+	if err := row.Scan(&revoked); err != nil {
+		return false, err
+	}
+
+	return revoked, nil
+}
+
+// GetLoginThrottle gets the failed logins for a throttle key
+// A key with no failures gets an empty throttle rather than an error
+func (s *PostgresStore) GetLoginThrottle(ctx context.Context, key string) (*LoginThrottle, error) {
+	t := &LoginThrottle{Key: key}
+	var lockedUntil sql.NullTime
+	query := `SELECT failures, last_failure_at, locked_until FROM login_throttles WHERE throttle_key=$1`
+	err := s.db.QueryRowContext(ctx, query, key).Scan(&t.Failures, &t.LastFailureAt, &lockedUntil)
+	if err == sql.ErrNoRows {
+		return t, nil
+	}
 	if err != nil {
 		return nil, err
 	}
+	t.LockedUntil = timeFromNullable(lockedUntil)
+
+	return t, nil
+}
 
-	// Get the balance of the from account
-	fromBalance, err := s.GetBalanceTx(tx, fromAcc)
+// ReserveLoginAttempt counts a login attempt against a throttle key before it is checked
+// The count starts over if the last failure was before resetBefore
+// The increment is a single statement so parallel attempts each get their own count
+func (s *PostgresStore) ReserveLoginAttempt(ctx context.Context, key string, at time.Time, resetBefore time.Time) (*LoginThrottle, error) {
+	t := &LoginThrottle{Key: key}
+	var lockedUntil sql.NullTime
+	query := `INSERT INTO login_throttles (
+			throttle_key,
+			failures,
+			last_failure_at
+			) VALUES (
+				$1, 1, $2
+			) ON CONFLICT (throttle_key) DO UPDATE SET
+				failures = CASE WHEN login_throttles.last_failure_at < $3 THEN 1 ELSE login_throttles.failures + 1 END,
+				last_failure_at = $2
+			RETURNING failures, last_failure_at, locked_until`
+	err := s.db.QueryRowContext(ctx, query, key, at, resetBefore).Scan(&t.Failures, &t.LastFailureAt, &lockedUntil)
+	if err != nil {
+		return nil, err
+	}
+	t.LockedUntil = timeFromNullable(lockedUntil)
+
+	return t, nil
+}
+
+// ReleaseLoginAttempt takes back an attempt counted by ReserveLoginAttempt that didn't fail
+func (s *PostgresStore) ReleaseLoginAttempt(ctx context.Context, key string) error {
+	_, err := s.db.ExecContext(ctx, "UPDATE login_throttles SET failures=GREATEST(failures-1, 0) WHERE throttle_key=$1", key)
+	return err
+}
+
+// LockLogin stops logins for a throttle key until the given time
+func (s *PostgresStore) LockLogin(ctx context.Context, key string, until time.Time) error {
+	_, err := s.db.ExecContext(ctx, "UPDATE login_throttles SET locked_until=$1 WHERE throttle_key=$2", until, key)
+	return err
+}
+
+// ClearLoginThrottle forgets the failed logins for a throttle key and lifts any lockout
+func (s *PostgresStore) ClearLoginThrottle(ctx context.Context, key string) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM login_throttles WHERE throttle_key=$1", key)
+	return err
+}
+
+// RecordSecurityEvent stores a security event
+func (s *PostgresStore) RecordSecurityEvent(ctx context.Context, event *SecurityEvent) error {
+	query := `INSERT INTO security_events (
+			kind,
+			account_number,
+			ip,
+			detail,
+			created_at
+			) VALUES (
+				$1, $2, $3, $4, $5
+			) RETURNING id`
+	var accountNumber sql.NullInt64
+	if event.AccountNumber != 0 {
+		accountNumber = sql.NullInt64{Int64: event.AccountNumber, Valid: true}
+	}
+	row := s.db.QueryRowContext(ctx, query, event.Kind, accountNumber, event.IP, event.Detail, event.CreatedAt)
+	return row.Scan(&event.ID)
+}
+
+// GetSecurityEvents gets security events, newest first
+func (s *PostgresStore) GetSecurityEvents(ctx context.Context, filter SecurityEventFilter) ([]*SecurityEvent, error) {
+	query := `SELECT id, kind, account_number, ip, detail, created_at FROM security_events WHERE true`
+	args := []any{}
+	if filter.AccountNumber != 0 {
+		args = append(args, filter.AccountNumber)
+		query += fmt.Sprintf(" AND account_number=$%d", len(args))
+	}
+	if filter.Kind != "" {
+		args = append(args, filter.Kind)
+		query += fmt.Sprintf(" AND kind=$%d", len(args))
+	}
+	query += " ORDER BY id DESC"
+	if filter.Limit > 0 {
+		args = append(args, filter.Limit)
+		query += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
 	if err != nil {
-		tx.Rollback()
 		return nil, err
 	}
+	defer rows.Close()
 
-	// Check if the from account has enough money
-	if fromBalance < int64(amount) {
+	events := []*SecurityEvent{}
+	for rows.Next() {
+		event := new(SecurityEvent)
+		var accountNumber sql.NullInt64
+		err := rows.Scan(&event.ID, &event.Kind, &accountNumber, &event.IP, &event.Detail, &event.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		event.AccountNumber = accountNumber.Int64
+		events = append(events, event)
+	}
+
+	return events, rows.Err()
+}
+
+// SetMFASecret stores a new encrypted TOTP secret for an account
+// Two-factor authentication stays off until EnableMFA is called
+func (s *PostgresStore) SetMFASecret(ctx context.Context, id int, secret string) error {
+	query := `UPDATE accounts SET mfa_secret=$1, mfa_enabled=false, mfa_last_step=NULL WHERE id=$2`
+	res, err := s.db.ExecContext(ctx, query, secret, id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return notFoundError("account not found")
+	}
+	return nil
+}
+
+// EnableMFA turns on two-factor authentication and replaces the recovery codes
+// The codes are stored as hashes
+func (s *PostgresStore) EnableMFA(ctx context.Context, id int, recoveryCodeHashes []string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE accounts SET mfa_enabled=true WHERE id=$1", id); err != nil {
 		tx.Rollback()
-		return nil, fmt.Errorf("insufficient funds")
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM mfa_recovery_codes WHERE account_id=$1", id); err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, hash := range recoveryCodeHashes {
+		_, err := tx.ExecContext(ctx, "INSERT INTO mfa_recovery_codes (account_id, code_hash) VALUES ($1, $2)", id, hash)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
 	}
 
-	// Subtract the amount from the from account
-	err = s.SubtractBalanceTx(tx, fromAcc, amount)
+	return tx.Commit()
+}
+
+// DisableMFA turns off two-factor authentication and removes the secret and recovery codes
+func (s *PostgresStore) DisableMFA(ctx context.Context, id int) error {
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
+		return err
+	}
+
+	query := `UPDATE accounts SET mfa_secret=NULL, mfa_enabled=false, mfa_last_step=NULL WHERE id=$1`
+	if _, err := tx.ExecContext(ctx, query, id); err != nil {
 		tx.Rollback()
-		return nil, err
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM mfa_recovery_codes WHERE account_id=$1", id); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// UseTOTPStep records the time step of an accepted TOTP code
+// Returns false if a code from that step or a later one was already accepted, so codes can't be replayed
+func (s *PostgresStore) UseTOTPStep(ctx context.Context, id int, step int64) (bool, error) {
+	query := `UPDATE accounts SET mfa_last_step=$1
+		WHERE id=$2 AND (mfa_last_step IS NULL OR mfa_last_step < $1)`
+	res, err := s.db.ExecContext(ctx, query, step, id)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
 	}
 
+	return n == 1, nil
+}
+
+// UseRecoveryCode uses up a recovery code by its hash
+// Returns false if the account has no unused code with that hash
+func (s *PostgresStore) UseRecoveryCode(ctx context.Context, id int, hash string) (bool, error) {
+	query := `UPDATE mfa_recovery_codes SET used_at=$1
+		WHERE account_id=$2 AND code_hash=$3 AND used_at IS NULL`
+	res, err := s.db.ExecContext(ctx, query, time.Now().UTC(), id, hash)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return n == 1, nil
+}
+
+// SetPassword stores a new password hash for an account
+// Access tokens issued before validAfter stop working and every refresh token is revoked
+func (s *PostgresStore) SetPassword(ctx context.Context, id int, encryptedPassword string, validAfter time.Time) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
 
-	// Add the amount to the to account
-	err = s.AddBalanceTx(tx, toAcc, amount)
+	query := `UPDATE accounts SET encrypted_password=$1, tokens_valid_after=$2 WHERE id=$3`
+	res, err := tx.ExecContext(ctx, query, encryptedPassword, validAfter, id)
 	if err != nil {
 		tx.Rollback()
-		return nil, err
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		tx.Rollback()
+		return notFoundError("account not found")
+	}
+
+	query = `UPDATE refresh_tokens SET revoked_at=$1 WHERE account_id=$2 AND revoked_at IS NULL`
+	if _, err := tx.ExecContext(ctx, query, validAfter, id); err != nil {
+		tx.Rollback()
+		return err
 	}
 
-	// Commit the transaction
-	err = tx.Commit()
+	return tx.Commit()
+}
+
+// CreatePasswordResetToken stores a new password reset token
+// Earlier unused tokens for the account are marked used so only the newest one works
+func (s *PostgresStore) CreatePasswordResetToken(ctx context.Context, rt *PasswordResetToken) error {
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
+		return err
+	}
+
+	query := `UPDATE password_reset_tokens SET used_at=$1 WHERE account_id=$2 AND used_at IS NULL`
+	if _, err := tx.ExecContext(ctx, query, rt.CreatedAt, rt.AccountID); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	query = `INSERT INTO password_reset_tokens (
+			account_id,
+			token_hash,
+			expires_at,
+			created_at
+			) VALUES (
+				$1, $2, $3, $4
+			) RETURNING id`
+	row := tx.QueryRowContext(ctx, query, rt.AccountID, rt.TokenHash, rt.ExpiresAt, rt.CreatedAt)
+	if err := row.Scan(&rt.ID); err != nil {
 		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetPasswordResetTokenByHash gets a password reset token by the hash of the token
+func (s *PostgresStore) GetPasswordResetTokenByHash(ctx context.Context, hash string) (*PasswordResetToken, error) {
+	rt := new(PasswordResetToken)
+	var usedAt sql.NullTime
+	query := `SELECT id, account_id, token_hash, expires_at, created_at, used_at
+		FROM password_reset_tokens WHERE token_hash=$1`
+	err := s.db.QueryRowContext(ctx, query, hash).Scan(
+		&rt.ID,
+		&rt.AccountID,
+		&rt.TokenHash,
+		&rt.ExpiresAt,
+		&rt.CreatedAt,
+		&usedAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, notFoundError("password reset token not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	rt.UsedAt = timeFromNullable(usedAt)
+
+	return rt, nil
+}
+
+// UsePasswordResetToken marks a password reset token as used
+// Returns false if the token was already used, so only one reset can succeed
+func (s *PostgresStore) UsePasswordResetToken(ctx context.Context, id int) (bool, error) {
+	query := `UPDATE password_reset_tokens SET used_at=$1 WHERE id=$2 AND used_at IS NULL`
+	res, err := s.db.ExecContext(ctx, query, time.Now().UTC(), id)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return n == 1, nil
+}
+
+// CreateAPIKey stores a new API key
+func (s *PostgresStore) CreateAPIKey(ctx context.Context, key *APIKey) error {
+	query := `INSERT INTO api_keys (
+			name,
+			prefix,
+			key_hash,
+			permissions,
+			account_ids,
+			created_by,
+			created_at,
+			expires_at
+			) VALUES (
+				$1, $2, $3, $4, $5, $6, $7, $8
+			) RETURNING id`
+	row := s.db.QueryRowContext(ctx,
+		query,
+		key.Name,
+		key.Prefix,
+		key.KeyHash,
+		pq.Array(key.Permissions),
+		pq.Array(key.AccountIDs),
+		key.CreatedBy,
+		key.CreatedAt,
+		key.ExpiresAt,
+	)
+	return row.Scan(&key.ID)
+}
+
+const apiKeyColumns = `id, name, prefix, key_hash, permissions, account_ids,
+	created_by, created_at, expires_at, last_used_at, revoked_at`
+
+// GetAPIKeys gets every API key, including revoked ones
+func (s *PostgresStore) GetAPIKeys(ctx context.Context) ([]*APIKey, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT "+apiKeyColumns+" FROM api_keys ORDER BY id")
+	if err != nil {
 		return nil, err
 	}
-	
-	// Get the updated account from the database
-	account, err := s.GetAccountByID(fromAcc)
+	defer rows.Close()
+
+	keys := []*APIKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+// GetAPIKeyByID gets an API key by its ID
+func (s *PostgresStore) GetAPIKeyByID(ctx context.Context, id int) (*APIKey, error) {
+	row := s.db.QueryRowContext(ctx, "SELECT "+apiKeyColumns+" FROM api_keys WHERE id=$1", id)
+	return scanAPIKey(row)
+}
+
+// GetAPIKeyByPrefix gets an API key by its prefix
+func (s *PostgresStore) GetAPIKeyByPrefix(ctx context.Context, prefix string) (*APIKey, error) {
+	row := s.db.QueryRowContext(ctx, "SELECT "+apiKeyColumns+" FROM api_keys WHERE prefix=$1", prefix)
+	return scanAPIKey(row)
+}
+
+// UpdateAPIKey updates the name, permissions, accounts and expiry of an API key
+func (s *PostgresStore) UpdateAPIKey(ctx context.Context, key *APIKey) error {
+	query := `UPDATE api_keys SET name=$1, permissions=$2, account_ids=$3, expires_at=$4 WHERE id=$5`
+	res, err := s.db.ExecContext(ctx, query, key.Name, pq.Array(key.Permissions), pq.Array(key.AccountIDs), key.ExpiresAt, key.ID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return notFoundError("api key not found")
+	}
+	return nil
+}
+
+// RevokeAPIKey stops an API key from working
+// The row is kept so the key still shows up in listings
+func (s *PostgresStore) RevokeAPIKey(ctx context.Context, id int, at time.Time) error {
+	res, err := s.db.ExecContext(ctx, "UPDATE api_keys SET revoked_at=$1 WHERE id=$2 AND revoked_at IS NULL", at, id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return notFoundError("api key not found or already revoked")
+	}
+	return nil
+}
+
+// TouchAPIKey records when an API key was last used
+func (s *PostgresStore) TouchAPIKey(ctx context.Context, id int, at time.Time) error {
+	_, err := s.db.ExecContext(ctx, "UPDATE api_keys SET last_used_at=$1 WHERE id=$2", at, id)
+	return err
+}
+
+func scanAPIKey(row scanner) (*APIKey, error) {
+	key := new(APIKey)
+	var perms []string
+	var accountIDs []int64
+	var expiresAt, lastUsedAt, revokedAt sql.NullTime
+	err := row.Scan(
+		&key.ID,
+		&key.Name,
+		&key.Prefix,
+		&key.KeyHash,
+		pq.Array(&perms),
+		pq.Array(&accountIDs),
+		&key.CreatedBy,
+		&key.CreatedAt,
+		&expiresAt,
+		&lastUsedAt,
+		&revokedAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, notFoundError("api key not found")
+	}
 	if err != nil {
 		return nil, err
 	}
+	key.Permissions = make([]Permission, len(perms))
+	for i, perm := range perms {
+		key.Permissions[i] = Permission(perm)
+	}
+	key.AccountIDs = make([]int, len(accountIDs))
+	for i, id := range accountIDs {
+		key.AccountIDs[i] = int(id)
+	}
+	key.ExpiresAt = timeFromNullable(expiresAt)
+	key.LastUsedAt = timeFromNullable(lastUsedAt)
+	key.RevokedAt = timeFromNullable(revokedAt)
 
-	return account, nil
+	return key, nil
+}
+
+// sortedUniqueIDs returns the IDs in ascending order without duplicates
+// This is the lock order for LockAccounts
+func sortedUniqueIDs(ids []int) []int {
+	seen := make(map[int]bool, len(ids))
+	sorted := make([]int, 0, len(ids))
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			sorted = append(sorted, id)
+		}
+	}
+	sort.Ints(sorted)
+	return sorted
 }
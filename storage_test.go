@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Helper for connecting to the Postgres database named by TEST_POSTGRES_URL
+// Tests that need Postgres are skipped when it isn't set. The schema is migrated first,
+// and tests only look at rows they created themselves so the database can be reused
+func newPostgresTestStore(t *testing.T) *PostgresStore {
+	t.Helper()
+	url := os.Getenv("TEST_POSTGRES_URL")
+	if url == "" {
+		t.Skip("TEST_POSTGRES_URL is not set")
+	}
+
+	store, err := NewPostgresStore(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	migrator, err := store.Migrator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := migrator.Up(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// Helper for a last name no other test run has used, for filtering down to this test's accounts
+func uniqueTestName() string {
+	return "T" + strconv.FormatInt(time.Now().UnixNano(), 36)
+}
+
+// The conditions are shared by the list and count queries, which read accounts without an alias
+func TestAccountFilterConditions(t *testing.T) {
+	minBalance, maxBalance := int64(10), int64(500)
+	since := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	until := time.Date(2023, 2, 1, 0, 0, 0, 0, time.UTC)
+
+	conditions, args := accountFilterConditions(AccountFilter{
+		NamePrefix:   "Jo_",
+		Status:       StatusActive,
+		Role:         RoleTeller,
+		MinBalance:   &minBalance,
+		MaxBalance:   &maxBalance,
+		CreatedSince: since,
+		CreatedUntil: until,
+	})
+
+	want := []string{
+		"TRUE",
+		"(lower(first_name) LIKE $1 OR lower(last_name) LIKE $1)",
+		"status=$2",
+		"EXISTS (SELECT 1 FROM account_roles WHERE account_roles.account_id = accounts.id AND role=$3)",
+		"balance >= $4",
+		"balance <= $5",
+		"created_at >= $6",
+		"created_at < $7",
+		"deleted_at IS NULL",
+	}
+	if len(conditions) != len(want) {
+		t.Fatalf("got conditions %q, want %q", conditions, want)
+	}
+	for i := range want {
+		if conditions[i] != want[i] {
+			t.Errorf("condition %d is %q, want %q", i, conditions[i], want[i])
+		}
+	}
+
+	wantArgs := []any{`jo\_%`, StatusActive, RoleTeller, minBalance, maxBalance, since, until}
+	if len(args) != len(wantArgs) {
+		t.Fatalf("got args %v, want %v", args, wantArgs)
+	}
+	for i := range wantArgs {
+		if args[i] != wantArgs[i] {
+			t.Errorf("arg %d is %v, want %v", i, args[i], wantArgs[i])
+		}
+	}
+}
+
+// Every filter and sort has to be valid SQL, which only Postgres can tell
+func TestPostgresGetAccountsFilters(t *testing.T) {
+	store := newPostgresTestStore(t)
+	ctx := context.Background()
+	name := uniqueTestName()
+
+	for _, balance := range []int64{100, 200, 300} {
+		createTestAccount(t, store, "Filter", name, balance, RoleCustomer)
+	}
+
+	minBalance := int64(150)
+	base := AccountFilter{
+		NamePrefix:   name,
+		Status:       StatusActive,
+		Role:         RoleCustomer,
+		MinBalance:   &minBalance,
+		CreatedSince: time.Now().Add(-time.Hour),
+		CreatedUntil: time.Now().Add(time.Hour),
+		Limit:        10,
+	}
+	for _, sort := range []AccountSort{SortByID, SortByLastName, SortByBalance, SortByCreatedAt} {
+		t.Run(string(sort), func(t *testing.T) {
+			filter := base
+			filter.Sort = sort
+			filter.Descending = true
+
+			count, err := store.CountAccounts(ctx, filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count != 2 {
+				t.Errorf("counted %d accounts, want 2", count)
+			}
+
+			filter.Limit = 1
+			first, err := store.GetAccounts(ctx, filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(first) != 1 {
+				t.Fatalf("got %d accounts on the first page, want 1", len(first))
+			}
+			filter.After = &AccountCursor{ID: first[0].ID, LastName: first[0].LastName, Balance: first[0].Balance, CreatedAt: first[0].CreatedAt}
+			second, err := store.GetAccounts(ctx, filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(second) != 1 || second[0].ID == first[0].ID {
+				t.Errorf("second page has %v, want the other account", second)
+			}
+		})
+	}
+}
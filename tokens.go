@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"time"
+)
+
+// Access tokens are short-lived and can be revoked by jti
+// Refresh tokens are opaque, stored hashed, and rotated on every use. All refresh tokens
+// descending from one login share a family, and using a token that was already rotated
+// revokes the whole family, since either the client or an attacker has a stolen copy
+// The lifetimes are set from the config at startup, see Config.Apply
+var (
+	accessTokenTTL  = 15 * time.Minute
+	refreshTokenTTL = 30 * 24 * time.Hour
+)
+
+// issueTokens creates an access token and a new refresh token in a family
+// An empty familyID starts a new family, as on login
+// mfa is whether the login passed two-factor authentication, it carries over to every refresh
+func issueTokens(ctx context.Context, s Storage, keys *Keyring, account *Account, familyID string, mfa bool) (*LoginResponse, error) {
+	if familyID == "" {
+		id, err := randomToken(16)
+		if err != nil {
+			return nil, err
+		}
+		familyID = id
+	}
+
+	refresh, err := randomToken(32)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	err = s.CreateRefreshToken(ctx, &RefreshToken{
+		AccountID: account.ID,
+		FamilyID:  familyID,
+		TokenHash: hashToken(refresh),
+		ExpiresAt: now.Add(refreshTokenTTL),
+		CreatedAt: now,
+		MFA:       mfa,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := createJWTToken(keys, account, familyID, mfa)
+	if err != nil {
+		return nil, err
+	}
+
+	return &LoginResponse{
+		AccountNumber: account.AccountNumber,
+		Token:         token,
+		RefreshToken:  refresh,
+		ExpiresIn:     int(accessTokenTTL.Seconds()),
+	}, nil
+}
+
+// refreshTokens exchanges a refresh token for a new access token and refresh token
+// The old refresh token is used up. Presenting it again revokes its family
+func refreshTokens(ctx context.Context, s Storage, keys *Keyring, refresh string) (*LoginResponse, error) {
+	rt, err := s.GetRefreshTokenByHash(ctx, hashToken(refresh))
+	if isErrorCode(err, CodeNotFound) {
+		return nil, unauthorizedError("invalid refresh token")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if rt.RevokedAt != nil {
+		return nil, unauthorizedError("refresh token has been revoked")
+	}
+	if rt.UsedAt != nil {
+		return nil, revokeReusedFamily(ctx, s, rt)
+	}
+	if time.Now().After(rt.ExpiresAt) {
+		return nil, unauthorizedError("refresh token has expired")
+	}
+
+	// Two requests racing with the same token can both get this far, only one can use it
+	used, err := s.UseRefreshToken(ctx, rt.ID)
+	if err != nil {
+		return nil, err
+	}
+	if !used {
+		return nil, revokeReusedFamily(ctx, s, rt)
+	}
+
+	account, err := s.GetAccountByID(ctx, rt.AccountID)
+	if isErrorCode(err, CodeNotFound) {
+		return nil, unauthorizedError("invalid refresh token")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if account.Status == StatusClosed {
+		return nil, unauthorizedError("account is closed")
+	}
+
+	return issueTokens(ctx, s, keys, account, rt.FamilyID, rt.MFA)
+}
+
+// revokeReusedFamily revokes every refresh token in the family of a token that was used twice
+func revokeReusedFamily(ctx context.Context, s Storage, rt *RefreshToken) error {
+	if err := s.RevokeRefreshTokenFamily(ctx, rt.FamilyID); err != nil {
+		return err
+	}
+	return unauthorizedError("refresh token reuse detected, please log in again")
+}
+
+// logout revokes the access token of the session and its refresh token family
+func logout(ctx context.Context, s Storage, session *Session) error {
+	if err := s.RevokeAccessToken(ctx, session.TokenID, session.ExpiresAt); err != nil {
+		return err
+	}
+	if session.FamilyID == "" {
+		return nil
+	}
+	return s.RevokeRefreshTokenFamily(ctx, session.FamilyID)
+}
+
+// randomToken returns n random bytes encoded for use in URLs and headers
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken is how refresh tokens are stored, so a database leak doesn't leak usable tokens
+// The tokens are random enough that a plain SHA-256 is sufficient
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+// Helper for logging in and returning both tokens
+func loginTokens(t *testing.T, h http.Handler, account *Account) LoginResponse {
+	t.Helper()
+	rec := doJSON(t, h, http.MethodPost, "/login", "", LoginRequest{AccountNumber: account.AccountNumber, Password: "password"})
+	var resp LoginResponse
+	decodeResponse(t, rec, &resp)
+	if resp.Token == "" || resp.RefreshToken == "" {
+		t.Fatalf("login didn't return both tokens: %s", rec.Body)
+	}
+	return resp
+}
+
+// Helper for checking whether an access token still gets the account it belongs to
+func tokenWorks(t *testing.T, h http.Handler, token string, account *Account) bool {
+	t.Helper()
+	rec := doJSON(t, h, http.MethodGet, fmt.Sprintf("/account/%d", account.ID), token, nil)
+	return rec.Code == http.StatusOK
+}
+
+// A refresh token works once. Presenting it again logs out everything that came from
+// the same login, but not the account's other logins
+func TestRefreshTokenReuseRevokesFamily(t *testing.T) {
+	h, _, accounts := newTestServer(t)
+	account := accounts[0]
+	first := loginTokens(t, h, account)
+	otherLogin := loginTokens(t, h, account)
+
+	rec := doJSON(t, h, http.MethodPost, "/token/refresh", "", RefreshRequest{RefreshToken: first.RefreshToken})
+	var rotated LoginResponse
+	decodeResponse(t, rec, &rotated)
+	if rotated.RefreshToken == first.RefreshToken || rotated.Token == first.Token {
+		t.Fatal("refreshing returned the same tokens")
+	}
+	if !tokenWorks(t, h, rotated.Token, account) {
+		t.Error("access token from a refresh doesn't work")
+	}
+
+	rec = doJSON(t, h, http.MethodPost, "/token/refresh", "", RefreshRequest{RefreshToken: first.RefreshToken})
+	expectError(t, rec, http.StatusUnauthorized, CodeUnauthorized)
+	rec = doJSON(t, h, http.MethodPost, "/token/refresh", "", RefreshRequest{RefreshToken: rotated.RefreshToken})
+	expectError(t, rec, http.StatusUnauthorized, CodeUnauthorized)
+
+	rec = doJSON(t, h, http.MethodPost, "/token/refresh", "", RefreshRequest{RefreshToken: otherLogin.RefreshToken})
+	if rec.Code != http.StatusOK {
+		t.Errorf("refresh from another login got status %d: %s", rec.Code, rec.Body)
+	}
+
+	rec = doJSON(t, h, http.MethodPost, "/token/refresh", "", RefreshRequest{RefreshToken: "made-up"})
+	expectError(t, rec, http.StatusUnauthorized, CodeUnauthorized)
+}
+
+// Of many requests racing with the same refresh token, only one gets new tokens
+func TestRefreshTokenRaceHasOneWinner(t *testing.T) {
+	h, _, accounts := newTestServer(t)
+	tokens := loginTokens(t, h, accounts[0])
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	statuses := map[int]int{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := doJSON(t, h, http.MethodPost, "/token/refresh", "", RefreshRequest{RefreshToken: tokens.RefreshToken})
+			mu.Lock()
+			statuses[rec.Code]++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	if statuses[http.StatusOK] != 1 || statuses[http.StatusUnauthorized] != 9 {
+		t.Errorf("got statuses %v, want one 200 and the rest 401", statuses)
+	}
+}
+
+// Logging out revokes the access token and the refresh tokens of that login
+func TestLogout(t *testing.T) {
+	h, _, accounts := newTestServer(t)
+	account := accounts[0]
+	tokens := loginTokens(t, h, account)
+	otherLogin := loginTokens(t, h, account)
+
+	rec := doJSON(t, h, http.MethodPost, "/logout", tokens.Token, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("logout got status %d: %s", rec.Code, rec.Body)
+	}
+
+	if tokenWorks(t, h, tokens.Token, account) {
+		t.Error("access token still works after logging out")
+	}
+	rec = doJSON(t, h, http.MethodPost, "/token/refresh", "", RefreshRequest{RefreshToken: tokens.RefreshToken})
+	expectError(t, rec, http.StatusUnauthorized, CodeUnauthorized)
+	if !tokenWorks(t, h, otherLogin.Token, account) {
+		t.Error("logging out of one login logged out another")
+	}
+
+	// Access tokens can't be used as refresh tokens, or the other way around
+	rec = doJSON(t, h, http.MethodPost, "/token/refresh", "", RefreshRequest{RefreshToken: otherLogin.Token})
+	expectError(t, rec, http.StatusUnauthorized, CodeUnauthorized)
+	if tokenWorks(t, h, otherLogin.RefreshToken, account) {
+		t.Error("a refresh token was accepted as an access token")
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// Helper for reading one page of an account's transaction history
+func getTransactions(t *testing.T, h http.Handler, token string, id int, query url.Values) TransactionsResponse {
+	t.Helper()
+	rec := doJSON(t, h, http.MethodGet, fmt.Sprintf("/account/%d/transactions?%s", id, query.Encode()), token, nil)
+	var resp TransactionsResponse
+	decodeResponse(t, rec, &resp)
+	return resp
+}
+
+func TestHandleGetTransactions(t *testing.T) {
+	h, _, accounts := newTestServer(t)
+	a, b := accounts[0], accounts[1]
+	tokenA := login(t, h, a)
+	tokenB := login(t, h, b)
+
+	for _, amount := range []int{10, 20, 30} {
+		rec := doJSON(t, h, http.MethodPost, "/transfer", tokenA, TransferRequest{ToAccountNumber: b.AccountNumber, Amount: amount})
+		if rec.Code != http.StatusOK {
+			t.Fatalf("transfer got status %d: %s", rec.Code, rec.Body)
+		}
+	}
+	rec := doJSON(t, h, http.MethodPost, "/transfer", tokenB, TransferRequest{ToAccountNumber: a.AccountNumber, Amount: 5})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("transfer got status %d: %s", rec.Code, rec.Body)
+	}
+
+	// Debits are negative and newest first
+	debits := getTransactions(t, h, tokenA, a.ID, url.Values{"direction": {DirectionDebit}})
+	want := []int64{-30, -20, -10}
+	if len(debits.Transactions) != len(want) {
+		t.Fatalf("got %d debits, want %d", len(debits.Transactions), len(want))
+	}
+	for i, txn := range debits.Transactions {
+		if txn.Direction != DirectionDebit || txn.Amount != want[i] {
+			t.Errorf("debit %d is %s %d, want debit %d", i, txn.Direction, txn.Amount, want[i])
+		}
+		if txn.CounterpartyAccountNumber == nil || *txn.CounterpartyAccountNumber != b.AccountNumber {
+			t.Errorf("debit %d has counterparty %v, want %d", i, txn.CounterpartyAccountNumber, b.AccountNumber)
+		}
+	}
+	if debits.NextCursor != "" {
+		t.Errorf("the only page has a next cursor %q", debits.NextCursor)
+	}
+
+	credits := getTransactions(t, h, tokenA, a.ID, url.Values{"direction": {DirectionCredit}})
+	if len(credits.Transactions) == 0 || credits.Transactions[0].Amount != 5 {
+		t.Errorf("newest credit isn't the 5 from the other account: %+v", credits.Transactions)
+	}
+	for _, txn := range credits.Transactions {
+		if txn.Direction != DirectionCredit {
+			t.Errorf("credit filter returned a %s", txn.Direction)
+		}
+	}
+
+	// Following the cursors visits the same transactions as one big page
+	all := getTransactions(t, h, tokenA, a.ID, url.Values{})
+	var paged []*Transaction
+	query := url.Values{"limit": {"2"}}
+	for {
+		page := getTransactions(t, h, tokenA, a.ID, query)
+		paged = append(paged, page.Transactions...)
+		if page.NextCursor == "" {
+			break
+		}
+		query.Set("cursor", page.NextCursor)
+	}
+	if len(paged) != len(all.Transactions) {
+		t.Fatalf("paging gave %d transactions, one page gave %d", len(paged), len(all.Transactions))
+	}
+	for i := range paged {
+		if paged[i].TransferID != all.Transactions[i].TransferID {
+			t.Errorf("transaction %d is %d when paging, %d on one page", i, paged[i].TransferID, all.Transactions[i].TransferID)
+		}
+	}
+
+	future := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	if resp := getTransactions(t, h, tokenA, a.ID, url.Values{"since": {future}}); len(resp.Transactions) != 0 {
+		t.Errorf("got %d transactions since an hour from now", len(resp.Transactions))
+	}
+	if resp := getTransactions(t, h, tokenA, a.ID, url.Values{"until": {future}}); len(resp.Transactions) != len(all.Transactions) {
+		t.Errorf("got %d transactions until an hour from now, want all %d", len(resp.Transactions), len(all.Transactions))
+	}
+
+	// Customers can only read their own history
+	rec = doJSON(t, h, http.MethodGet, fmt.Sprintf("/account/%d/transactions", b.ID), tokenA, nil)
+	expectError(t, rec, http.StatusForbidden, CodeForbidden)
+
+	for _, query := range []string{"direction=sideways", "since=yesterday", "limit=0", "limit=101", "cursor=%25%25"} {
+		rec = doJSON(t, h, http.MethodGet, fmt.Sprintf("/account/%d/transactions?%s", a.ID, query), tokenA, nil)
+		expectError(t, rec, http.StatusBadRequest, CodeValidation)
+	}
+}
@@ -9,50 +9,378 @@ import (
 type apiFunc func(w http.ResponseWriter, r *http.Request) error
 
 // Api error type for server error responses
+// See errors.go for the codes and the statuses they are sent with
 type ApiError struct {
-	Error string `json:"error"`
+	Error     string       `json:"error"`
+	Code      ErrorCode    `json:"code"`
+	Fields    []FieldError `json:"fields,omitempty"`
+	RequestID string       `json:"request_id,omitempty"`
 }
 
 // TransferRequest is the request body for the transfer endpoint
+// Accounts are addressed by the account numbers customers see, not internal IDs
+// The validate tags are checked by decodeJSON, see validate.go
 type TransferRequest struct {
-	ToAccountID   int `json:"to_account_id"`
-	FromAccountID int `json:"from_account_id"`
-	Amount        int `json:"amount"`
+	ToAccountNumber   int64 `json:"to_account_number" validate:"required,accountnumber"`
+	FromAccountNumber int64 `json:"from_account_number" validate:"omitempty,accountnumber"`
+	Amount            int   `json:"amount" validate:"min=1"`
 }
 
-// Account is the model for storing account information
-type Account struct {
-	ID                int       `json:"id"`
-	FirstName         string    `json:"first_name"`
-	LastName          string    `json:"last_name"`
-	EncryptedPassword string    `json:"-"`
-	AccountNumber     int64     `json:"account_number"`
+// An account can't send money to itself
+func (t *TransferRequest) validateFields() []FieldError {
+	if t.FromAccountNumber != 0 && t.FromAccountNumber == t.ToAccountNumber {
+		return []FieldError{{Field: "to_account_number", Message: "to_account_number must be a different account from from_account_number"}}
+	}
+	return nil
+}
+
+// TransferReceipt is returned by the transfer endpoint
+// Balance is the balance of the from account after the transfer
+type TransferReceipt struct {
+	TransferID        int       `json:"transfer_id"`
+	FromAccountNumber int64     `json:"from_account_number"`
+	ToAccountNumber   int64     `json:"to_account_number"`
+	Amount            int64     `json:"amount"`
 	Balance           int64     `json:"balance"`
 	CreatedAt         time.Time `json:"created_at"`
-	IsAdmin           bool      `json:"is_admin"`
+}
+
+// Account is the model for storing account information
+type Account struct {
+	ID                int           `json:"id"`
+	FirstName         string        `json:"first_name"`
+	LastName          string        `json:"last_name"`
+	EncryptedPassword string        `json:"-"`
+	AccountNumber     int64         `json:"account_number"`
+	Balance           int64         `json:"balance"`
+	CreatedAt         time.Time     `json:"created_at"`
+	Roles             []Role        `json:"roles"`
+	Status            AccountStatus `json:"status"`
+	ClosedAt          *time.Time    `json:"closed_at,omitempty"`
+	DeletedAt         *time.Time    `json:"deleted_at,omitempty"`
+	MFASecret         string        `json:"-"` // Encrypted, empty if two-factor authentication was never set up
+	MFAEnabled        bool          `json:"mfa_enabled"`
+	TokensValidAfter  *time.Time    `json:"-"` // Set when the password changes, older tokens are rejected
+	// Bumped when the details, roles or status change, and sent as the ETag, see patch.go
+	// Balance changes from transfers don't bump it
+	Version int `json:"version"`
+}
+
+// AccountStatus is where an account is in its lifecycle
+// See accountTransitions in lifecycle.go for the allowed moves between them
+type AccountStatus string
+
+const (
+	StatusPending AccountStatus = "pending"
+	StatusActive  AccountStatus = "active"
+	StatusFrozen  AccountStatus = "frozen"
+	StatusClosed  AccountStatus = "closed"
+)
+
+// AccountFilter narrows, orders and pages the accounts returned by GetAccounts
+// Empty fields don't filter. NamePrefix matches the start of the first or last name, ignoring case
+// Balances are inclusive, CreatedSince is inclusive and CreatedUntil exclusive
+// Limit is required, the stores refuse to list every account at once
+type AccountFilter struct {
+	NamePrefix     string
+	Status         AccountStatus
+	Role           Role
+	MinBalance     *int64
+	MaxBalance     *int64
+	CreatedSince   time.Time
+	CreatedUntil   time.Time
+	IncludeDeleted bool
+
+	Sort       AccountSort
+	Descending bool
+	After      *AccountCursor // Where the previous page ended, nil for the first page
+	Limit      int
+}
+
+// AccountSort is a field accounts can be listed in order of
+// Accounts with the same value are ordered by ID, so every order is stable for paging
+type AccountSort string
+
+const (
+	SortByID        AccountSort = "id"
+	SortByLastName  AccountSort = "last_name"
+	SortByBalance   AccountSort = "balance"
+	SortByCreatedAt AccountSort = "created_at"
+)
+
+// AccountCursor is the last account of a page, as far as the sort order is concerned
+// Only the field being sorted by is used, along with the ID
+type AccountCursor struct {
+	ID        int
+	LastName  string
+	Balance   int64
+	CreatedAt time.Time
+}
+
+// AccountsResponse is one page of accounts
+// Total is how many accounts match the filter across every page. NextCursor is empty on the last page
+type AccountsResponse struct {
+	Accounts   []*Account `json:"accounts"`
+	Total      int        `json:"total"`
+	NextCursor string     `json:"next_cursor,omitempty"`
+}
+
+// Request body for moving an account to a new lifecycle status
+type AccountStatusRequest struct {
+	Status AccountStatus `json:"status" validate:"required"`
 }
 
 type LoginRequest struct {
-	AccountNumber int64  `json:"account_number"`
-	Password      string `json:"password"`
+	AccountNumber int64  `json:"account_number" validate:"required,accountnumber"`
+	Password      string `json:"password" validate:"required"`
 }
 
 type LoginResponse struct {
 	AccountNumber int64  `json:"sub"` // Sub is part of the JWT spec
 	Token         string `json:"access_token"`
+	RefreshToken  string `json:"refresh_token"`
+	ExpiresIn     int    `json:"expires_in"` // Seconds until the access token expires
+}
+
+// Returned by /login instead of tokens when the account has two-factor authentication on
+// The MFA token is exchanged for tokens at /login/mfa along with a code
+type MFAChallengeResponse struct {
+	MFARequired bool   `json:"mfa_required"`
+	MFAToken    string `json:"mfa_token"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+// Request body for the second step of logging in
+type MFALoginRequest struct {
+	MFAToken string `json:"mfa_token" validate:"required"`
+	Code     string `json:"code" validate:"required"`
+}
+
+// Request body for confirming or disabling two-factor authentication
+// Code is a code from the authenticator app, or a recovery code
+type MFACodeRequest struct {
+	Code string `json:"code" validate:"required"`
+}
+
+// Returned when two-factor authentication is set up
+// The secret is only shown this once, it has to be confirmed with a code before it is used
+type MFAEnrollResponse struct {
+	Secret     string `json:"secret"`
+	OTPAuthURI string `json:"otpauth_uri"`
+}
+
+// Returned when two-factor authentication is confirmed
+// The recovery codes are only shown this once
+type MFARecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// Request body for changing your own password
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password" validate:"required"`
+	NewPassword     string `json:"new_password" validate:"required"`
+}
+
+// Request body for setting a new password with a reset token
+type ResetPasswordRequest struct {
+	Token       string `json:"token" validate:"required"`
+	NewPassword string `json:"new_password" validate:"required"`
+}
+
+// PasswordResetToken is a stored password reset token
+// Only the hash of the token is kept. UsedAt is set when the password is reset with it
+type PasswordResetToken struct {
+	ID        int
+	AccountID int
+	TokenHash string
+	ExpiresAt time.Time
+	CreatedAt time.Time
+	UsedAt    *time.Time
+}
+
+// Request body for exchanging a refresh token for new tokens
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token" validate:"required"`
+}
+
+// RefreshToken is a stored refresh token
+// Only the hash of the token is kept. UsedAt is set when the token is rotated
+type RefreshToken struct {
+	ID        int
+	AccountID int
+	FamilyID  string
+	TokenHash string
+	ExpiresAt time.Time
+	CreatedAt time.Time
+	UsedAt    *time.Time
+	RevokedAt *time.Time
+	MFA       bool // Whether the login the family came from passed two-factor authentication
 }
 
 type CreateAccountRequest struct {
-	FirstName string `json:"first_name"`
-	LastName  string `json:"last_name"`
-	Password  string `json:"password"`
-	Balance   int64  `json:"balance"`
-	IsAdmin   bool   `json:"is_admin"`
+	FirstName string `json:"first_name" validate:"required,max=50"`
+	LastName  string `json:"last_name" validate:"required,max=50"`
+	Password  string `json:"password" validate:"required"`
+	Balance   int64  `json:"balance" validate:"min=0"`
+	Roles     []Role `json:"roles"`
+	// Status is optional and must be pending or active. Defaults to active
+	Status AccountStatus `json:"status"`
 }
 
 type UpdateAccountRequest struct {
-	FirstName     string `json:"first_name"`
-	LastName      string `json:"last_name"`
-	AccountNumber int64  `json:"account_number"`
-	IsAdmin       bool   `json:"is_admin"`
+	FirstName     string `json:"first_name" validate:"required,max=50"`
+	LastName      string `json:"last_name" validate:"required,max=50"`
+	AccountNumber int64  `json:"account_number" validate:"required,accountnumber"`
+	Roles         []Role `json:"roles"`
+}
+
+// Kinds of transfer recorded in the journal
+const (
+	TransferKindTransfer = "transfer"
+	TransferKindDeposit  = "deposit"
+)
+
+// Transfer is one entry in the double-entry journal
+// FromAccountID is nil when money enters the bank from outside, e.g. an opening deposit
+// The account numbers are looked up when the transfer is read, for showing to customers
+type Transfer struct {
+	ID                int        `json:"id"`
+	Kind              string     `json:"kind"`
+	FromAccountID     *int       `json:"from_account_id"`
+	ToAccountID       int        `json:"to_account_id"`
+	FromAccountNumber *int64     `json:"from_account_number"`
+	ToAccountNumber   int64      `json:"to_account_number"`
+	Amount            int64      `json:"amount"`
+	CreatedAt         time.Time  `json:"created_at"`
+	Postings          []*Posting `json:"postings,omitempty"`
+}
+
+// Posting is one side of a transfer
+// Debits are negative and credits are positive, so the postings of a transfer sum to zero
+// AccountID is nil for the outside-world side of a deposit
+type Posting struct {
+	ID         int       `json:"id"`
+	TransferID int       `json:"transfer_id"`
+	AccountID  *int      `json:"account_id"`
+	Amount     int64     `json:"amount"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// Directions of a transfer relative to one account
+const (
+	DirectionDebit  = "debit"
+	DirectionCredit = "credit"
+)
+
+// TransferFilter narrows the transfers returned for an account
+// Zero values mean no filter. BeforeID is the keyset cursor for paging backwards
+type TransferFilter struct {
+	Direction string
+	Since     time.Time
+	Until     time.Time
+	BeforeID  int
+	Limit     int
+}
+
+// Transaction is a transfer seen from the side of one account, used for statements
+// Amount is negative for debits and positive for credits
+// The counterparty is the account number the customer knows, nil for money from outside the bank
+type Transaction struct {
+	TransferID                int       `json:"transfer_id"`
+	Kind                      string    `json:"kind"`
+	Direction                 string    `json:"direction"`
+	Amount                    int64     `json:"amount"`
+	CounterpartyAccountNumber *int64    `json:"counterparty_account_number"`
+	CreatedAt                 time.Time `json:"created_at"`
+}
+
+// TransactionsResponse is one page of an account's transaction history
+// NextCursor is empty on the last page
+type TransactionsResponse struct {
+	Transactions []*Transaction `json:"transactions"`
+	NextCursor   string         `json:"next_cursor,omitempty"`
+}
+
+// IdempotencyRecord is the stored outcome of a request made with an Idempotency-Key header
+// Keys are scoped per caller. StatusCode is 0 while the first request is still in flight
+type IdempotencyRecord struct {
+	Caller      string // See Principal.CallerID
+	Key         string
+	RequestHash string
+	StatusCode  int
+	Body        []byte
+	CreatedAt   time.Time
+}
+
+// LoginThrottle tracks failed logins for an account number or an IP address
+// Failures is reset after a quiet period, LockedUntil is set once there are too many
+type LoginThrottle struct {
+	Key           string
+	Failures      int
+	LastFailureAt time.Time
+	LockedUntil   *time.Time
+}
+
+// SecurityEventKind is the type of a security event
+type SecurityEventKind string
+
+const (
+	EventLoginFailed     SecurityEventKind = "login_failed"
+	EventLoginLocked     SecurityEventKind = "login_locked"
+	EventAccountUnlocked SecurityEventKind = "account_unlocked"
+
+	EventPasswordChanged        SecurityEventKind = "password_changed"
+	EventPasswordResetRequested SecurityEventKind = "password_reset_requested"
+	EventPasswordReset          SecurityEventKind = "password_reset"
+)
+
+// SecurityEvent is a record of something a security review should see
+// AccountNumber is the number that was tried, which may not belong to any account
+type SecurityEvent struct {
+	ID            int               `json:"id"`
+	Kind          SecurityEventKind `json:"kind"`
+	AccountNumber int64             `json:"account_number,omitempty"`
+	IP            string            `json:"ip,omitempty"`
+	Detail        string            `json:"detail,omitempty"`
+	CreatedAt     time.Time         `json:"created_at"`
+}
+
+// SecurityEventFilter narrows the security events returned
+// Zero values mean no filter. Events are returned newest first
+type SecurityEventFilter struct {
+	AccountNumber int64
+	Kind          SecurityEventKind
+	Limit         int
+}
+
+// APIKey lets a service authenticate without logging in, with the X-API-Key header
+// Only a hash of the key is stored. Prefix is the start of the key, kept to tell keys apart
+// AccountIDs limits the key to those accounts, an empty list means any account
+type APIKey struct {
+	ID          int          `json:"id"`
+	Name        string       `json:"name"`
+	Prefix      string       `json:"prefix"`
+	KeyHash     string       `json:"-"`
+	Permissions []Permission `json:"permissions"`
+	AccountIDs  []int        `json:"account_ids"`
+	CreatedBy   int          `json:"created_by"`
+	CreatedAt   time.Time    `json:"created_at"`
+	ExpiresAt   *time.Time   `json:"expires_at,omitempty"`
+	LastUsedAt  *time.Time   `json:"last_used_at,omitempty"`
+	RevokedAt   *time.Time   `json:"revoked_at,omitempty"`
+}
+
+// Request body for creating or updating an API key
+type APIKeyRequest struct {
+	Name        string       `json:"name" validate:"required,max=100"`
+	Permissions []Permission `json:"permissions" validate:"required"`
+	AccountIDs  []int        `json:"account_ids"`
+	ExpiresAt   *time.Time   `json:"expires_at"`
+}
+
+// Returned when an API key is created
+// The key itself is only shown this once
+type CreateAPIKeyResponse struct {
+	Key string `json:"key"`
+	*APIKey
 }
@@ -1,19 +1,22 @@
 package main
 
 import (
+	"encoding/base64"
 	"encoding/json"
-	"math/rand"
+	"fmt"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
-
-	"golang.org/x/crypto/bcrypt"
 )
 
 // this function is for the router to be able take requests and return responses
+// Errors returned by the handler are turned into responses by writeError in errors.go
 func MakeHTTPHandlerFunc(fn apiFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if err := fn(w, r); err != nil {
-			WriteJSON(w, http.StatusBadRequest, ApiError{Error: err.Error()})
+			writeError(w, r, err)
 		}
 	}
 }
@@ -28,10 +31,14 @@ func WriteJSON(w http.ResponseWriter, status int, v any) error {
 
 // NewAccount creates a new account and hashes the password
 // This function is used in the seedAccounts function in main.go
-// Currently the account number is a random number between 0 and 1,000,000
-// In the future we will want to make sure that the account number is unique
-func NewAccount(firstName, lastName, password string, isAdmin bool,  balance ...int64) (*Account, error) {
-	encpw, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+// The account number is random with a check digit, see accountnumber.go
+// CreateAccount replaces it if it turns out to be taken
+func NewAccount(firstName, lastName, password string, roles []Role, balance ...int64) (*Account, error) {
+	encpw, err := hashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+	number, err := generateAccountNumber()
 	if err != nil {
 		return nil, err
 	}
@@ -43,11 +50,229 @@ func NewAccount(firstName, lastName, password string, isAdmin bool,  balance ...
 	return &Account{
 		FirstName:         firstName,
 		LastName:          lastName,
-		EncryptedPassword: string(encpw),
-		AccountNumber:     int64(rand.Intn(1000000)),
+		EncryptedPassword: encpw,
+		AccountNumber:     number,
 		Balance:           bal,
 		CreatedAt:         time.Now().UTC(),
-		IsAdmin:           isAdmin,
+		Roles:             roles,
+		Status:            StatusActive,
+		Version:           1,
 	}, nil
 
 }
+
+// Limits for paging through transaction history
+const (
+	defaultTransactionsLimit = 50
+	maxTransactionsLimit     = 100
+)
+
+// parseTransferFilter builds a TransferFilter from the query string of the transactions endpoint
+func parseTransferFilter(q url.Values) (*TransferFilter, error) {
+	filter := &TransferFilter{Limit: defaultTransactionsLimit}
+
+	switch d := q.Get("direction"); d {
+	case "", DirectionDebit, DirectionCredit:
+		filter.Direction = d
+	default:
+		return nil, fieldError("direction", "invalid direction %s", d)
+	}
+
+	if v := q.Get("since"); v != "" {
+		since, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil, fieldError("since", "invalid since %s", v)
+		}
+		filter.Since = since.UTC()
+	}
+	if v := q.Get("until"); v != "" {
+		until, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil, fieldError("until", "invalid until %s", v)
+		}
+		filter.Until = until.UTC()
+	}
+
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxTransactionsLimit {
+			return nil, fieldError("limit", "limit must be between 1 and %d", maxTransactionsLimit)
+		}
+		filter.Limit = limit
+	}
+
+	if v := q.Get("cursor"); v != "" {
+		id, err := decodeCursor(v)
+		if err != nil {
+			return nil, fieldError("cursor", "invalid cursor")
+		}
+		filter.BeforeID = id
+	}
+
+	return filter, nil
+}
+
+// Cursors are opaque to clients so the paging key can change without breaking them
+func encodeCursor(id int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(id)))
+}
+
+func decodeCursor(cursor string) (int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, err
+	}
+	id, err := strconv.Atoi(string(b))
+	if err != nil || id < 1 {
+		return 0, fmt.Errorf("invalid cursor")
+	}
+	return id, nil
+}
+
+// Limits for paging through accounts
+const (
+	defaultAccountsLimit = 50
+	maxAccountsLimit     = 100
+)
+
+// parseAccountFilter builds an AccountFilter from the query string of the accounts endpoint
+func parseAccountFilter(q url.Values) (*AccountFilter, error) {
+	filter := &AccountFilter{
+		NamePrefix:     strings.TrimSpace(q.Get("name")),
+		Status:         AccountStatus(q.Get("status")),
+		Role:           Role(q.Get("role")),
+		IncludeDeleted: q.Get("include_deleted") == "true",
+		Sort:           SortByID,
+		Limit:          defaultAccountsLimit,
+	}
+	if filter.Status != "" && !filter.Status.Valid() {
+		return nil, fieldError("status", "invalid status %s", filter.Status)
+	}
+	if filter.Role != "" && !filter.Role.Valid() {
+		return nil, fieldError("role", "invalid role %s", filter.Role)
+	}
+
+	for _, b := range []struct {
+		name  string
+		field **int64
+	}{{"min_balance", &filter.MinBalance}, {"max_balance", &filter.MaxBalance}} {
+		v := q.Get(b.name)
+		if v == "" {
+			continue
+		}
+		balance, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, fieldError(b.name, "%s must be a whole number", b.name)
+		}
+		*b.field = &balance
+	}
+
+	if v := q.Get("created_since"); v != "" {
+		since, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil, fieldError("created_since", "invalid created_since %s", v)
+		}
+		filter.CreatedSince = since.UTC()
+	}
+	if v := q.Get("created_until"); v != "" {
+		until, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil, fieldError("created_until", "invalid created_until %s", v)
+		}
+		filter.CreatedUntil = until.UTC()
+	}
+
+	if v := q.Get("sort"); v != "" {
+		field := strings.TrimPrefix(v, "-")
+		switch sort := AccountSort(field); sort {
+		case SortByID, SortByLastName, SortByBalance, SortByCreatedAt:
+			filter.Sort = sort
+			filter.Descending = field != v
+		default:
+			return nil, fieldError("sort", "can't sort by %s", field)
+		}
+	}
+
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxAccountsLimit {
+			return nil, fieldError("limit", "limit must be between 1 and %d", maxAccountsLimit)
+		}
+		filter.Limit = limit
+	}
+
+	if v := q.Get("cursor"); v != "" {
+		after, err := decodeAccountCursor(v, filter.Sort, filter.Descending)
+		if err != nil {
+			return nil, fieldError("cursor", "invalid cursor")
+		}
+		filter.After = after
+	}
+
+	return filter, nil
+}
+
+// accountCursor is what an accounts cursor holds
+// The sort order is kept so a cursor can't be used with a different one
+type accountCursor struct {
+	Sort       AccountSort `json:"s"`
+	Descending bool        `json:"d,omitempty"`
+	ID         int         `json:"i"`
+	LastName   string      `json:"n,omitempty"`
+	Balance    int64       `json:"b,omitempty"`
+	CreatedAt  *time.Time  `json:"c,omitempty"`
+}
+
+// encodeAccountCursor makes the cursor for the page after acc
+func encodeAccountCursor(acc *Account, filter *AccountFilter) string {
+	c := accountCursor{Sort: filter.Sort, Descending: filter.Descending, ID: acc.ID}
+	switch filter.Sort {
+	case SortByLastName:
+		c.LastName = acc.LastName
+	case SortByBalance:
+		c.Balance = acc.Balance
+	case SortByCreatedAt:
+		c.CreatedAt = &acc.CreatedAt
+	}
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeAccountCursor(cursor string, sort AccountSort, descending bool) (*AccountCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, err
+	}
+	var c accountCursor
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, err
+	}
+	if c.ID < 1 || c.Sort != sort || c.Descending != descending {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	after := &AccountCursor{ID: c.ID, LastName: c.LastName, Balance: c.Balance}
+	if c.CreatedAt != nil {
+		after.CreatedAt = *c.CreatedAt
+	}
+	return after, nil
+}
+
+// transactionForAccount turns a journal transfer into a statement line for one account
+func transactionForAccount(t *Transfer, accountID int) *Transaction {
+	txn := &Transaction{
+		TransferID: t.ID,
+		Kind:       t.Kind,
+		CreatedAt:  t.CreatedAt,
+	}
+	if t.FromAccountID != nil && *t.FromAccountID == accountID {
+		txn.Direction = DirectionDebit
+		txn.Amount = -t.Amount
+		to := t.ToAccountNumber
+		txn.CounterpartyAccountNumber = &to
+	} else {
+		txn.Direction = DirectionCredit
+		txn.Amount = t.Amount
+		txn.CounterpartyAccountNumber = t.FromAccountNumber
+	}
+	return txn
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Request bodies larger than this are rejected before they are decoded
+const maxRequestBodyBytes = 64 << 10
+
+// Middleware for capping the size of request bodies
+// Reading past the limit fails with *http.MaxBytesError, which decodeJSON and the
+// idempotency middleware turn into a 413
+func limitRequestBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodyBytes)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// decodeJSON decodes a request body into v and validates it
+// The body must be a single JSON object with only the fields v knows about,
+// see validateStruct for the rules that can be put on the fields
+func decodeJSON(r *http.Request, v any) error {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return decodeError(err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return validationError("request body must be a single JSON object")
+	}
+	return validateStruct(v)
+}
+
+// Helper for turning an error from the JSON decoder into one for the client
+func decodeError(err error) error {
+	var maxBytes *http.MaxBytesError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &maxBytes):
+		return newError(CodeRequestTooLarge, "request body must be at most %d bytes", maxBytes.Limit)
+	case errors.As(err, &typeErr) && typeErr.Field != "":
+		return fieldError(typeErr.Field, "%s must be a %s", typeErr.Field, jsonTypeName(typeErr.Type))
+	case errors.Is(err, io.EOF):
+		return validationError("request body is empty")
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		// The decoder has no error type for this, the field name is only in the message
+		field, _ := strconv.Unquote(strings.TrimPrefix(err.Error(), "json: unknown field "))
+		return fieldError(field, "unknown field %s", field)
+	default:
+		return validationError("invalid request body")
+	}
+}
+
+// Helper for describing a Go type the way it looks in JSON
+func jsonTypeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "whole number"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Slice, reflect.Array:
+		return "list"
+	default:
+		return "object"
+	}
+}
+
+// crossFieldValidator is implemented by requests with rules that involve more than one field
+// It runs after the tag rules and its errors are returned along with theirs
+type crossFieldValidator interface {
+	validateFields() []FieldError
+}
+
+// validateStruct checks the validate tags on the fields of a struct
+// Rules are separated by commas and checked in order, stopping at the first that fails:
+//
+//	required       the field must not be the zero value (empty or blank string, 0, empty list)
+//	omitempty      skip the other rules when the field is the zero value
+//	min=N, max=N   length in characters for strings, value for numbers, length for lists
+//	accountnumber  the field must be a valid account number, see accountnumber.go
+//
+// Every field is checked so the client gets all of the problems at once
+func validateStruct(v any) error {
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	if rv.Kind() != reflect.Struct {
+		return nil
+	}
+
+	var fields []FieldError
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		sf := rt.Field(i)
+		rules := sf.Tag.Get("validate")
+		if rules == "" || !sf.IsExported() {
+			continue
+		}
+		name := jsonFieldName(sf)
+		if msg := checkRules(name, rv.Field(i), rules); msg != "" {
+			fields = append(fields, FieldError{Field: name, Message: msg})
+		}
+	}
+	if cv, ok := v.(crossFieldValidator); ok {
+		fields = append(fields, cv.validateFields()...)
+	}
+
+	if len(fields) == 0 {
+		return nil
+	}
+	msgs := make([]string, len(fields))
+	for i, f := range fields {
+		msgs[i] = f.Message
+	}
+	return &Error{Code: CodeValidation, Message: strings.Join(msgs, "; "), Fields: fields}
+}
+
+// Helper for getting the name a field has in JSON
+func jsonFieldName(sf reflect.StructField) string {
+	name, _, _ := strings.Cut(sf.Tag.Get("json"), ",")
+	if name == "" || name == "-" {
+		return sf.Name
+	}
+	return name
+}
+
+// checkRules checks one field against its rules and returns what is wrong with it, if anything
+func checkRules(name string, fv reflect.Value, rules string) string {
+	for _, rule := range strings.Split(rules, ",") {
+		rule, arg, _ := strings.Cut(strings.TrimSpace(rule), "=")
+		switch rule {
+		case "required":
+			if fv.IsZero() || (fv.Kind() == reflect.Slice && fv.Len() == 0) ||
+				(fv.Kind() == reflect.String && strings.TrimSpace(fv.String()) == "") {
+				return fmt.Sprintf("%s is required", name)
+			}
+		case "omitempty":
+			if fv.IsZero() {
+				return ""
+			}
+		case "min", "max":
+			n, err := strconv.ParseInt(arg, 10, 64)
+			if err != nil {
+				panic(fmt.Sprintf("bad %s rule on %s: %q", rule, name, arg))
+			}
+			if msg := checkBound(name, fv, rule, n); msg != "" {
+				return msg
+			}
+		case "accountnumber":
+			if !AcceptedAccountNumber(fv.Int()) {
+				return fmt.Sprintf("%s is not a valid account number", name)
+			}
+		default:
+			panic(fmt.Sprintf("unknown validation rule %q on %s", rule, name))
+		}
+	}
+	return ""
+}
+
+// checkBound checks a min or max rule
+func checkBound(name string, fv reflect.Value, rule string, n int64) string {
+	var size int64
+	var unit string
+	switch fv.Kind() {
+	case reflect.String:
+		size, unit = int64(utf8.RuneCountInString(fv.String())), " characters"
+	case reflect.Slice:
+		size, unit = int64(fv.Len()), " items"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		size = fv.Int()
+	default:
+		panic(fmt.Sprintf("%s rule can't be used on %s", rule, name))
+	}
+
+	if rule == "min" && size < n {
+		return fmt.Sprintf("%s must be at least %d%s", name, n, unit)
+	}
+	if rule == "max" && size > n {
+		return fmt.Sprintf("%s must be at most %d%s", name, n, unit)
+	}
+	return ""
+}
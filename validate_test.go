@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestValidateStructRequired(t *testing.T) {
+	tests := []struct {
+		name      string
+		firstName string
+		valid     bool
+	}{
+		{"set", "Jo", true},
+		{"padded", " Jo ", true},
+		{"empty", "", false},
+		{"spaces", "   ", false},
+		{"tabs and newlines", "\t\n", false},
+	}
+	for _, tt := range tests {
+		err := validateStruct(&CreateAccountRequest{FirstName: tt.firstName, LastName: "Smith", Password: "password"})
+		if tt.valid && err != nil {
+			t.Errorf("%s: got %v, want no error", tt.name, err)
+		}
+		if !tt.valid && !isErrorCode(err, CodeValidation) {
+			t.Errorf("%s: got %v, want a validation error", tt.name, err)
+		}
+	}
+}
+
+// A name of only spaces is as good as no name, whichever way it is sent
+func TestBlankNamesAreRequired(t *testing.T) {
+	h, store, accounts := newTestServer(t)
+	teller := createTestAccount(t, store, "Blank", "Teller", 0, RoleTeller)
+	token := login(t, h, teller)
+	path := fmt.Sprintf("/account/%d", accounts[0].ID)
+
+	rec := doJSON(t, h, http.MethodPost, "/accounts", token, CreateAccountRequest{FirstName: "   ", LastName: "Smith", Password: "Passw0rd-long!"})
+	expectBlankFirstName(t, rec)
+
+	rec = doJSON(t, h, http.MethodPut, path, token, UpdateAccountRequest{
+		FirstName:     "   ",
+		LastName:      accounts[0].LastName,
+		AccountNumber: accounts[0].AccountNumber,
+		Roles:         accounts[0].Roles,
+	})
+	expectBlankFirstName(t, rec)
+
+	rec = doJSONWithHeaders(t, h, http.MethodPatch, path, token, map[string]string{"first_name": " "}, map[string]string{"If-Match": "*"})
+	expectBlankFirstName(t, rec)
+}
+
+// Helper for checking a response is a validation error on first_name
+func expectBlankFirstName(t *testing.T, rec *httptest.ResponseRecorder) {
+	t.Helper()
+	expectError(t, rec, http.StatusBadRequest, CodeValidation)
+	var apiErr ApiError
+	if err := json.Unmarshal(rec.Body.Bytes(), &apiErr); err != nil {
+		t.Fatal(err)
+	}
+	if len(apiErr.Fields) != 1 || apiErr.Fields[0].Field != "first_name" {
+		t.Errorf("got field errors %v, want one on first_name", apiErr.Fields)
+	}
+}